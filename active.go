@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Callback data prefix of the Cancel button on the placeholder message
+const stopCallbackPrefix = "stop:"
+
+// errStoppedByUser is the cancellation cause when the user stops a generation
+var errStoppedByUser = errors.New("stopped by user")
+
+// activeRequest describes a generation that is currently running in a chat
+type activeRequest struct {
+	requestID string
+	model     string
+	query     string
+	startedAt time.Time
+	cancel    context.CancelCauseFunc
+}
+
+var (
+	activeRequests   = make(map[int64]*activeRequest) // chat ID -> running request
+	activeRequestsMu sync.Mutex
+)
+
+// Register a running request for a chat and return the context to use for it
+func startActiveRequest(ctx context.Context, chatID int64, model string, query string, requestID string) (context.Context, func()) {
+	reqCtx, cancel := context.WithCancelCause(ctx)
+
+	activeRequestsMu.Lock()
+	activeRequests[chatID] = &activeRequest{
+		requestID: requestID,
+		model:     model,
+		query:     query,
+		startedAt: time.Now(),
+		cancel:    cancel,
+	}
+	activeRequestsMu.Unlock()
+
+	finish := func() {
+		activeRequestsMu.Lock()
+		if active, exists := activeRequests[chatID]; exists && active.requestID == requestID {
+			delete(activeRequests, chatID)
+		}
+		activeRequestsMu.Unlock()
+		cancel(nil)
+	}
+	return reqCtx, finish
+}
+
+// Cancel the running request of a chat. If requestID is not empty, only the
+// request with that ID is cancelled.
+func stopActiveRequest(chatID int64, requestID string) (*activeRequest, bool) {
+	activeRequestsMu.Lock()
+	defer activeRequestsMu.Unlock()
+
+	active, exists := activeRequests[chatID]
+	if !exists || (requestID != "" && active.requestID != requestID) {
+		return nil, false
+	}
+	active.cancel(errStoppedByUser)
+	delete(activeRequests, chatID)
+	return active, true
+}
+
+// Describe a stopped request for the user
+func describeStoppedRequest(active *activeRequest) string {
+	query := active.query
+	if len([]rune(query)) > 60 {
+		query = string([]rune(query)[:60]) + "…"
+	}
+	return fmt.Sprintf("⏹ Stopped %s after %ds: \"%s\"",
+		active.model, int(time.Since(active.startedAt).Seconds()), query)
+}
+
+// Handle the /stop command. It bypasses the chat queue so that it can
+// interrupt the message that is currently being answered.
+func (b *Bot) handleStopCommand(message *tgbotapi.Message, requestID string) {
+	chatID := message.Chat.ID
+	setRequestLogFields(requestID, slog.Int64("user_id", message.From.ID), slog.Int64("chat_id", chatID))
+	defer clearRequestLogFields(requestID)
+	if !b.isAuthorized(message.From.ID, message, requestID) {
+		return
+	}
+
+	dropped := clearChatQueue(chatID)
+	active, stopped := stopActiveRequest(chatID, "")
+	logInfo("[%s] User %d requested stop, stopped: %v, dropped queued messages: %d",
+		requestID, message.From.ID, stopped, dropped)
+
+	if !stopped && dropped == 0 {
+		b.sendMessage(chatID, "Nothing to stop.", requestID)
+		return
+	}
+
+	var reply string
+	if stopped {
+		reply = describeStoppedRequest(active)
+	}
+	if dropped > 0 {
+		if reply != "" {
+			reply += "\n"
+		}
+		reply += fmt.Sprintf("Removed %d queued message(s).", dropped)
+	}
+	b.sendMessage(chatID, reply, requestID)
+}
+
+// Handle a press on the Cancel button of a placeholder message
+func (b *Bot) handleStopCallback(query *tgbotapi.CallbackQuery, requestID string) {
+	answer := "Nothing to cancel"
+
+	configMu.Lock()
+	authorized := config.AuthorizedIDs[query.From.ID]
+	configMu.Unlock()
+
+	if authorized && query.Message != nil {
+		targetID := query.Data[len(stopCallbackPrefix):]
+		if active, stopped := stopActiveRequest(query.Message.Chat.ID, targetID); stopped {
+			logInfo("[%s] User %d cancelled request %s", requestID, query.From.ID, targetID)
+			answer = "Cancelled"
+			b.sendMessage(query.Message.Chat.ID, describeStoppedRequest(active), requestID)
+		}
+	}
+
+	if _, err := b.telegram.Request(tgbotapi.NewCallback(query.ID, answer)); err != nil {
+		logError("[%s] Failed to answer callback query: %v", requestID, err)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	statsDayFormat     = "2006-01-02"          // Days of the stats, in UTC
+	statsRetentionDays = 30                    // Days of stats kept in the config
+	defaultStatsDays   = 7                     // Days shown by /stats without arguments
+	broadcastInterval  = 50 * time.Millisecond // Delay between broadcast messages, below Telegram's 30 messages per second
+	broadcastRetries   = 3                     // Attempts per user when Telegram asks to slow down
+)
+
+// DayStats counts the activity of one day for /stats
+type DayStats struct {
+	ActiveUsers map[int64]bool        `json:"active_users"` // users who sent a message
+	Models      map[string]ModelStats `json:"models"`       // model ID -> requests
+}
+
+// ModelStats counts the requests made to a model
+type ModelStats struct {
+	Requests         int     `json:"requests"`
+	Errors           int     `json:"errors"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+// Add the requests of another day or model
+func (s *ModelStats) add(other ModelStats) {
+	s.Requests += other.Requests
+	s.Errors += other.Errors
+	s.PromptTokens += other.PromptTokens
+	s.CompletionTokens += other.CompletionTokens
+	s.Cost += other.Cost
+}
+
+// Describe the error rate of the requests
+func (s ModelStats) errorRate() string {
+	if s.Requests+s.Errors == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%.1f%%", float64(s.Errors)*100/float64(s.Requests+s.Errors))
+}
+
+// Get the stats of the current day, dropping the days older than
+// statsRetentionDays. The caller must hold configMu.
+func todayStatsLocked() *DayStats {
+	now := time.Now().UTC()
+	if config.Stats == nil {
+		config.Stats = make(map[string]*DayStats)
+	}
+	today := now.Format(statsDayFormat)
+	stats, exists := config.Stats[today]
+	if !exists {
+		stats = &DayStats{ActiveUsers: make(map[int64]bool), Models: make(map[string]ModelStats)}
+		config.Stats[today] = stats
+		oldest := now.AddDate(0, 0, -statsRetentionDays+1).Format(statsDayFormat)
+		maps.DeleteFunc(config.Stats, func(day string, _ *DayStats) bool { return day < oldest })
+	}
+	return stats
+}
+
+// Record that a user sent a message, for /users and the active users of
+// /stats. Returns the user with the new activity time.
+func recordActivity(userID int64, requestID string) User {
+	configMu.Lock()
+	todayStatsLocked().ActiveUsers[userID] = true
+	configMu.Unlock()
+
+	user := modifyUser(userID, requestID, func(stored *User) { stored.LastActive = time.Now() })
+	logDebug("[%s] Recorded activity of user %d", requestID, userID)
+	return user
+}
+
+// Add a completed request to the stats of the day. The caller must hold
+// configMu.
+func addRequestStatsLocked(completion *Completion) {
+	stats := todayStatsLocked()
+	modelStats := stats.Models[completion.Model]
+	modelStats.Requests++
+	if completion.Usage != nil && !completion.Cached {
+		modelStats.PromptTokens += completion.Usage.PromptTokens
+		modelStats.CompletionTokens += completion.Usage.CompletionTokens
+		modelStats.Cost += completion.Usage.Cost
+	}
+	stats.Models[completion.Model] = modelStats
+}
+
+// Add a failed request to the stats of the day
+func recordFailedRequest(modelID string) {
+	configMu.Lock()
+	stats := todayStatsLocked()
+	modelStats := stats.Models[modelID]
+	modelStats.Errors++
+	stats.Models[modelID] = modelStats
+	configMu.Unlock()
+
+	saveConfig()
+}
+
+// Get the IDs of all known users: the authorized ones and those with
+// settings. The caller must hold configMu.
+func knownUserIDsLocked() []int64 {
+	ids := make(map[int64]bool)
+	for userID, authorized := range config.AuthorizedIDs {
+		if authorized {
+			ids[userID] = true
+		}
+	}
+	for userID := range config.Users {
+		ids[userID] = true
+	}
+	return slices.Sorted(maps.Keys(ids))
+}
+
+// Describe how long ago something happened
+func formatAge(t time.Time, now time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	age := now.Sub(t)
+	switch {
+	case age < time.Minute:
+		return "just now"
+	case age < time.Hour:
+		return fmt.Sprintf("%dm ago", int(age.Minutes()))
+	case age < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(age.Hours()))
+	}
+	return fmt.Sprintf("%dd ago", int(age.Hours()/24))
+}
+
+// Handle the /stats command
+func handleStatsCommand(c *CommandContext) {
+	fields, ok := c.requireFields(0, 1)
+	if !ok {
+		return
+	}
+	days := defaultStatsDays
+	if len(fields) == 1 {
+		var err error
+		days, err = strconv.Atoi(fields[0])
+		if err != nil || days < 1 || days > statsRetentionDays {
+			c.usageError(fmt.Sprintf("The number of days must be between 1 and %d.", statsRetentionDays))
+			return
+		}
+	}
+	c.Bot.sendMessage(c.ChatID, formatStats(days, time.Now()), c.RequestID)
+}
+
+// Describe the activity of the last days, per day and per model
+func formatStats(days int, now time.Time) string {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	var total ModelStats
+	activeUsers := make(map[int64]bool)
+	models := make(map[string]ModelStats)
+	var dayLines []string
+	for i := 0; i < days; i++ {
+		day := now.UTC().AddDate(0, 0, -i).Format(statsDayFormat)
+		stats := config.Stats[day]
+		if stats == nil {
+			continue
+		}
+		var dayTotal ModelStats
+		for modelID, modelStats := range stats.Models {
+			dayTotal.add(modelStats)
+			perModel := models[modelID]
+			perModel.add(modelStats)
+			models[modelID] = perModel
+		}
+		maps.Copy(activeUsers, stats.ActiveUsers)
+		total.add(dayTotal)
+		dayLines = append(dayLines, fmt.Sprintf("• %s: %d users, %d requests, %d errors, %s",
+			day, len(stats.ActiveUsers), dayTotal.Requests, dayTotal.Errors, formatCost(dayTotal.Cost)))
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("📊 Stats for the last %d days (UTC)\n\n", days))
+	authorizedUsers := 0
+	for _, authorized := range config.AuthorizedIDs {
+		if authorized {
+			authorizedUsers++
+		}
+	}
+	sb.WriteString(fmt.Sprintf("Users: %d authorized, %d active\n", authorizedUsers, len(activeUsers)))
+	sb.WriteString(fmt.Sprintf("Requests: %d, errors: %d (%s)\n", total.Requests, total.Errors, total.errorRate()))
+	sb.WriteString(fmt.Sprintf("Tokens: %d prompt + %d completion\n", total.PromptTokens, total.CompletionTokens))
+	sb.WriteString(fmt.Sprintf("Cost: %s", formatCost(total.Cost)))
+	if len(dayLines) == 0 {
+		sb.WriteString("\n\nNo activity recorded yet.")
+		return sb.String()
+	}
+
+	sb.WriteString("\n\nPer day:\n")
+	sb.WriteString(strings.Join(dayLines, "\n"))
+	sb.WriteString("\n\nPer model:")
+	modelIDs := slices.SortedFunc(maps.Keys(models), func(a, b string) int {
+		return cmp.Or(cmp.Compare(models[b].Requests+models[b].Errors, models[a].Requests+models[a].Errors), strings.Compare(a, b))
+	})
+	for _, modelID := range modelIDs {
+		modelStats := models[modelID]
+		name := modelID
+		if name == "" {
+			name = "unknown model"
+		}
+		sb.WriteString(fmt.Sprintf("\n• %s: %d requests, %d errors (%s), %s",
+			name, modelStats.Requests, modelStats.Errors, modelStats.errorRate(), formatCost(modelStats.Cost)))
+	}
+	return sb.String()
+}
+
+// Handle the /users command
+func handleUsersCommand(c *CommandContext) {
+	now := time.Now()
+	configMu.Lock()
+	userIDs := knownUserIDsLocked()
+	users := make(map[int64]User, len(userIDs))
+	authorized := make(map[int64]bool, len(userIDs))
+	for _, userID := range userIDs {
+		users[userID] = config.Users[userID]
+		authorized[userID] = config.AuthorizedIDs[userID]
+	}
+	configMu.Unlock()
+
+	if len(userIDs) == 0 {
+		c.Bot.sendMessage(c.ChatID, "No users yet.", c.RequestID)
+		return
+	}
+
+	// Most recently active first
+	slices.SortStableFunc(userIDs, func(a, b int64) int {
+		return users[b].LastActive.Compare(users[a].LastActive)
+	})
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("👥 Users (%d):\n", len(userIDs)))
+	for _, userID := range userIDs {
+		user := users[userID]
+		var labels []string
+		if isAdmin(userID) {
+			labels = append(labels, "admin")
+		}
+		if !authorized[userID] {
+			labels = append(labels, "not authorized")
+		}
+		sb.WriteString(fmt.Sprintf("\n• %d", userID))
+		if len(labels) > 0 {
+			sb.WriteString(" (" + strings.Join(labels, ", ") + ")")
+		}
+		if user.LastActive.IsZero() {
+			sb.WriteString(": never active")
+		} else {
+			sb.WriteString(": active " + formatAge(user.LastActive, now))
+		}
+		if user.CurrentModel != "" {
+			sb.WriteString(", model " + user.CurrentModel)
+		}
+		sb.WriteString(fmt.Sprintf(", %d requests", user.Usage.Requests))
+	}
+	sb.WriteString("\n\nUse /whois <user_id> for details.")
+	c.Bot.sendMessage(c.ChatID, sb.String(), c.RequestID)
+}
+
+// Handle the /whois command
+func handleWhoisCommand(c *CommandContext) {
+	fields, ok := c.requireFields(1, 1)
+	if !ok {
+		return
+	}
+	userID, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		c.usageError("The user ID must be a number.")
+		return
+	}
+
+	configMu.Lock()
+	user, exists := config.Users[userID]
+	authorized := config.AuthorizedIDs[userID]
+	configMu.Unlock()
+	if !exists && !authorized {
+		c.Bot.sendMessage(c.ChatID, fmt.Sprintf("❌ Unknown user %d.", userID), c.RequestID)
+		return
+	}
+
+	conversationsMu.Lock()
+	threadCount, currentThread := 0, ""
+	if threads := conversations[userID]; threads != nil {
+		threadCount, currentThread = len(threads.Threads), threads.Current
+	}
+	conversationsMu.Unlock()
+
+	yesNo := map[bool]string{true: "yes", false: "no"}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("👤 User %d\n\n", userID))
+	sb.WriteString(fmt.Sprintf("• Authorized: %s, admin: %s\n", yesNo[authorized], yesNo[isAdmin(userID)]))
+	if user.LastActive.IsZero() {
+		sb.WriteString("• Last active: never\n")
+	} else {
+		sb.WriteString(fmt.Sprintf("• Last active: %s (%s)\n", formatExportTime(user.LastActive), formatAge(user.LastActive, time.Now())))
+	}
+	if user.CurrentModel != "" {
+		sb.WriteString(fmt.Sprintf("• Model: %s (%s), provider %s\n", user.CurrentModel, user.Models[user.CurrentModel], currentProvider(user).Name))
+	}
+	sb.WriteString(fmt.Sprintf("• OpenRouter token: %s\n", map[bool]string{true: "set", false: "not set"}[user.OpenRouterToken != ""]))
+	sb.WriteString(fmt.Sprintf("• Models: %d, own providers: %d\n", len(user.Models), len(user.Providers)))
+	if threadCount > 0 {
+		sb.WriteString(fmt.Sprintf("• Threads: %d (current: %s)\n", threadCount, currentThread))
+	}
+	sb.WriteString(fmt.Sprintf("• Requests: %d, tokens: %d prompt + %d completion, cost: %s",
+		user.Usage.Requests, user.Usage.PromptTokens, user.Usage.CompletionTokens, formatCost(user.Usage.Cost)))
+	c.Bot.sendMessage(c.ChatID, sb.String(), c.RequestID)
+}
+
+// Handle the /broadcast command. Messages are sent in the background so
+// that the admin's chat is not blocked while a long list is delivered.
+func handleBroadcastCommand(c *CommandContext) {
+	text, ok := c.requireText()
+	if !ok {
+		return
+	}
+
+	configMu.Lock()
+	var recipients []int64
+	for _, userID := range slices.Sorted(maps.Keys(config.AuthorizedIDs)) {
+		if config.AuthorizedIDs[userID] && userID != c.UserID {
+			recipients = append(recipients, userID)
+		}
+	}
+	configMu.Unlock()
+
+	if len(recipients) == 0 {
+		c.Bot.sendMessage(c.ChatID, "No other authorized users to broadcast to.", c.RequestID)
+		return
+	}
+	logInfo("[%s] User %d is broadcasting a message to %d users", c.RequestID, c.UserID, len(recipients))
+	c.Bot.sendMessage(c.ChatID, fmt.Sprintf("📣 Broadcasting to %d users...", len(recipients)), c.RequestID)
+	go c.Bot.broadcast(c.ChatID, recipients, text, c.RequestID)
+}
+
+// Send a message to each recipient at most once per broadcastInterval, then
+// report the deliveries to the admin's chat
+func (b *Bot) broadcast(chatID int64, recipients []int64, text string, requestID string) {
+	failures := make(map[int64]error)
+	for i, userID := range recipients {
+		if i > 0 {
+			time.Sleep(broadcastInterval)
+		}
+		if err := b.sendBroadcastMessage(userID, text); err != nil {
+			logError("[%s] Failed to broadcast to user %d: %v", requestID, userID, err)
+			failures[userID] = err
+		}
+	}
+
+	delivered := len(recipients) - len(failures)
+	logInfo("[%s] Broadcast delivered to %d of %d users", requestID, delivered, len(recipients))
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("✅ Broadcast delivered to %d of %d users.", delivered, len(recipients)))
+	if len(failures) > 0 {
+		sb.WriteString("\n\nFailed:")
+		for _, userID := range slices.Sorted(maps.Keys(failures)) {
+			sb.WriteString(fmt.Sprintf("\n• %d: %v", userID, failures[userID]))
+		}
+	}
+	b.sendMessage(chatID, sb.String(), requestID)
+}
+
+// Send a broadcast message to a user, waiting as long as Telegram asks when
+// messages are sent too fast
+func (b *Bot) sendBroadcastMessage(userID int64, text string) error {
+	var err error
+	for attempt := 0; attempt < broadcastRetries; attempt++ {
+		if _, err = b.telegram.Send(tgbotapi.NewMessage(userID, text)); err == nil {
+			return nil
+		}
+		var tgErr *tgbotapi.Error
+		if !errors.As(err, &tgErr) || tgErr.RetryAfter <= 0 {
+			return err
+		}
+		time.Sleep(time.Duration(tgErr.RetryAfter) * time.Second)
+	}
+	return err
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxAPIRetries   = 3                // Retries for transient OpenRouter errors
+	retryBaseDelay  = 1 * time.Second  // First retry delay, doubled on every attempt
+	maxRetryDelay   = 30 * time.Second // Upper bound for a single retry delay
+	retryJitterPart = 0.5              // Random jitter added on top of the delay, as a fraction of it
+)
+
+// APIErrorKind classifies errors returned by the OpenRouter API
+type APIErrorKind int
+
+const (
+	ErrKindUnknown APIErrorKind = iota
+	ErrKindNetwork
+	ErrKindRateLimited
+	ErrKindProvider
+	ErrKindContextLength
+	ErrKindModeration
+	ErrKindInsufficientCredits
+	ErrKindAuth
+	ErrKindModelNotFound
+	ErrKindBadRequest
+)
+
+// APIError is a classified error returned by the OpenRouter API
+type APIError struct {
+	Kind       APIErrorKind
+	StatusCode int
+	Message    string
+	Reasons    []string      // Moderation reasons, if any
+	RetryAfter time.Duration // Delay requested by the server, if any
+}
+
+func (e *APIError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("API error: %s", e.Message)
+	}
+	if e.Message == "" {
+		return fmt.Sprintf("API returned error status: %d", e.StatusCode)
+	}
+	return fmt.Sprintf("API returned error status: %d: %s", e.StatusCode, e.Message)
+}
+
+// Retryable reports whether the request may succeed if it is sent again
+func (e *APIError) Retryable() bool {
+	switch e.Kind {
+	case ErrKindNetwork, ErrKindRateLimited, ErrKindProvider:
+		return true
+	}
+	return false
+}
+
+// UserMessage explains the error to the user and suggests what to do
+func (e *APIError) UserMessage() string {
+	switch e.Kind {
+	case ErrKindNetwork:
+		return "⚠️ Could not reach OpenRouter, even after retrying. Please try again in a moment."
+	case ErrKindRateLimited:
+		return "⏳ The model is rate limited right now. Please wait a minute and try again, " +
+			"switch model with /setmodel, or configure fallback models with /setfallbacks."
+	case ErrKindProvider:
+		return fmt.Sprintf("⚠️ The model provider is having problems (error %d), even after retrying. "+
+			"Please try again later or configure fallback models with /setfallbacks.", e.StatusCode)
+	case ErrKindContextLength:
+		return "📏 The conversation is too long for this model's context window. " +
+			"Start a new one with /new, check /context, or switch to a model with a larger context using /setmodel."
+	case ErrKindModeration:
+		reasons := "no reason given"
+		if len(e.Reasons) > 0 {
+			reasons = strings.Join(e.Reasons, ", ")
+		}
+		return fmt.Sprintf("🚫 The request was flagged by the provider's moderation (%s). "+
+			"Rephrase it or switch to another model with /setmodel.", reasons)
+	case ErrKindInsufficientCredits:
+		return "💳 Your OpenRouter account does not have enough credits for this request. " +
+			"Top up at https://openrouter.ai/settings/credits and check your balance with /getcredits."
+	case ErrKindAuth:
+		return "🔑 OpenRouter rejected your API token. Set a valid token with /settoken <your_token>."
+	case ErrKindModelNotFound:
+		return "❓ OpenRouter does not know the current model. Check its id with /model " +
+			"and fix it with /addmodel, or pick another one with /setmodel."
+	case ErrKindBadRequest:
+		return fmt.Sprintf("⚠️ OpenRouter rejected the request: %s", e.Message)
+	}
+	return fmt.Sprintf("⚠️ OpenRouter returned an error (%s). Please try again.", e.Error())
+}
+
+// openRouterErrorBody is the error payload returned by OpenRouter
+type openRouterErrorBody struct {
+	Error *struct {
+		Code     int    `json:"code"`
+		Message  string `json:"message"`
+		Metadata struct {
+			Reasons      []string `json:"reasons"`
+			ProviderName string   `json:"provider_name"`
+		} `json:"metadata"`
+	} `json:"error"`
+}
+
+// Build a classified error from a non-OK response
+func parseAPIError(statusCode int, header http.Header, body []byte) *APIError {
+	apiErr := &APIError{StatusCode: statusCode}
+
+	var errBody openRouterErrorBody
+	if err := json.Unmarshal(body, &errBody); err == nil && errBody.Error != nil {
+		apiErr.Message = errBody.Error.Message
+		apiErr.Reasons = errBody.Error.Metadata.Reasons
+	}
+	apiErr.Kind = classifyAPIError(statusCode, apiErr.Message)
+	apiErr.RetryAfter = parseRetryAfter(header.Get("Retry-After"))
+
+	return apiErr
+}
+
+// Classify an error by its status code and message
+func classifyAPIError(statusCode int, message string) APIErrorKind {
+	lower := strings.ToLower(message)
+	switch {
+	case strings.Contains(lower, "context length") || strings.Contains(lower, "context window") ||
+		strings.Contains(lower, "maximum context") || strings.Contains(lower, "too many tokens"):
+		return ErrKindContextLength
+	case statusCode == http.StatusTooManyRequests:
+		return ErrKindRateLimited
+	case statusCode == http.StatusPaymentRequired || strings.Contains(lower, "insufficient credits"):
+		return ErrKindInsufficientCredits
+	case statusCode == http.StatusForbidden && (strings.Contains(lower, "moderation") || strings.Contains(lower, "flagged")):
+		return ErrKindModeration
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ErrKindAuth
+	case statusCode == http.StatusNotFound:
+		return ErrKindModelNotFound
+	case statusCode == http.StatusRequestTimeout || statusCode >= 500:
+		return ErrKindProvider
+	case statusCode == http.StatusBadRequest:
+		return ErrKindBadRequest
+	}
+	return ErrKindUnknown
+}
+
+// Parse a Retry-After header given either in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(when); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// Compute the delay before the given retry attempt (starting at 1)
+func retryDelay(attempt int, err error) time.Duration {
+	delay := retryBaseDelay << (attempt - 1)
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > delay {
+		delay = apiErr.RetryAfter
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+
+	jitter := time.Duration(rand.Int64N(int64(float64(delay)*retryJitterPart) + 1))
+	return delay + jitter
+}
+
+// Check whether an error returned by a request attempt is worth retrying
+func isRetryableError(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Retryable()
+}
+
+// Sleep for the given duration unless the context is done first
+func sleepWithContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-timer.C:
+		return nil
+	}
+}
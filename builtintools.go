@@ -0,0 +1,680 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+const (
+	fetchTimeout        = 15 * time.Second
+	maxFetchBytes       = 2 << 20 // 2 MB
+	defaultFetchedRunes = 6000    // Text returned by fetch_url when max_chars is not set
+)
+
+func init() {
+	registerTool(calculatorTool{})
+	registerTool(timeTool{})
+	registerTool(unitConversionTool{})
+	registerTool(fetchURLTool{})
+}
+
+// Decode the arguments of a tool call
+func decodeToolArguments(arguments json.RawMessage, v any) error {
+	if err := json.Unmarshal(arguments, v); err != nil {
+		return fmt.Errorf("invalid arguments: %v", err)
+	}
+	return nil
+}
+
+// Format a number without floating point noise
+func formatNumber(value float64) string {
+	return strconv.FormatFloat(value, 'g', 12, 64)
+}
+
+// calculatorTool evaluates arithmetic expressions
+type calculatorTool struct{}
+
+func (calculatorTool) Name() string { return "calculator" }
+
+func (calculatorTool) Description() string {
+	return "Evaluate an arithmetic expression exactly, e.g. (3.5 + 2) * 4^2 / sqrt(2). " +
+		"Supports + - * / % ^, parentheses, pi, e and the functions sqrt, cbrt, abs, exp, ln, log (base 10), log2, " +
+		"sin, cos, tan, asin, acos, atan (radians), floor, ceil, round, min, max and pow."
+}
+
+func (calculatorTool) Parameters() json.RawMessage {
+	return json.RawMessage(`{"type":"object","properties":{"expression":{"type":"string","description":"The expression to evaluate"}},"required":["expression"]}`)
+}
+
+func (calculatorTool) Execute(ctx context.Context, arguments json.RawMessage) (string, error) {
+	var args struct {
+		Expression string `json:"expression"`
+	}
+	if err := decodeToolArguments(arguments, &args); err != nil {
+		return "", err
+	}
+	value, err := evaluateExpression(args.Expression)
+	if err != nil {
+		return "", err
+	}
+	return formatNumber(value), nil
+}
+
+// Evaluate an arithmetic expression
+func evaluateExpression(expression string) (float64, error) {
+	p := &exprParser{input: []rune(expression)}
+	value, err := p.expression()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos+1)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("the result is not a finite number")
+	}
+	return value, nil
+}
+
+// exprParser is a recursive descent parser for arithmetic expressions:
+//
+//	expression = term { ("+" | "-") term }
+//	term       = unary { ("*" | "/" | "%") unary }
+//	unary      = ("+" | "-") unary | power
+//	power      = primary [ "^" unary ]
+//	primary    = number | name [ "(" arguments ")" ] | "(" expression ")"
+type exprParser struct {
+	input []rune
+	pos   int
+}
+
+func (p *exprParser) skipSpaces() {
+	for p.pos < len(p.input) && unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+// Consume the next rune if it is one of chars
+func (p *exprParser) accept(chars string) (rune, bool) {
+	p.skipSpaces()
+	if p.pos < len(p.input) && strings.ContainsRune(chars, p.input[p.pos]) {
+		p.pos++
+		return p.input[p.pos-1], true
+	}
+	return 0, false
+}
+
+func (p *exprParser) expression() (float64, error) {
+	value, err := p.term()
+	for err == nil {
+		op, ok := p.accept("+-")
+		if !ok {
+			break
+		}
+		var right float64
+		if right, err = p.term(); err == nil {
+			if op == '+' {
+				value += right
+			} else {
+				value -= right
+			}
+		}
+	}
+	return value, err
+}
+
+func (p *exprParser) term() (float64, error) {
+	value, err := p.unary()
+	for err == nil {
+		op, ok := p.accept("*/%×÷")
+		if !ok {
+			break
+		}
+		var right float64
+		if right, err = p.unary(); err == nil {
+			switch op {
+			case '*', '×':
+				value *= right
+			case '/', '÷':
+				if right == 0 {
+					return 0, fmt.Errorf("division by zero")
+				}
+				value /= right
+			case '%':
+				if right == 0 {
+					return 0, fmt.Errorf("division by zero")
+				}
+				value = math.Mod(value, right)
+			}
+		}
+	}
+	return value, err
+}
+
+func (p *exprParser) unary() (float64, error) {
+	if op, ok := p.accept("+-"); ok {
+		value, err := p.unary()
+		if op == '-' {
+			value = -value
+		}
+		return value, err
+	}
+	return p.power()
+}
+
+func (p *exprParser) power() (float64, error) {
+	base, err := p.primary()
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := p.accept("^"); ok {
+		exponent, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		return math.Pow(base, exponent), nil
+	}
+	return base, nil
+}
+
+func (p *exprParser) primary() (float64, error) {
+	p.skipSpaces()
+	if p.pos >= len(p.input) {
+		return 0, fmt.Errorf("unexpected end of expression")
+	}
+
+	if _, ok := p.accept("("); ok {
+		value, err := p.expression()
+		if err != nil {
+			return 0, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			return 0, fmt.Errorf("missing closing parenthesis")
+		}
+		return value, nil
+	}
+
+	start := p.pos
+	r := p.input[p.pos]
+	switch {
+	case unicode.IsDigit(r) || r == '.':
+		for p.pos < len(p.input) && (unicode.IsDigit(p.input[p.pos]) || p.input[p.pos] == '.') {
+			p.pos++
+		}
+		// Exponent, as in 1.5e-3
+		if p.pos < len(p.input) && (p.input[p.pos] == 'e' || p.input[p.pos] == 'E') {
+			end := p.pos + 1
+			if end < len(p.input) && (p.input[end] == '+' || p.input[end] == '-') {
+				end++
+			}
+			if end < len(p.input) && unicode.IsDigit(p.input[end]) {
+				for end < len(p.input) && unicode.IsDigit(p.input[end]) {
+					end++
+				}
+				p.pos = end
+			}
+		}
+		value, err := strconv.ParseFloat(string(p.input[start:p.pos]), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %q", string(p.input[start:p.pos]))
+		}
+		return value, nil
+	case unicode.IsLetter(r):
+		for p.pos < len(p.input) && (unicode.IsLetter(p.input[p.pos]) || unicode.IsDigit(p.input[p.pos])) {
+			p.pos++
+		}
+		name := strings.ToLower(string(p.input[start:p.pos]))
+		if _, ok := p.accept("("); ok {
+			args, err := p.arguments()
+			if err != nil {
+				return 0, err
+			}
+			return callFunction(name, args)
+		}
+		switch name {
+		case "pi", "π":
+			return math.Pi, nil
+		case "e":
+			return math.E, nil
+		}
+		return 0, fmt.Errorf("unknown name %q", name)
+	}
+	return 0, fmt.Errorf("unexpected %q at position %d", r, p.pos+1)
+}
+
+// Parse the arguments of a function call, after the opening parenthesis
+func (p *exprParser) arguments() ([]float64, error) {
+	var args []float64
+	if _, ok := p.accept(")"); ok {
+		return args, nil
+	}
+	for {
+		value, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value)
+		if _, ok := p.accept(","); ok {
+			continue
+		}
+		if _, ok := p.accept(")"); ok {
+			return args, nil
+		}
+		return nil, fmt.Errorf("missing closing parenthesis")
+	}
+}
+
+// Functions of one argument supported by the calculator
+var calculatorFunctions = map[string]func(float64) float64{
+	"sqrt": math.Sqrt, "cbrt": math.Cbrt, "abs": math.Abs, "exp": math.Exp,
+	"ln": math.Log, "log": math.Log10, "log10": math.Log10, "log2": math.Log2,
+	"sin": math.Sin, "cos": math.Cos, "tan": math.Tan,
+	"asin": math.Asin, "acos": math.Acos, "atan": math.Atan,
+	"floor": math.Floor, "ceil": math.Ceil, "round": math.Round,
+}
+
+func callFunction(name string, args []float64) (float64, error) {
+	if fn, exists := calculatorFunctions[name]; exists {
+		if len(args) != 1 {
+			return 0, fmt.Errorf("%s takes one argument", name)
+		}
+		return fn(args[0]), nil
+	}
+	switch name {
+	case "pow":
+		if len(args) != 2 {
+			return 0, fmt.Errorf("pow takes two arguments")
+		}
+		return math.Pow(args[0], args[1]), nil
+	case "min", "max":
+		if len(args) == 0 {
+			return 0, fmt.Errorf("%s takes at least one argument", name)
+		}
+		result := args[0]
+		for _, arg := range args[1:] {
+			if name == "min" {
+				result = math.Min(result, arg)
+			} else {
+				result = math.Max(result, arg)
+			}
+		}
+		return result, nil
+	}
+	return 0, fmt.Errorf("unknown function %q", name)
+}
+
+// timeTool tells the current date and time in a time zone
+type timeTool struct{}
+
+func (timeTool) Name() string { return "get_current_time" }
+
+func (timeTool) Description() string {
+	return "Get the current date, time and day of the week in a time zone."
+}
+
+func (timeTool) Parameters() json.RawMessage {
+	return json.RawMessage(`{"type":"object","properties":{"timezone":{"type":"string","description":"IANA time zone such as Europe/Berlin or America/New_York. Defaults to UTC."}}}`)
+}
+
+func (timeTool) Execute(ctx context.Context, arguments json.RawMessage) (string, error) {
+	var args struct {
+		Timezone string `json:"timezone"`
+	}
+	if err := decodeToolArguments(arguments, &args); err != nil {
+		return "", err
+	}
+	if args.Timezone == "" {
+		args.Timezone = "UTC"
+	}
+	location, err := time.LoadLocation(args.Timezone)
+	if err != nil {
+		return "", fmt.Errorf("unknown time zone %q, use an IANA name such as Europe/Berlin", args.Timezone)
+	}
+	now := time.Now().In(location)
+	return fmt.Sprintf("%s, %s (%s, UTC%s)", now.Format("Monday"), now.Format("2006-01-02 15:04:05"), args.Timezone, now.Format("-07:00")), nil
+}
+
+// unitConversionTool converts between units of measurement
+type unitConversionTool struct{}
+
+// unit is a unit of measurement, as a factor to the base unit of its quantity
+type unit struct {
+	quantity string
+	factor   float64
+}
+
+// Units by name. Base units: metre, kilogram, litre, square metre, metre per
+// second, second and byte. Temperatures are converted separately.
+var units = map[string]unit{
+	"m": {"length", 1}, "meter": {"length", 1}, "metre": {"length", 1},
+	"km": {"length", 1000}, "kilometer": {"length", 1000}, "kilometre": {"length", 1000},
+	"cm": {"length", 0.01}, "centimeter": {"length", 0.01}, "centimetre": {"length", 0.01},
+	"mm": {"length", 0.001}, "millimeter": {"length", 0.001}, "millimetre": {"length", 0.001},
+	"mi": {"length", 1609.344}, "mile": {"length", 1609.344},
+	"yd": {"length", 0.9144}, "yard": {"length", 0.9144},
+	"ft": {"length", 0.3048}, "foot": {"length", 0.3048}, "feet": {"length", 0.3048},
+	"in": {"length", 0.0254}, "inch": {"length", 0.0254}, "inches": {"length", 0.0254},
+	"nmi": {"length", 1852}, "nautical mile": {"length", 1852},
+
+	"kg": {"mass", 1}, "kilogram": {"mass", 1},
+	"g": {"mass", 0.001}, "gram": {"mass", 0.001},
+	"mg": {"mass", 1e-6}, "milligram": {"mass", 1e-6},
+	"t": {"mass", 1000}, "tonne": {"mass", 1000},
+	"lb": {"mass", 0.45359237}, "lbs": {"mass", 0.45359237}, "pound": {"mass", 0.45359237},
+	"oz": {"mass", 0.028349523125}, "ounce": {"mass", 0.028349523125},
+	"st": {"mass", 6.35029318}, "stone": {"mass", 6.35029318},
+
+	"l": {"volume", 1}, "liter": {"volume", 1}, "litre": {"volume", 1},
+	"ml": {"volume", 0.001}, "milliliter": {"volume", 0.001}, "millilitre": {"volume", 0.001},
+	"m3": {"volume", 1000}, "cubic meter": {"volume", 1000},
+	"gal": {"volume", 3.785411784}, "gallon": {"volume", 3.785411784},
+	"qt": {"volume", 0.946352946}, "quart": {"volume", 0.946352946},
+	"pt": {"volume", 0.473176473}, "pint": {"volume", 0.473176473},
+	"cup":  {"volume", 0.2365882365},
+	"floz": {"volume", 0.0295735295625}, "fl oz": {"volume", 0.0295735295625}, "fluid ounce": {"volume", 0.0295735295625},
+	"tbsp": {"volume", 0.01478676478125}, "tablespoon": {"volume", 0.01478676478125},
+	"tsp": {"volume", 0.00492892159375}, "teaspoon": {"volume", 0.00492892159375},
+
+	"m2": {"area", 1}, "square meter": {"area", 1},
+	"km2": {"area", 1e6}, "square kilometer": {"area", 1e6},
+	"cm2": {"area", 1e-4}, "square centimeter": {"area", 1e-4},
+	"ha": {"area", 1e4}, "hectare": {"area", 1e4},
+	"acre": {"area", 4046.8564224},
+	"ft2":  {"area", 0.09290304}, "square foot": {"area", 0.09290304}, "square feet": {"area", 0.09290304},
+	"mi2": {"area", 2589988.110336}, "square mile": {"area", 2589988.110336},
+
+	"m/s": {"speed", 1}, "km/h": {"speed", 1 / 3.6}, "kph": {"speed", 1 / 3.6},
+	"mph": {"speed", 0.44704}, "kn": {"speed", 1852.0 / 3600}, "knot": {"speed", 1852.0 / 3600},
+	"ft/s": {"speed", 0.3048},
+
+	"s": {"time", 1}, "sec": {"time", 1}, "second": {"time", 1},
+	"ms": {"time", 0.001}, "millisecond": {"time", 0.001},
+	"min": {"time", 60}, "minute": {"time", 60},
+	"h": {"time", 3600}, "hr": {"time", 3600}, "hour": {"time", 3600},
+	"day": {"time", 86400}, "week": {"time", 604800},
+	"year": {"time", 31557600}, // Julian year of 365.25 days
+
+	"bit": {"data", 0.125}, "b": {"data", 1}, "byte": {"data", 1},
+	"kb": {"data", 1e3}, "mb": {"data", 1e6}, "gb": {"data", 1e9}, "tb": {"data", 1e12},
+	"kib": {"data", 1 << 10}, "mib": {"data", 1 << 20}, "gib": {"data", 1 << 30}, "tib": {"data", 1 << 40},
+}
+
+// Temperature scales by name
+var temperatureScales = map[string]string{
+	"c": "C", "°c": "C", "celsius": "C",
+	"f": "F", "°f": "F", "fahrenheit": "F",
+	"k": "K", "kelvin": "K",
+}
+
+func (unitConversionTool) Name() string { return "convert_units" }
+
+func (unitConversionTool) Description() string {
+	return "Convert a value between units of length, mass, volume, area, speed, time, data size or temperature, " +
+		"e.g. 5 mi to km, 70 F to C, 2 GiB to MB."
+}
+
+func (unitConversionTool) Parameters() json.RawMessage {
+	return json.RawMessage(`{"type":"object","properties":{` +
+		`"value":{"type":"number","description":"The value to convert"},` +
+		`"from":{"type":"string","description":"Unit of the value, such as km, lb, F or GiB"},` +
+		`"to":{"type":"string","description":"Unit to convert to"}},` +
+		`"required":["value","from","to"]}`)
+}
+
+func (unitConversionTool) Execute(ctx context.Context, arguments json.RawMessage) (string, error) {
+	var args struct {
+		Value float64 `json:"value"`
+		From  string  `json:"from"`
+		To    string  `json:"to"`
+	}
+	if err := decodeToolArguments(arguments, &args); err != nil {
+		return "", err
+	}
+	result, err := convertUnits(args.Value, args.From, args.To)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s = %s %s", formatNumber(args.Value), args.From, formatNumber(result), args.To), nil
+}
+
+// Normalise a unit name: lower case, without a plural "s"
+func normalizeUnit(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if _, exists := units[name]; exists {
+		return name
+	}
+	if trimmed := strings.TrimSuffix(name, "s"); trimmed != name {
+		if _, exists := units[trimmed]; exists {
+			return trimmed
+		}
+	}
+	return name
+}
+
+// Convert a value between two units of the same quantity
+func convertUnits(value float64, from string, to string) (float64, error) {
+	fromScale, fromIsTemperature := temperatureScales[strings.ToLower(strings.TrimSpace(from))]
+	toScale, toIsTemperature := temperatureScales[strings.ToLower(strings.TrimSpace(to))]
+	if fromIsTemperature || toIsTemperature {
+		if !fromIsTemperature || !toIsTemperature {
+			return 0, fmt.Errorf("cannot convert between %s and %s", from, to)
+		}
+		return convertTemperature(value, fromScale, toScale), nil
+	}
+
+	fromUnit, exists := units[normalizeUnit(from)]
+	if !exists {
+		return 0, fmt.Errorf("unknown unit %q", from)
+	}
+	toUnit, exists := units[normalizeUnit(to)]
+	if !exists {
+		return 0, fmt.Errorf("unknown unit %q", to)
+	}
+	if fromUnit.quantity != toUnit.quantity {
+		return 0, fmt.Errorf("cannot convert %s (%s) to %s (%s)", from, fromUnit.quantity, to, toUnit.quantity)
+	}
+	return value * fromUnit.factor / toUnit.factor, nil
+}
+
+// Convert a temperature between the C, F and K scales
+func convertTemperature(value float64, from string, to string) float64 {
+	celsius := value
+	switch from {
+	case "F":
+		celsius = (value - 32) * 5 / 9
+	case "K":
+		celsius = value - 273.15
+	}
+	switch to {
+	case "F":
+		return celsius*9/5 + 32
+	case "K":
+		return celsius + 273.15
+	}
+	return celsius
+}
+
+// fetchURLTool downloads a web page and extracts its text
+type fetchURLTool struct{}
+
+var (
+	htmlTitleRegex     = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	htmlSkippedRegex   = regexp.MustCompile(`(?is)<(script|style|noscript|svg|head|template)\b.*?</(script|style|noscript|svg|head|template)>|<!--.*?-->`)
+	htmlBlockTagRegex  = regexp.MustCompile(`(?i)</?(p|div|br|li|tr|h[1-6]|section|article|header|footer|blockquote|pre|table|ul|ol)\b[^>]*>`)
+	htmlTagRegex       = regexp.MustCompile(`<[^>]*>`)
+	spaceRunRegex      = regexp.MustCompile(`[ \t\r\f\v]+`)
+	blankLineRunsRegex = regexp.MustCompile(`\n\s*\n+`)
+)
+
+// HTTP client for fetch_url, which refuses to connect to private addresses so
+// that the model cannot reach services on the bot's network
+var fetchClient = &http.Client{
+	Timeout: fetchTimeout,
+	Transport: &http.Transport{
+		// No proxy: a proxy would make the connection instead of the dialer
+		// below and bypass the address check
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: fetchTimeout,
+			Control: checkPublicAddress,
+		}).DialContext,
+	},
+}
+
+// Dialer control refusing connections to loopback, private, link-local and
+// other special-purpose addresses. It runs on the resolved address, so host
+// names that resolve to such addresses are refused too.
+func checkPublicAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("connections to %s are not allowed", host)
+	}
+	return nil
+}
+
+// Special-purpose ranges of the IANA registries that are not reachable from
+// the internet or can lead to internal hosts, besides the loopback, private
+// and link-local ones known to the net package
+var specialPurposeNets = mustParseCIDRs(
+	"0.0.0.0/8",       // "this network"
+	"100.64.0.0/10",   // shared address space (carrier-grade NAT)
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // documentation (TEST-NET-1)
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation (TEST-NET-2)
+	"203.0.113.0/24",  // documentation (TEST-NET-3)
+	"224.0.0.0/4",     // multicast
+	"240.0.0.0/4",     // reserved, including the broadcast address
+	"64:ff9b::/96",    // NAT64, embeds an IPv4 address
+	"64:ff9b:1::/48",  // local-use NAT64
+	"100::/64",        // discard-only
+	"2001::/23",       // IETF protocol assignments, including Teredo
+	"2001:db8::/32",   // documentation
+	"2002::/16",       // 6to4, embeds an IPv4 address
+	"ff00::/8",        // multicast
+)
+
+// Parse CIDR ranges, panicking on invalid ones
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = network
+	}
+	return nets
+}
+
+// Check whether an address can be reached from the internet
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range specialPurposeNets {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (fetchURLTool) Name() string { return "fetch_url" }
+
+func (fetchURLTool) Description() string {
+	return "Download a web page or text file and return its title and readable text."
+}
+
+func (fetchURLTool) Parameters() json.RawMessage {
+	return json.RawMessage(`{"type":"object","properties":{` +
+		`"url":{"type":"string","description":"The http or https URL to fetch"},` +
+		`"max_chars":{"type":"integer","description":"Most characters of text to return (default 6000)"}},` +
+		`"required":["url"]}`)
+}
+
+func (fetchURLTool) Execute(ctx context.Context, arguments json.RawMessage) (string, error) {
+	var args struct {
+		URL      string `json:"url"`
+		MaxChars int    `json:"max_chars"`
+	}
+	if err := decodeToolArguments(arguments, &args); err != nil {
+		return "", err
+	}
+	parsed, err := url.Parse(args.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", fmt.Errorf("invalid URL %q, only http and https URLs can be fetched", args.URL)
+	}
+	if args.MaxChars <= 0 {
+		args.MaxChars = defaultFetchedRunes
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", parsed.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; OpenRouterTelegramBot/1.0)")
+	req.Header.Set("Accept", "text/html,text/plain,application/json;q=0.9,*/*;q=0.5")
+
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch %s: %v", parsed.Host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned status %d", parsed.Host, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchBytes))
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %v", err)
+	}
+
+	contentType := strings.ToLower(resp.Header.Get("Content-Type"))
+	switch {
+	case strings.Contains(contentType, "html"):
+		title, text := extractHTMLText(string(body))
+		return fmt.Sprintf("Title: %s\nURL: %s\n\n%s", title, resp.Request.URL, truncateRunes(text, args.MaxChars)), nil
+	case contentType == "", strings.HasPrefix(contentType, "text/"), strings.Contains(contentType, "json"), strings.Contains(contentType, "xml"):
+		return fmt.Sprintf("URL: %s\n\n%s", resp.Request.URL, truncateRunes(ensureUTF8(string(body)), args.MaxChars)), nil
+	}
+	return "", fmt.Errorf("cannot read content of type %s", contentType)
+}
+
+// Extract the title and the readable text of an HTML page
+func extractHTMLText(page string) (string, string) {
+	title := ""
+	if match := htmlTitleRegex.FindStringSubmatch(page); match != nil {
+		title = strings.TrimSpace(html.UnescapeString(htmlTagRegex.ReplaceAllString(match[1], "")))
+	}
+
+	text := htmlSkippedRegex.ReplaceAllString(page, "")
+	text = htmlBlockTagRegex.ReplaceAllString(text, "\n")
+	text = htmlTagRegex.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+	text = spaceRunRegex.ReplaceAllString(text, " ")
+	text = blankLineRunsRegex.ReplaceAllString(text, "\n\n")
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return title, ensureUTF8(strings.TrimSpace(strings.Join(lines, "\n")))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"1.1.1.1", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"0.1.2.3", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"100.128.0.1", true},
+		{"192.0.0.8", false},
+		{"192.0.2.1", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"198.20.0.1", true},
+		{"198.51.100.7", false},
+		{"203.0.113.9", false},
+		{"224.0.0.251", false},
+		{"255.255.255.255", false},
+		{"64:ff9b::7f00:1", false},
+		{"64:ff9b::808:808", false},
+		{"64:ff9b:1::1", false},
+		{"100::1", false},
+		{"2001::1", false},
+		{"2001:db8::1", false},
+		{"2002:7f00:1::", false},
+		{"ff02::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:100.64.0.1", false},
+		{"::ffff:8.8.8.8", true},
+	}
+	for _, test := range tests {
+		if got := isPublicIP(net.ParseIP(test.ip)); got != test.public {
+			t.Errorf("isPublicIP(%s) = %v, want %v", test.ip, got, test.public)
+		}
+	}
+}
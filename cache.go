@@ -0,0 +1,300 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cacheTTL              = 24 * time.Hour
+	maxMemoryCacheEntries = 500
+	maxDiskCacheBytes     = 100 << 20 // 100 MB
+	diskCacheDir          = "data/cache"
+)
+
+// Cache modes a user can choose
+const (
+	CacheOff   = "off"   // never use the cache
+	CacheOn    = "on"    // cache answers generated with temperature 0
+	CacheForce = "force" // cache all answers, whatever the temperature
+)
+
+// ResponseCache stores completions by a key derived from the request
+type ResponseCache interface {
+	Get(key string) (*Completion, bool)
+	Put(key string, completion *Completion)
+	Clear() int
+}
+
+// Cache used for all requests
+var responseCache ResponseCache
+
+// Create the response cache. The BOT_CACHE environment variable selects the
+// backend: "disk" stores answers under data/cache, anything else keeps them
+// in memory.
+func initResponseCache() {
+	if strings.EqualFold(os.Getenv("BOT_CACHE"), "disk") {
+		responseCache = newDiskCache(diskCacheDir, cacheTTL, maxDiskCacheBytes)
+		logInfo("Using on-disk response cache in %s", diskCacheDir)
+		return
+	}
+	responseCache = newMemoryCache(maxMemoryCacheEntries, cacheTTL)
+}
+
+// Get the cache key of a request, and whether the request may use the cache.
+// Requests are only cached for users who enabled it, and with non-zero (or
+// default) temperature only when forced, since such answers vary by design.
+func responseCacheKey(user User, provider Provider, requestBody []byte) (string, bool) {
+	switch user.Cache {
+	case CacheOn:
+		temperature := effectiveParams(user).Temperature
+		if temperature == nil || *temperature != 0 {
+			return "", false
+		}
+	case CacheForce:
+	default:
+		return "", false
+	}
+
+	// Answers are not shared between providers or API keys, which pay for their own requests
+	hash := sha256.New()
+	hash.Write([]byte(provider.BaseURL + "\n" + provider.APIKey + "\n"))
+	hash.Write(requestBody)
+	return hex.EncodeToString(hash.Sum(nil)), true
+}
+
+// Copy a completion so that cached values are never modified
+func copyCompletion(completion *Completion) *Completion {
+	copied := *completion
+	if completion.Usage != nil {
+		usage := *completion.Usage
+		copied.Usage = &usage
+	}
+	return &copied
+}
+
+// memoryCache is an in-memory LRU cache with a TTL
+type memoryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	order      *list.List               // most recently used first
+	entries    map[string]*list.Element // key -> element holding a *memoryCacheEntry
+}
+
+type memoryCacheEntry struct {
+	key        string
+	completion *Completion
+	storedAt   time.Time
+}
+
+func newMemoryCache(maxEntries int, ttl time.Duration) *memoryCache {
+	return &memoryCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+func (c *memoryCache) Get(key string) (*Completion, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, exists := c.entries[key]
+	if !exists {
+		return nil, false
+	}
+	entry := element.Value.(*memoryCacheEntry)
+	if time.Since(entry.storedAt) > c.ttl {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return copyCompletion(entry.completion), true
+}
+
+func (c *memoryCache) Put(key string, completion *Completion) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, exists := c.entries[key]; exists {
+		c.order.Remove(element)
+	}
+	c.entries[key] = c.order.PushFront(&memoryCacheEntry{key: key, completion: copyCompletion(completion), storedAt: time.Now()})
+
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+}
+
+func (c *memoryCache) Clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := len(c.entries)
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+	return count
+}
+
+// diskCache stores each completion as a JSON file named by its key. Files
+// older than the TTL are ignored, and the oldest files are removed when the
+// total size exceeds the limit. The size and time of each file are kept in
+// memory, so that writes do not list the directory.
+type diskCache struct {
+	mu       sync.Mutex
+	dir      string
+	ttl      time.Duration
+	maxBytes int64
+	files    map[string]diskCacheFile // key -> file
+	total    int64                    // total size of the files, in bytes
+}
+
+type diskCacheFile struct {
+	size    int64
+	modTime time.Time
+}
+
+func newDiskCache(dir string, ttl time.Duration, maxBytes int64) *diskCache {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logError("Failed to create cache directory %s: %v", dir, err)
+	}
+	c := &diskCache{dir: dir, ttl: ttl, maxBytes: maxBytes, files: make(map[string]diskCacheFile)}
+	c.load()
+	return c
+}
+
+// Index the files left in the directory by a previous run
+func (c *diskCache) load() {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		logError("Failed to read cache directory %s: %v", c.dir, err)
+		return
+	}
+	for _, entry := range entries {
+		key, isCacheFile := strings.CutSuffix(entry.Name(), ".json")
+		info, err := entry.Info()
+		if !isCacheFile || err != nil || info.IsDir() {
+			continue
+		}
+		c.files[key] = diskCacheFile{size: info.Size(), modTime: info.ModTime()}
+		c.total += info.Size()
+	}
+	c.evict()
+}
+
+func (c *diskCache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+// Remove the file of a key and forget it
+func (c *diskCache) remove(key string) {
+	os.Remove(c.path(key))
+	if file, exists := c.files[key]; exists {
+		c.total -= file.size
+		delete(c.files, key)
+	}
+}
+
+func (c *diskCache) Get(key string) (*Completion, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	file, exists := c.files[key]
+	if !exists {
+		return nil, false
+	}
+	if time.Since(file.modTime) > c.ttl {
+		c.remove(key)
+		return nil, false
+	}
+	path := c.path(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		c.remove(key)
+		return nil, false
+	}
+	var completion Completion
+	if err := json.Unmarshal(data, &completion); err != nil {
+		logError("Failed to parse cache file %s: %v", path, err)
+		c.remove(key)
+		return nil, false
+	}
+	return &completion, true
+}
+
+func (c *diskCache) Put(key string, completion *Completion) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := json.Marshal(completion)
+	if err != nil {
+		logError("Failed to marshal cached completion: %v", err)
+		return
+	}
+	if err := os.WriteFile(c.path(key), data, 0644); err != nil {
+		logError("Failed to write cache file: %v", err)
+		return
+	}
+	if old, exists := c.files[key]; exists {
+		c.total -= old.size
+	}
+	c.files[key] = diskCacheFile{size: int64(len(data)), modTime: time.Now()}
+	c.total += int64(len(data))
+	if c.total > c.maxBytes {
+		c.evict()
+	}
+}
+
+// Remove expired files, then the oldest files until the cache fits the size limit
+func (c *diskCache) evict() {
+	keys := make([]string, 0, len(c.files))
+	for key, file := range c.files {
+		if time.Since(file.modTime) > c.ttl {
+			c.remove(key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return c.files[keys[i]].modTime.Before(c.files[keys[j]].modTime)
+	})
+	for _, key := range keys {
+		if c.total <= c.maxBytes {
+			break
+		}
+		c.remove(key)
+	}
+}
+
+func (c *diskCache) Clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, entry := range entries {
+		if !entry.IsDir() && os.Remove(filepath.Join(c.dir, entry.Name())) == nil {
+			count++
+		}
+	}
+	c.files = make(map[string]diskCacheFile)
+	c.total = 0
+	return count
+}
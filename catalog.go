@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	openRouterModelsPath = "/models"       // Models catalog endpoint
+	catalogTTL           = 6 * time.Hour   // How long the fetched catalog is used
+	catalogRetryInterval = 5 * time.Minute // Wait before fetching again after a failure
+	defaultContextLength = 8192            // Assumed context length of models missing from the catalog
+)
+
+// CatalogModel is a model in the OpenRouter models catalog
+type CatalogModel struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	ContextLength int    `json:"context_length"`
+	Pricing       struct {
+		Prompt     string `json:"prompt"`
+		Completion string `json:"completion"`
+	} `json:"pricing"`
+	TopProvider struct {
+		MaxCompletionTokens int `json:"max_completion_tokens"`
+	} `json:"top_provider"`
+}
+
+var (
+	catalogMu        sync.Mutex
+	catalogModels    map[string]CatalogModel // model ID -> model
+	catalogFetchedAt time.Time
+	catalogFailedAt  time.Time
+	catalogFetch     chan struct{} // closed when the fetch in progress ends, nil if there is none
+)
+
+// Get a model from the catalog, fetching the catalog if it is missing or stale.
+// Only one request fetches the catalog at a time; the others keep using the
+// stale catalog meanwhile, or wait for the first one. Returns false if the
+// model is unknown or the catalog is unavailable.
+func (b *Bot) lookupCatalogModel(ctx context.Context, modelID string, requestID string) (CatalogModel, bool) {
+	catalogMu.Lock()
+	stale := time.Since(catalogFetchedAt) > catalogTTL
+	fetch := catalogFetch
+	if stale && fetch == nil && time.Since(catalogFailedAt) > catalogRetryInterval {
+		catalogFetch = make(chan struct{})
+		catalogMu.Unlock()
+		b.fetchCatalog(ctx, requestID)
+		catalogMu.Lock()
+	} else if fetch != nil && catalogModels == nil {
+		catalogMu.Unlock()
+		select {
+		case <-fetch:
+		case <-ctx.Done():
+		}
+		catalogMu.Lock()
+	}
+	model, exists := catalogModels[modelID]
+	catalogMu.Unlock()
+	return model, exists
+}
+
+// Fetch the catalog without holding catalogMu and swap it in. The caller
+// must have set catalogFetch.
+func (b *Bot) fetchCatalog(ctx context.Context, requestID string) {
+	models, err := b.llm.Models(ctx, requestID)
+
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	if err != nil {
+		logError("[%s] Failed to fetch models catalog: %v", requestID, err)
+		// A cancelled request says nothing about the API, so the next one may retry
+		if ctx.Err() == nil {
+			catalogFailedAt = time.Now()
+		}
+	} else {
+		catalogModels = models
+		catalogFetchedAt = time.Now()
+		logInfo("[%s] Fetched models catalog with %d models", requestID, len(models))
+	}
+	close(catalogFetch)
+	catalogFetch = nil
+}
+
+// Get the context length of a model in tokens
+func (b *Bot) modelContextLength(ctx context.Context, modelID string, requestID string) int {
+	model, exists := b.lookupCatalogModel(ctx, modelID, requestID)
+	if !exists || model.ContextLength <= 0 {
+		logDebug("[%s] Context length of %s unknown, assuming %d tokens", requestID, modelID, defaultContextLength)
+		return defaultContextLength
+	}
+	return model.ContextLength
+}
+
+// Models fetches the models catalog from OpenRouter
+func (c *httpLLMClient) Models(ctx context.Context, requestID string) (map[string]CatalogModel, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", openRouterURL(openRouterModelsPath), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("X-Request-ID", requestID)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, parseAPIError(resp.StatusCode, resp.Header, body)
+	}
+
+	var catalog struct {
+		Data []CatalogModel `json:"data"`
+	}
+	if err := json.Unmarshal(body, &catalog); err != nil {
+		return nil, fmt.Errorf("failed to parse models catalog: %v", err)
+	}
+
+	models := make(map[string]CatalogModel, len(catalog.Data))
+	for _, model := range catalog.Data {
+		models[model.ID] = model
+	}
+	return models, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// LLMClient sends requests to the model APIs
+type LLMClient interface {
+	// Send a chat completion request to a provider and read the answer. If the
+	// context is cancelled while the answer streams in, the partial answer is
+	// returned together with the error.
+	Chat(ctx context.Context, provider Provider, request OpenRouterRequest, requestID string) (*Completion, error)
+	// Get the credits balance of an OpenRouter API token
+	Credits(ctx context.Context, apiToken string, requestID string) (*CreditsResponse, error)
+	// Get the OpenRouter models catalog by model ID
+	Models(ctx context.Context, requestID string) (map[string]CatalogModel, error)
+}
+
+// TelegramSender sends messages and other requests to the Telegram Bot API.
+// *tgbotapi.BotAPI implements it.
+type TelegramSender interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error)
+	GetFileDirectURL(fileID string) (string, error)
+	GetMe() (tgbotapi.User, error)
+}
+
+// Bot handles updates with the clients of the Telegram and model APIs. main
+// creates it with the real APIs; tests create it with fakes, such as the ones
+// of the fake package, to run the handlers offline.
+type Bot struct {
+	telegram TelegramSender
+	llm      LLMClient
+	timeout  time.Duration // time limit to handle a message
+
+	background sync.WaitGroup // work that outlives the message, such as thread titles
+}
+
+// Create a bot using the given clients
+func newBot(telegram TelegramSender, llm LLMClient) *Bot {
+	return &Bot{telegram: telegram, llm: llm, timeout: handlerTimeout}
+}
+
+// httpLLMClient is the LLMClient that calls the APIs over HTTP
+type httpLLMClient struct {
+	client       *http.Client
+	publicClient *http.Client // for providers that are not trusted, refuses private addresses
+}
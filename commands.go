@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Roles required to run a command
+const (
+	RoleUser  = "user"  // every authorized user
+	RoleAdmin = "admin" // users listed in BOT_ADMIN_IDS
+)
+
+// Command is a bot command: how it is called, who may call it and what it does
+type Command struct {
+	Name        string   // name without the slash
+	Aliases     []string // other names, not listed in the help
+	Args        string   // argument syntax shown in the help, such as <name>
+	Description string
+	Role        string
+	Handler     func(c *CommandContext)
+}
+
+// CommandContext is a command call being handled
+type CommandContext struct {
+	Bot       *Bot
+	Ctx       context.Context
+	Command   *Command
+	Message   *tgbotapi.Message
+	ChatID    int64
+	UserID    int64
+	User      User
+	Args      string
+	RequestID string
+}
+
+// Registered commands in the order of the help, and by name and alias
+var (
+	commandList  []*Command
+	commandIndex = make(map[string]*Command)
+)
+
+// Add a command to the bot
+func registerCommand(command Command) {
+	cmd := &command
+	if cmd.Role == "" {
+		cmd.Role = RoleUser
+	}
+	for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+		if _, exists := commandIndex[name]; exists {
+			panic("command registered twice: " + name)
+		}
+		commandIndex[name] = cmd
+	}
+	commandList = append(commandList, cmd)
+}
+
+// Find a command by name or alias
+func lookupCommand(name string) (*Command, bool) {
+	cmd, exists := commandIndex[strings.ToLower(name)]
+	return cmd, exists
+}
+
+// Check whether a user may run a command
+func (cmd *Command) allowed(userID int64) bool {
+	return cmd.Role != RoleAdmin || isAdmin(userID)
+}
+
+// Get the command as written in the help, such as /setmodel <name>
+func (cmd *Command) syntax() string {
+	if cmd.Args == "" {
+		return "/" + cmd.Name
+	}
+	return "/" + cmd.Name + " " + cmd.Args
+}
+
+// Get the usage line of the command
+func (cmd *Command) usage() string {
+	return "Usage: " + cmd.syntax()
+}
+
+// Run the command of a message. Admin commands are unknown to other users.
+func (b *Bot) dispatchCommand(ctx context.Context, message *tgbotapi.Message, user User, requestID string) {
+	chatID := message.Chat.ID
+	userID := message.From.ID
+	cmd, exists := lookupCommand(message.Command())
+	if !exists || !cmd.allowed(userID) {
+		if exists {
+			logInfo("[%s] User %d is not allowed to run /%s", requestID, userID, cmd.Name)
+		}
+		b.sendMessage(chatID, "Unknown command. Use /help to see available commands.", requestID)
+		return
+	}
+	cmd.Handler(&CommandContext{
+		Bot:       b,
+		Ctx:       ctx,
+		Command:   cmd,
+		Message:   message,
+		ChatID:    chatID,
+		UserID:    userID,
+		User:      user,
+		Args:      message.CommandArguments(),
+		RequestID: requestID,
+	})
+}
+
+// Reply with an error followed by the usage of the command
+func (c *CommandContext) usageError(reason string) {
+	c.Bot.sendMessage(c.ChatID, fmt.Sprintf("❌ %s\n%s", reason, c.Command.usage()), c.RequestID)
+}
+
+// Get the arguments as a single text. Replies with the usage and returns
+// false when there are none.
+func (c *CommandContext) requireText() (string, bool) {
+	text := strings.TrimSpace(c.Args)
+	if text == "" {
+		c.usageError("Missing arguments.")
+		return "", false
+	}
+	return text, true
+}
+
+// Split the arguments into words. Replies with the usage and returns false
+// when there are fewer than min or more than max words; max 0 means any
+// number.
+func (c *CommandContext) requireFields(min int, max int) ([]string, bool) {
+	fields := strings.Fields(c.Args)
+	switch {
+	case len(fields) < min:
+		c.usageError("Missing arguments.")
+		return nil, false
+	case max > 0 && len(fields) > max:
+		c.usageError("Too many arguments.")
+		return nil, false
+	}
+	return fields, true
+}
+
+// Generate the help for a user from the registered commands
+func helpText(userID int64) string {
+	var sb, admin strings.Builder
+	sb.WriteString("Available commands:\n")
+	for _, cmd := range commandList {
+		if !cmd.allowed(userID) {
+			continue
+		}
+		line := fmt.Sprintf("%s - %s\n", cmd.syntax(), cmd.Description)
+		if cmd.Role == RoleAdmin {
+			admin.WriteString(line)
+		} else {
+			sb.WriteString(line)
+		}
+	}
+	if admin.Len() > 0 {
+		sb.WriteString("\nAdmin commands:\n")
+		sb.WriteString(admin.String())
+	}
+	sb.WriteString("Just send a message to chat with the current AI model!")
+	return sb.String()
+}
+
+// Get the commands a user may run, for the Telegram command menu
+func menuCommands(admin bool) []tgbotapi.BotCommand {
+	var menu []tgbotapi.BotCommand
+	for _, cmd := range commandList {
+		if cmd.Role == RoleAdmin && !admin {
+			continue
+		}
+		menu = append(menu, tgbotapi.BotCommand{Command: cmd.Name, Description: cmd.Description})
+	}
+	return menu
+}
+
+// Register the command menu with Telegram: user commands for everyone and
+// all commands in the private chats of the admins
+func (b *Bot) registerBotCommands(requestID string) {
+	scopes := []tgbotapi.SetMyCommandsConfig{
+		tgbotapi.NewSetMyCommandsWithScope(tgbotapi.NewBotCommandScopeDefault(), menuCommands(false)...),
+	}
+	admins := getAdminIDs()
+	for _, adminID := range slices.Sorted(maps.Keys(admins)) {
+		scopes = append(scopes, tgbotapi.NewSetMyCommandsWithScope(tgbotapi.NewBotCommandScopeChat(adminID), menuCommands(true)...))
+	}
+	for _, scope := range scopes {
+		if _, err := b.telegram.Request(scope); err != nil {
+			logError("[%s] Failed to register the command menu for scope %s: %v", requestID, scope.Scope.Type, err)
+		}
+	}
+	logInfo("[%s] Registered %d commands for users and %d admins", requestID, len(commandList), len(admins))
+}
+
+func init() {
+	registerCommand(Command{Name: "help", Aliases: []string{"start"}, Description: "Show this help message", Handler: handleHelpCommand})
+	registerCommand(Command{Name: "settoken", Args: "<token>", Description: "Set your OpenRouter API token", Handler: handleSetTokenCommand})
+	registerCommand(Command{Name: "model", Description: "Show current AI model", Handler: handleModelCommand})
+	registerCommand(Command{Name: "models", Description: "List available AI models", Handler: handleModelsCommand})
+	registerCommand(Command{Name: "setmodel", Args: "<name>", Description: "Set current AI model by name", Handler: handleSetModelCommand})
+	registerCommand(Command{Name: "addmodel", Args: "<your_name> <openrouter_id>", Description: "Add a new model to your list", Handler: handleAddModelCommand})
+	registerCommand(Command{Name: "removemodel", Args: "<name>", Description: "Remove a model from your list", Handler: handleRemoveModelCommand})
+	registerCommand(Command{Name: "provider", Args: "[add|remove …]", Description: "List or register OpenAI-compatible API providers (local models)", Handler: func(c *CommandContext) {
+		c.Bot.handleProviderCommand(c.ChatID, c.UserID, c.User, c.Args, c.RequestID)
+	}})
+	registerCommand(Command{Name: "fallbacks", Description: "Show your fallback models", Handler: handleFallbacksCommand})
+	registerCommand(Command{Name: "setfallbacks", Args: "<name1> <name2> ...", Description: "Set models to try when the current one fails (off to clear)", Handler: handleSetFallbacksCommand})
+	registerCommand(Command{Name: "params", Args: "[@<model>] [<name> <value>|reset]", Description: "Show or change generation parameters (temperature, max_tokens, ...)", Handler: func(c *CommandContext) {
+		c.Bot.handleParamsCommand(c.ChatID, c.UserID, c.User, c.Args, c.RequestID)
+	}})
+	registerCommand(Command{Name: "reasoning", Args: "[low|medium|high|tokens <n>|default|hide|show]", Description: "Show or change reasoning effort and thinking display", Handler: func(c *CommandContext) {
+		c.Bot.handleReasoningCommand(c.ChatID, c.UserID, c.User, c.Args, c.RequestID)
+	}})
+	registerCommand(Command{Name: "output", Args: "[tables|code|math <mode>]", Description: "Choose how wide tables, long code blocks and math are sent", Handler: func(c *CommandContext) {
+		c.Bot.handleOutputCommand(c.ChatID, c.UserID, c.User, c.Args, c.RequestID)
+	}})
+	registerCommand(Command{Name: "thread", Args: "[new|switch|rename|delete|system …]", Description: "List, create and switch conversation threads", Handler: func(c *CommandContext) {
+		c.Bot.handleThreadCommand(c.ChatID, c.UserID, c.User, c.Args, c.RequestID)
+	}})
+	registerCommand(Command{Name: "new", Description: "Start a new conversation in the current thread", Handler: func(c *CommandContext) {
+		c.Bot.handleNewCommand(c.ChatID, c.UserID, c.RequestID)
+	}})
+	registerCommand(Command{Name: "context", Args: "[strategy window|summary|pin [n]|unpin]", Description: "Show context usage, pin messages or choose how long conversations are shortened", Handler: func(c *CommandContext) {
+		c.Bot.handleContextCommand(c.Ctx, c.ChatID, c.UserID, c.User, c.Args, c.RequestID)
+	}})
+	registerCommand(Command{Name: "export", Args: "[md|json|html]", Description: "Export the current conversation as a file", Handler: func(c *CommandContext) {
+		c.Bot.handleExportCommand(c.ChatID, c.UserID, c.Args, c.RequestID)
+	}})
+	registerCommand(Command{Name: "import", Description: "Continue a conversation from a JSON file (OpenAI messages or ChatGPT export)", Handler: func(c *CommandContext) {
+		c.Bot.handleImportCommand(c.ChatID, c.UserID, c.RequestID)
+	}})
+	registerCommand(Command{Name: "compare", Args: "<model1> <model2> ... -- <prompt>|@<set> <prompt>|save|sets|delete …", Description: "Ask several models the same question", Handler: func(c *CommandContext) {
+		c.Bot.handleCompareCommand(c.Ctx, c.ChatID, c.UserID, c.User, c.Args, c.RequestID)
+	}})
+	registerCommand(Command{Name: "web", Args: "<question>|on|off", Description: "Answer with web search results and sources (on/off for every message)", Handler: func(c *CommandContext) {
+		c.Bot.handleWebCommand(c.Ctx, c.ChatID, c.UserID, c.User, c.Args, c.RequestID)
+	}})
+	registerCommand(Command{Name: "tools", Args: "[on|off|enable <tool>|disable <tool>]", Description: "Let the model use a calculator, the clock, unit conversion and web pages", Handler: func(c *CommandContext) {
+		c.Bot.handleToolsCommand(c.ChatID, c.UserID, c.User, c.Args, c.RequestID)
+	}})
+	registerCommand(Command{Name: "cache", Args: "[on|force|off|clear]", Description: "Reuse answers to identical requests", Handler: func(c *CommandContext) {
+		c.Bot.handleCacheCommand(c.ChatID, c.UserID, c.User, c.Args, c.RequestID)
+	}})
+	registerCommand(Command{Name: "usage", Description: "Show your requests, tokens, cost and cache hits", Handler: func(c *CommandContext) {
+		c.Bot.handleUsageCommand(c.ChatID, c.UserID, c.User, c.Args, c.RequestID)
+	}})
+	registerCommand(Command{Name: "getcredits", Description: "Check your OpenRouter credits balance", Handler: handleGetCreditsCommand})
+	registerCommand(Command{Name: "stop", Description: "Stop the answer that is being generated", Handler: func(c *CommandContext) {
+		c.Bot.handleStopCommand(c.Message, c.RequestID)
+	}})
+	registerCommand(Command{Name: "debug", Description: "Toggle debug logging", Role: RoleAdmin, Handler: handleDebugCommand})
+	registerCommand(Command{Name: "stats", Args: "[days]", Description: "Show active users, requests, cost and error rate per day and model", Role: RoleAdmin, Handler: handleStatsCommand})
+	registerCommand(Command{Name: "users", Description: "List users with their last activity and model", Role: RoleAdmin, Handler: handleUsersCommand})
+	registerCommand(Command{Name: "whois", Args: "<user_id>", Description: "Show a user's settings and usage", Role: RoleAdmin, Handler: handleWhoisCommand})
+	registerCommand(Command{Name: "broadcast", Args: "<text>", Description: "Send a message to all authorized users", Role: RoleAdmin, Handler: handleBroadcastCommand})
+}
+
+// Handle the /help command
+func handleHelpCommand(c *CommandContext) {
+	c.Bot.sendMessage(c.ChatID, helpText(c.UserID), c.RequestID)
+}
+
+// Handle the /settoken command
+func handleSetTokenCommand(c *CommandContext) {
+	token, ok := c.requireText()
+	if !ok {
+		return
+	}
+	addLogSecret(token)
+	modifyUser(c.UserID, c.RequestID, func(stored *User) { stored.OpenRouterToken = token })
+	c.Bot.sendMessage(c.ChatID, "OpenRouter API token has been set! You can now chat with AI models.", c.RequestID)
+}
+
+// Handle the /model command
+func handleModelCommand(c *CommandContext) {
+	if c.User.CurrentModel == "" {
+		c.Bot.sendMessage(c.ChatID, "No model selected. Use /setmodel <name> to select a model.", c.RequestID)
+		return
+	}
+	modelID := c.User.Models[c.User.CurrentModel]
+	c.Bot.sendMessage(c.ChatID, fmt.Sprintf("Current model: %s (%s)", c.User.CurrentModel, modelID), c.RequestID)
+}
+
+// Handle the /models command
+func handleModelsCommand(c *CommandContext) {
+	if len(c.User.Models) == 0 {
+		c.Bot.sendMessage(c.ChatID, "No models available. Use /addmodel to add some.", c.RequestID)
+		return
+	}
+	var modelsList string
+	for name, id := range c.User.Models {
+		modelsList += fmt.Sprintf("• %s (%s)\n", name, id)
+	}
+	c.Bot.sendMessage(c.ChatID, fmt.Sprintf("Available models:\n%s\nUse /setmodel <name> to select a model.\n Full models list (for getting ids) can be saw in: https://openrouter.ai/models?order=top-weekly", modelsList), c.RequestID)
+}
+
+// Handle the /setmodel command
+func handleSetModelCommand(c *CommandContext) {
+	fields, ok := c.requireFields(1, 1)
+	if !ok {
+		return
+	}
+	modelName := fields[0]
+	if _, exists := c.User.Models[modelName]; !exists {
+		c.Bot.sendMessage(c.ChatID, fmt.Sprintf("Model '%s' not found. Use /models to see available models.", modelName), c.RequestID)
+		return
+	}
+	modifyUser(c.UserID, c.RequestID, func(stored *User) { stored.CurrentModel = modelName })
+	setThreadModel(c.UserID, modelName, c.RequestID)
+	c.Bot.sendMessage(c.ChatID, fmt.Sprintf("Model set to: %s (%s)", modelName, c.User.Models[modelName]), c.RequestID)
+}
+
+// Handle the /addmodel command
+func handleAddModelCommand(c *CommandContext) {
+	fields, ok := c.requireFields(2, 2)
+	if !ok {
+		return
+	}
+	name, id := fields[0], fields[1]
+	modifyUser(c.UserID, c.RequestID, func(stored *User) {
+		if stored.Models == nil {
+			stored.Models = make(map[string]string)
+		}
+		stored.Models[name] = id
+	})
+	c.Bot.sendMessage(c.ChatID, fmt.Sprintf("Model added: %s (%s)", name, id), c.RequestID)
+}
+
+// Handle the /removemodel command
+func handleRemoveModelCommand(c *CommandContext) {
+	fields, ok := c.requireFields(1, 1)
+	if !ok {
+		return
+	}
+	modelName := fields[0]
+	if _, exists := c.User.Models[modelName]; !exists {
+		c.Bot.sendMessage(c.ChatID, fmt.Sprintf("Model '%s' not found.", modelName), c.RequestID)
+		return
+	}
+	modifyUser(c.UserID, c.RequestID, func(stored *User) {
+		if stored.CurrentModel == modelName {
+			stored.CurrentModel = ""
+		}
+		// A new slice, since the fallbacks of the old profile may be in use
+		stored.FallbackModels = slices.DeleteFunc(slices.Clone(stored.FallbackModels), func(name string) bool {
+			return name == modelName
+		})
+		delete(stored.ModelParams, modelName)
+		delete(stored.Models, modelName)
+	})
+	c.Bot.sendMessage(c.ChatID, fmt.Sprintf("Model '%s' removed.", modelName), c.RequestID)
+}
+
+// Handle the /fallbacks command
+func handleFallbacksCommand(c *CommandContext) {
+	if len(c.User.FallbackModels) == 0 {
+		c.Bot.sendMessage(c.ChatID, "No fallback models set. Use /setfallbacks <name1> <name2> ... to set them.", c.RequestID)
+		return
+	}
+	var fallbackList string
+	for i, name := range c.User.FallbackModels {
+		fallbackList += fmt.Sprintf("%d. %s (%s)\n", i+1, name, c.User.Models[name])
+	}
+	c.Bot.sendMessage(c.ChatID, fmt.Sprintf("Fallback models, tried in order when %s fails:\n%s", c.User.CurrentModel, fallbackList), c.RequestID)
+}
+
+// Handle the /setfallbacks command
+func handleSetFallbacksCommand(c *CommandContext) {
+	names, ok := c.requireFields(1, 0)
+	if !ok {
+		return
+	}
+	if len(names) == 1 && names[0] == "off" {
+		modifyUser(c.UserID, c.RequestID, func(stored *User) { stored.FallbackModels = nil })
+		c.Bot.sendMessage(c.ChatID, "Fallback models cleared.", c.RequestID)
+		return
+	}
+	for _, name := range names {
+		if _, exists := c.User.Models[name]; !exists {
+			c.Bot.sendMessage(c.ChatID, fmt.Sprintf("Model '%s' not found. Use /models to see available models.", name), c.RequestID)
+			return
+		}
+	}
+	modifyUser(c.UserID, c.RequestID, func(stored *User) { stored.FallbackModels = names })
+	c.Bot.sendMessage(c.ChatID, fmt.Sprintf("Fallback models set: %s", strings.Join(names, ", ")), c.RequestID)
+}
+
+// Handle the /debug command
+func handleDebugCommand(c *CommandContext) {
+	configMu.Lock()
+	if config.LogLevel == LogLevelDebug {
+		config.LogLevel = LogLevelInfo
+		setLogLevel(config.LogLevel)
+		configMu.Unlock()
+		saveConfig()
+		c.Bot.sendMessage(c.ChatID, "Debug mode disabled.", c.RequestID)
+	} else {
+		config.LogLevel = LogLevelDebug
+		setLogLevel(config.LogLevel)
+		configMu.Unlock()
+		saveConfig()
+		c.Bot.sendMessage(c.ChatID, "Debug mode enabled. Check logs for detailed information.", c.RequestID)
+	}
+}
+
+// Handle the /getcredits command
+func handleGetCreditsCommand(c *CommandContext) {
+	if c.User.OpenRouterToken == "" {
+		c.Bot.sendMessage(c.ChatID, "Please set your OpenRouter API token first with /settoken <your_token>", c.RequestID)
+		return
+	}
+	c.Bot.sendTypingAction(c.ChatID, c.RequestID)
+	credits, err := c.Bot.GetCredits(c.User.OpenRouterToken, c.RequestID)
+	if err != nil {
+		logError("[%s] Failed to get credits: %v", c.RequestID, err)
+		c.Bot.sendMessage(c.ChatID, fmt.Sprintf("Error getting credits: %v", err), c.RequestID)
+		return
+	}
+	c.Bot.sendMessage(c.ChatID, FormatCreditsInfo(credits), c.RequestID)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Most models queried by one /compare. Each model takes a rate limit token,
+// so a comparison must fit in one burst.
+const maxCompareModels = rateLimitBurst
+
+const compareUsage = `Usage:
+/compare <model1> <model2> ... -- <prompt> - Ask several models the same question
+/compare @<set> <prompt> - Use a saved comparison set
+/compare save <set> <model1> <model2> ... - Save a comparison set
+/compare sets - List saved comparison sets
+/compare delete <set> - Delete a comparison set
+
+Models are names from /models, OpenRouter model IDs (such as openai/gpt-4o) or <provider>:<model> IDs.`
+
+// compareResult is the answer of one model in a comparison
+type compareResult struct {
+	name       string
+	modelID    string
+	completion *Completion
+	err        error
+	latency    time.Duration
+}
+
+// Handle the /compare command
+func (b *Bot) handleCompareCommand(ctx context.Context, chatID int64, userID int64, user User, args string, requestID string) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		b.sendMessage(chatID, compareUsage, requestID)
+		return
+	}
+
+	switch fields[0] {
+	case "sets":
+		b.sendMessage(chatID, formatCompareSets(user), requestID)
+		return
+	case "save":
+		if len(fields) < 4 {
+			b.sendMessage(chatID, "Usage: /compare save <set> <model1> <model2> ...", requestID)
+			return
+		}
+		models := fields[2:]
+		if err := validateCompareModels(user, models); err != nil {
+			b.sendMessage(chatID, "❌ "+err.Error(), requestID)
+			return
+		}
+		modifyUser(userID, requestID, func(stored *User) {
+			if stored.CompareSets == nil {
+				stored.CompareSets = make(map[string][]string)
+			}
+			stored.CompareSets[fields[1]] = models
+		})
+		b.sendMessage(chatID, fmt.Sprintf("Comparison set %q saved: %s", fields[1], strings.Join(models, ", ")), requestID)
+		return
+	case "delete":
+		if len(fields) != 2 {
+			b.sendMessage(chatID, "Usage: /compare delete <set>", requestID)
+			return
+		}
+		if _, exists := user.CompareSets[fields[1]]; !exists {
+			b.sendMessage(chatID, fmt.Sprintf("Comparison set %q not found.", fields[1]), requestID)
+			return
+		}
+		modifyUser(userID, requestID, func(stored *User) { delete(stored.CompareSets, fields[1]) })
+		b.sendMessage(chatID, fmt.Sprintf("Comparison set %q deleted.", fields[1]), requestID)
+		return
+	}
+
+	models, prompt, err := parseCompareArgs(user, args)
+	if err != nil {
+		b.sendMessage(chatID, "❌ "+err.Error()+"\n\n"+compareUsage, requestID)
+		return
+	}
+	for _, model := range models {
+		if single, _ := compareUser(user, model); user.OpenRouterToken == "" && currentProvider(single).needsOpenRouterToken() {
+			b.sendMessage(chatID, "Please set your OpenRouter API token first with /settoken <your_token>", requestID)
+			return
+		}
+	}
+
+	// Every model is a paid request, so take all their tokens before starting
+	if !b.takeRequestTokens(chatID, userID, len(models), requestID) {
+		return
+	}
+
+	b.runComparison(ctx, chatID, userID, user, models, prompt, requestID)
+}
+
+// Parse the models and prompt of a comparison: either a model list and the
+// prompt separated by "--", or a saved set followed by the prompt
+func parseCompareArgs(user User, args string) ([]string, string, error) {
+	args = strings.TrimSpace(args)
+	var models []string
+	var prompt string
+
+	if strings.HasPrefix(args, "@") {
+		name, rest, _ := strings.Cut(args[1:], " ")
+		set, exists := user.CompareSets[name]
+		if !exists {
+			return nil, "", fmt.Errorf("comparison set %q not found", name)
+		}
+		models = set
+		prompt = strings.TrimPrefix(strings.TrimSpace(rest), "-- ")
+	} else {
+		modelList, rest, found := strings.Cut(args, "--")
+		if !found {
+			return nil, "", fmt.Errorf(`separate the models from the prompt with "--"`)
+		}
+		models = strings.Fields(modelList)
+		prompt = rest
+	}
+
+	prompt = strings.TrimSpace(prompt)
+	if prompt == "" {
+		return nil, "", fmt.Errorf("the prompt is empty")
+	}
+	if len(models) < 2 {
+		return nil, "", fmt.Errorf("name at least two models to compare")
+	}
+	if err := validateCompareModels(user, models); err != nil {
+		return nil, "", err
+	}
+	return models, prompt, nil
+}
+
+// Check that the models of a comparison exist and are not too many
+func validateCompareModels(user User, models []string) error {
+	if len(models) > maxCompareModels {
+		return fmt.Errorf("at most %d models can be compared at once", maxCompareModels)
+	}
+	for _, model := range models {
+		if _, exists := user.Models[model]; !exists && !strings.ContainsAny(model, "/:") {
+			return fmt.Errorf("model %q not found. Use a name from /models, an OpenRouter model ID or <provider>:<model>", model)
+		}
+	}
+	return nil
+}
+
+// Get a copy of the user that queries a single model: the model becomes
+// current and fallbacks are disabled, so each answer comes from that model
+func compareUser(user User, model string) (User, string) {
+	single := user
+	single.Models = maps.Clone(user.Models)
+	single.FallbackModels = nil
+	if _, exists := single.Models[model]; !exists {
+		// A model ID rather than a name
+		single.Models[model] = model
+	}
+	single.CurrentModel = model
+	return single, single.Models[model]
+}
+
+// Query the models concurrently, keep a status message up to date as
+// answers arrive, and send each answer as a labelled message
+func (b *Bot) runComparison(ctx context.Context, chatID int64, userID int64, user User, models []string, prompt string, requestID string) {
+	logInfo("[%s] Comparing %d models: %s", requestID, len(models), strings.Join(models, ", "))
+	b.sendTypingAction(chatID, requestID)
+
+	reqCtx, finish := startActiveRequest(ctx, chatID, strings.Join(models, ", "), prompt, requestID)
+	defer finish()
+
+	results := make([]*compareResult, len(models))
+	statusID := b.sendCompareStatus(chatID, 0, models, results, requestID)
+
+	// Each model request needs a slot: the slot of the message being handled,
+	// or a free worker slot. The own slot always comes back, so the comparison
+	// makes progress even when all the worker slots are taken.
+	ownSlot := make(chan struct{}, 1)
+	ownSlot <- struct{}{}
+
+	var mu sync.Mutex // guards results, status edits and sent answers
+	var wg sync.WaitGroup
+	for i, model := range models {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			single, modelID := compareUser(user, model)
+			start := time.Now()
+			var completion *Completion
+			var err error
+			var release func()
+			select {
+			case <-ownSlot:
+				release = func() { ownSlot <- struct{}{} }
+			case workerSlots <- struct{}{}:
+				release = func() { <-workerSlots }
+			case <-reqCtx.Done():
+				err = context.Cause(reqCtx)
+			}
+			if release != nil {
+				completion, err = b.queryOpenRouterWithContext(reqCtx, single, []Message{{Role: "user", Content: prompt}}, requestID)
+				release()
+			}
+			result := &compareResult{name: model, modelID: modelID, completion: completion, err: err, latency: time.Since(start)}
+			if completion != nil {
+				recordUsage(userID, completion, requestID)
+			}
+
+			// Send the answer under the lock so that the parts of long
+			// answers from different models do not interleave
+			mu.Lock()
+			defer mu.Unlock()
+			results[i] = result
+			b.sendCompareStatus(chatID, statusID, models, results, requestID)
+			b.sendCompareAnswer(chatID, single, result, requestID)
+		}()
+	}
+	wg.Wait()
+	logInfo("[%s] Comparison finished", requestID)
+}
+
+// Send or update the status message of a comparison. Returns the message ID.
+func (b *Bot) sendCompareStatus(chatID int64, messageID int, models []string, results []*compareResult, requestID string) int {
+	var sb strings.Builder
+	done := 0
+	for i, model := range models {
+		result := results[i]
+		switch {
+		case result == nil:
+			sb.WriteString(fmt.Sprintf("⏳ %s\n", model))
+		case result.err != nil:
+			done++
+			sb.WriteString(fmt.Sprintf("❌ %s: %s\n", model, compareErrorText(result.err)))
+		default:
+			done++
+			sb.WriteString(fmt.Sprintf("✅ %s: %s\n", model, formatCompareStats(result)))
+		}
+	}
+	text := fmt.Sprintf("🔬 Comparing %d models (%d/%d done)\n\n%s", len(models), done, len(models), sb.String())
+
+	if messageID == 0 {
+		sent, err := b.telegram.Send(tgbotapi.NewMessage(chatID, text))
+		if err != nil {
+			logError("[%s] Failed to send comparison status: %v", requestID, err)
+			return 0
+		}
+		return sent.MessageID
+	}
+	if _, err := b.telegram.Send(tgbotapi.NewEditMessageText(chatID, messageID, text)); err != nil {
+		logError("[%s] Failed to update comparison status: %v", requestID, err)
+	}
+	return messageID
+}
+
+// Describe the latency, token usage and cost of an answer
+func formatCompareStats(result *compareResult) string {
+	stats := []string{fmt.Sprintf("%.1fs", result.latency.Seconds())}
+	if result.completion.Cached {
+		return strings.Join(append(stats, "♻️ cached"), " · ")
+	}
+	if usage := result.completion.Usage; usage != nil {
+		stats = append(stats, fmt.Sprintf("%d+%d tokens", usage.PromptTokens, usage.CompletionTokens))
+		if usage.Cost > 0 {
+			stats = append(stats, formatCost(usage.Cost))
+		}
+	}
+	return strings.Join(stats, " · ")
+}
+
+// Get a short description of a failed comparison request
+func compareErrorText(err error) string {
+	if errors.Is(err, errStoppedByUser) {
+		return "stopped"
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Message
+	}
+	return err.Error()
+}
+
+// Send the answer of one model, labelled with the model and its stats
+func (b *Bot) sendCompareAnswer(chatID int64, user User, result *compareResult, requestID string) {
+	if result.err != nil && (result.completion == nil || strings.TrimSpace(result.completion.Content) == "") {
+		return
+	}
+
+	label := fmt.Sprintf("**%s** (%s)", result.name, result.modelID)
+	if result.err == nil {
+		label += " · " + formatCompareStats(result)
+	} else {
+		label += " · ⏹ partial"
+	}
+	b.sendAnswer(chatID, user, result.completion, label+"\n\n"+cleanModelPrefix(result.completion.Content), requestID)
+}
+
+// Describe the user's saved comparison sets
+func formatCompareSets(user User) string {
+	if len(user.CompareSets) == 0 {
+		return "No comparison sets saved. Use /compare save <set> <model1> <model2> ... to save one."
+	}
+	var sb strings.Builder
+	sb.WriteString("Comparison sets:\n")
+	for _, name := range sortedKeys(user.CompareSets) {
+		sb.WriteString(fmt.Sprintf("• %s: %s\n", name, strings.Join(user.CompareSets[name], ", ")))
+	}
+	sb.WriteString("\nUse /compare @<set> <prompt> to run one.")
+	return sb.String()
+}
+
+// Get the keys of a map in sorted order
+func sortedKeys[V any](m map[string]V) []string {
+	return slices.Sorted(maps.Keys(m))
+}
@@ -2,27 +2,46 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
+	"maps"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 // Configuration structure
 type Config struct {
-	TelegramToken string         `json:"telegram_token"`
-	Users         map[int64]User `json:"users"`
-	AuthorizedIDs map[int64]bool `json:"authorized_ids"` // Track authorized users
-	LogLevel      string         `json:"log_level"`      // Log level (debug, info, error)
+	TelegramToken string               `json:"telegram_token"`
+	Users         map[int64]User       `json:"users"`
+	AuthorizedIDs map[int64]bool       `json:"authorized_ids"`      // Track authorized users
+	LogLevel      string               `json:"log_level"`           // Log level (debug, info, error)
+	Providers     map[string]Provider  `json:"providers,omitempty"` // OpenAI-compatible APIs available to all users
+	Stats         map[string]*DayStats `json:"stats,omitempty"`     // day -> activity shown by /stats
 	// Not storing password in the config file for security
 }
 
 // User structure to store per-user settings
 type User struct {
-	OpenRouterToken string            `json:"openrouter_token"`
-	CurrentModel    string            `json:"current_model"`
-	Models          map[string]string `json:"models"` // name -> id mapping
+	OpenRouterToken string                      `json:"openrouter_token"`
+	CurrentModel    string                      `json:"current_model"`
+	Models          map[string]string           `json:"models"`                    // name -> id mapping
+	FallbackModels  []string                    `json:"fallback_models,omitempty"` // model names tried when the current model fails
+	Params          GenerationParams            `json:"params"`                    // default generation parameters
+	ModelParams     map[string]GenerationParams `json:"model_params,omitempty"`    // model name -> parameter overrides
+	Reasoning       ReasoningSettings           `json:"reasoning"`                 // reasoning model preferences
+	Output          OutputSettings              `json:"output"`                    // output of wide tables, long code and math
+	Context         ContextSettings             `json:"context"`                   // handling of conversations longer than the context window
+	CompareSets     map[string][]string         `json:"compare_sets,omitempty"`    // set name -> models compared by /compare
+	Cache           string                      `json:"cache,omitempty"`           // response cache mode: off, on or force
+	Usage           UsageStats                  `json:"usage"`                     // requests, tokens and cost spent so far
+	Tools           ToolSettings                `json:"tools"`                     // tools the model may call
+	Web             bool                        `json:"web,omitempty"`             // search the web for every message
+	Providers       map[string]Provider         `json:"providers,omitempty"`       // name -> the user's own OpenAI-compatible APIs
+	LastActive      time.Time                   `json:"last_active,omitzero"`      // when the user last sent a message
 }
 
 // Logger levels
@@ -36,9 +55,13 @@ const (
 var (
 	config      Config
 	configMu    sync.Mutex
+	configSave  = newDelayedSave(writeConfig)
 	httpClient  *http.Client
-	logger      *log.Logger
+	logger      *slog.Logger
 	botPassword string // Store the password separately from the config
+
+	adminIDs     map[int64]bool // Users allowed to run admin commands
+	adminIDsOnce sync.Once
 )
 
 // Default models to include
@@ -51,28 +74,43 @@ var defaultModels = map[string]string{
 	"mistral-7b-instruct": "mistralai/mistral-7b-instruct-v0.1",
 }
 
-const (
-	configFile = "data/bot_config.json"
-	helpText   = `Available commands:
-/help - Show this help message
-/settoken <token> - Set your OpenRouter API token
-/model - Show current AI model
-/models - List available AI models
-/setmodel <name> - Set current AI model by name
-/addmodel <your_name> <openrouter_id> - Add a new model to your list
-/removemodel <name> - Remove a model from your list
-/getcredits - Check your OpenRouter credits balance
-Just send a message to chat with the current AI model!`
-)
+const configFile = "data/bot_config.json"
 
 // Get the bot password from environment variable
 func getBotPassword() string {
 	if botPassword == "" {
 		botPassword = os.Getenv("BOT_PASSWORD")
+		addLogSecret(botPassword)
 	}
 	return botPassword
 }
 
+// Get the IDs of the bot admins from the BOT_ADMIN_IDS environment variable,
+// a comma-separated list of Telegram user IDs
+func getAdminIDs() map[int64]bool {
+	adminIDsOnce.Do(func() {
+		adminIDs = make(map[int64]bool)
+		for _, field := range strings.Split(os.Getenv("BOT_ADMIN_IDS"), ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			id, err := strconv.ParseInt(field, 10, 64)
+			if err != nil {
+				logError("Ignoring invalid admin ID %q in BOT_ADMIN_IDS", field)
+				continue
+			}
+			adminIDs[id] = true
+		}
+	})
+	return adminIDs
+}
+
+// Check whether a user is a bot admin
+func isAdmin(userID int64) bool {
+	return getAdminIDs()[userID]
+}
+
 // Check if essential environment variables are set
 func checkEnvironmentVars() {
 	// Check if password is set
@@ -81,7 +119,10 @@ func checkEnvironmentVars() {
 		os.Exit(1)
 	}
 
-	// You could add other checks here in the future
+	// Admin commands, /debug included, are only available to the admins
+	if len(getAdminIDs()) == 0 {
+		logWarning("BOT_ADMIN_IDS is not set: admin commands such as /debug, /stats and /users are disabled")
+	}
 }
 
 func initHTTPClient() {
@@ -95,10 +136,30 @@ func initHTTPClient() {
 	}
 }
 
-// Load configuration from file or create default
-func loadConfig() {
+// Create the client of the model APIs, which uses httpClient
+func newLLMClient() LLMClient {
+	// Providers registered by users who are not admins may only be on public
+	// addresses, so that they cannot make the bot reach its own network
+	publicClient := &http.Client{
+		Timeout: defaultTimeout,
+		Transport: &http.Transport{
+			Proxy:               nil, // a proxy would bypass the address check
+			DialContext:         (&net.Dialer{Timeout: 30 * time.Second, Control: checkPublicAddress}).DialContext,
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+	return tracingLLMClient{metricsLLMClient{&httpLLMClient{client: httpClient, publicClient: publicClient}}}
+}
+
+// Load configuration from file or create default. Connecting to Telegram
+// needs the bot password and token; the terminal chat needs neither.
+func loadConfig(telegram bool) {
 	// First check environment variables
-	checkEnvironmentVars()
+	if telegram {
+		checkEnvironmentVars()
+	}
 
 	configMu.Lock()
 
@@ -118,9 +179,28 @@ func loadConfig() {
 		logInfo("Config file not found, creating new one")
 	}
 
+	addLogSecret(config.TelegramToken)
+
+	// Apply the log level and keep the stored secrets out of the logs
+	setLogLevel(config.LogLevel)
+	for _, user := range config.Users {
+		addLogSecret(user.OpenRouterToken)
+		for _, provider := range user.Providers {
+			addLogSecret(provider.APIKey)
+		}
+	}
+	for _, provider := range config.Providers {
+		addLogSecret(provider.APIKey)
+	}
+
 	// Check if Telegram token is set, if not, get from environment
 	if config.TelegramToken == "" {
 		config.TelegramToken = os.Getenv("TELEGRAM_TOKEN")
+		addLogSecret(config.TelegramToken)
+		if config.TelegramToken == "" && !telegram {
+			configMu.Unlock()
+			return
+		}
 		if config.TelegramToken == "" {
 			configMu.Unlock() // Make sure to unlock before fatal
 			logError("Telegram token not provided. Set it in config file or TELEGRAM_TOKEN environment variable")
@@ -135,18 +215,23 @@ func loadConfig() {
 	}
 }
 
-// Save configuration to file
+// Save configuration to file. The file is written shortly after, together
+// with the changes made in the meantime.
 func saveConfig() {
-	configMu.Lock()
-	defer configMu.Unlock()
+	configSave.schedule()
+}
 
+// Write configuration to file
+func writeConfig() {
+	configMu.Lock()
 	data, err := json.MarshalIndent(config, "", "  ")
+	configMu.Unlock()
 	if err != nil {
 		logError("Failed to marshal config: %v", err)
 		return
 	}
 
-	if err := os.WriteFile(configFile, data, 0644); err != nil {
+	if err := writeFileAtomic(configFile, data, 0644); err != nil {
 		logError("Failed to write config file: %v", err)
 	} else {
 		logDebug("Config saved successfully")
@@ -183,13 +268,23 @@ func getUser(userID int64, requestID string) User {
 	return user
 }
 
-// Update user in config
-func updateUser(userID int64, user User, requestID string) {
+// Change a user's profile under the config lock, so that changes made
+// meanwhile by other requests, such as usage counts, are kept. The maps of
+// the profile are copied first: copies returned by getUser share them and are
+// read without the lock. Returns the changed profile.
+func modifyUser(userID int64, requestID string, modify func(user *User)) User {
 	configMu.Lock()
+	user := config.Users[userID]
+	user.Models = maps.Clone(user.Models)
+	user.ModelParams = maps.Clone(user.ModelParams)
+	user.CompareSets = maps.Clone(user.CompareSets)
+	user.Providers = maps.Clone(user.Providers)
+	modify(&user)
 	config.Users[userID] = user
 	configMu.Unlock()
 
 	// Save config after releasing the lock
 	saveConfig()
 	logDebug("[%s] Updated user profile for user %d", requestID, userID)
+	return user
 }
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Ways to fit a long conversation into the model's context window
+const (
+	ContextStrategyWindow  = "window"  // drop the oldest messages
+	ContextStrategySummary = "summary" // replace the oldest messages with a summary
+)
+
+const (
+	messageTokenOverhead  = 4    // Tokens added per message for the role and separators
+	maxOutputReserve      = 4096 // Most tokens kept free for the answer when max_tokens is not set
+	maxSummarizedRunes    = 2000 // Longest message text passed to the summariser
+	defaultPinnedMessages = 2    // Messages pinned by /context pin without a count
+)
+
+const contextUsage = `Usage:
+/context - Show how much of the model's context the current thread uses
+/context strategy window|summary - Drop the oldest messages (window) or summarise them (summary) when the context is full
+/context pin [n] - Always keep the last n messages (default 2) in the context
+/context unpin - Unpin all messages`
+
+// ContextSettings are the user's preferences for long conversations
+type ContextSettings struct {
+	Strategy string `json:"strategy,omitempty"` // window (default) or summary
+}
+
+// contextPlan is the selection of conversation messages sent to the model
+type contextPlan struct {
+	messages      []Message
+	contextLength int // context length of the model, in tokens
+	reserved      int // tokens kept free for the answer
+	systemTokens  int
+	summaryTokens int
+	pinnedTokens  int
+	recentTokens  int
+	queryTokens   int
+	pinned        int // number of pinned messages included
+	recent        int // number of recent messages included
+	firstRecent   int // index of the oldest recent message included
+	dropped       int // number of messages left out
+}
+
+// Estimate the number of tokens in text. Latin text averages about four
+// characters per token; other scripts are counted as one token per character
+// so the estimate errs on the side of leaving room.
+func estimateTokens(text string) int {
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < 128 {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+3)/4 + other
+}
+
+// Estimate the number of tokens of a message
+func estimateMessageTokens(content string) int {
+	return estimateTokens(content) + messageTokenOverhead
+}
+
+// Get the strategy, defaulting to the sliding window
+func (s ContextSettings) strategy() string {
+	if s.Strategy == "" {
+		return ContextStrategyWindow
+	}
+	return s.Strategy
+}
+
+// Tokens kept free for the answer
+func outputReserve(contextLength int, params GenerationParams) int {
+	if params.MaxTokens != nil {
+		return min(*params.MaxTokens, contextLength/2)
+	}
+	return min(contextLength/4, maxOutputReserve)
+}
+
+// Select the messages that fit into the context: the system prompt, the
+// summary of older messages, pinned messages and as many recent messages as
+// fit, followed by the query.
+func planContext(conversation Conversation, query string, settings ContextSettings, contextLength int, params GenerationParams) contextPlan {
+	plan := contextPlan{
+		contextLength: contextLength,
+		reserved:      outputReserve(contextLength, params),
+		queryTokens:   estimateMessageTokens(query),
+	}
+	if conversation.SystemPrompt != "" {
+		plan.systemTokens = estimateMessageTokens(conversation.SystemPrompt)
+	}
+
+	// With a summary, the messages it covers are only sent as the summary
+	useSummary := settings.strategy() == ContextStrategySummary && conversation.Summary != ""
+	start := 0
+	if useSummary {
+		plan.summaryTokens = estimateMessageTokens(conversation.Summary)
+		start = min(conversation.Summarized, len(conversation.Messages))
+	}
+
+	for _, message := range conversation.Messages {
+		if message.Pinned {
+			plan.pinnedTokens += estimateMessageTokens(message.Content)
+			plan.pinned++
+		}
+	}
+
+	// Add recent messages, newest first, until the budget is used up
+	budget := plan.contextLength - plan.reserved - plan.systemTokens - plan.summaryTokens - plan.pinnedTokens - plan.queryTokens
+	plan.firstRecent = len(conversation.Messages)
+	for i := len(conversation.Messages) - 1; i >= start; i-- {
+		message := conversation.Messages[i]
+		if message.Pinned {
+			plan.firstRecent = i
+			continue
+		}
+		tokens := estimateMessageTokens(message.Content)
+		if tokens > budget {
+			break
+		}
+		budget -= tokens
+		plan.recentTokens += tokens
+		plan.recent++
+		plan.firstRecent = i
+	}
+	plan.dropped = len(conversation.Messages) - plan.pinned - plan.recent
+	if useSummary {
+		plan.dropped = max(0, plan.dropped-conversation.Summarized)
+	}
+
+	// Build the messages in chronological order
+	if conversation.SystemPrompt != "" {
+		plan.messages = append(plan.messages, Message{Role: "system", Content: conversation.SystemPrompt})
+	}
+	if useSummary {
+		plan.messages = append(plan.messages, Message{Role: "system", Content: "Summary of the earlier conversation:\n" + conversation.Summary})
+	}
+	for i, message := range conversation.Messages {
+		if message.Pinned || i >= plan.firstRecent {
+			plan.messages = append(plan.messages, Message{Role: message.Role, Content: message.Content})
+		}
+	}
+	plan.messages = append(plan.messages, Message{Role: "user", Content: query})
+	return plan
+}
+
+// Get the messages to send for a query in the user's current thread. With
+// the summary strategy, messages that no longer fit are summarised first.
+func (b *Bot) buildContext(ctx context.Context, user User, userID int64, conversation Conversation, query string, requestID string) contextPlan {
+	modelID := user.Models[user.CurrentModel]
+	contextLength := b.modelContextLength(ctx, modelID, requestID)
+	params := effectiveParams(user)
+	plan := planContext(conversation, query, user.Context, contextLength, params)
+
+	if user.Context.strategy() != ContextStrategySummary || plan.firstRecent <= conversation.Summarized {
+		return plan
+	}
+
+	logInfo("[%s] Summarising messages %d-%d of thread %q", requestID, conversation.Summarized+1, plan.firstRecent, conversation.Name)
+	summary, err := b.summarizeMessages(ctx, user, userID, conversation.Summary, conversation.Messages[conversation.Summarized:plan.firstRecent], requestID)
+	if err != nil {
+		logError("[%s] Failed to summarise conversation, dropping old messages instead: %v", requestID, err)
+		return plan
+	}
+	conversation.Summary = summary
+	conversation.Summarized = plan.firstRecent
+	setThreadSummary(userID, conversation.Name, summary, plan.firstRecent, requestID)
+	return planContext(conversation, query, user.Context, contextLength, params)
+}
+
+// Summarise messages with a cheap model (or the thread's own model on another
+// provider), extending the previous summary
+func (b *Bot) summarizeMessages(ctx context.Context, user User, userID int64, previous string, messages []ConversationMessage, requestID string) (string, error) {
+	var transcript strings.Builder
+	if previous != "" {
+		transcript.WriteString("Summary so far:\n" + previous + "\n\nNew messages:\n")
+	}
+	for _, message := range messages {
+		transcript.WriteString(fmt.Sprintf("%s: %s\n\n", messageHeading(message), truncateRunes(message.Content, maxSummarizedRunes)))
+	}
+
+	completion, err := b.queryUtilityModel(ctx, user, utilityModelID(user), []Message{
+		{Role: "system", Content: "Summarise the conversation below so that it can replace the messages as context for continuing it. " +
+			"Keep facts, decisions, names, numbers, code identifiers and open questions. Be concise and reply with the summary only."},
+		{Role: "user", Content: transcript.String()},
+	}, requestID)
+	if err != nil {
+		return "", err
+	}
+	recordUsage(userID, completion, requestID)
+
+	summary := strings.TrimSpace(completion.Content)
+	if summary == "" {
+		return "", fmt.Errorf("the summariser returned an empty summary")
+	}
+	return summary, nil
+}
+
+// Store the summary of the oldest messages of a thread
+func setThreadSummary(userID int64, thread string, summary string, summarized int, requestID string) {
+	conversationsMu.Lock()
+	conversation := userThreadsLocked(userID).Threads[thread]
+	if conversation == nil || summarized > len(conversation.Messages) {
+		conversationsMu.Unlock()
+		return
+	}
+	conversation.Summary = summary
+	conversation.Summarized = summarized
+	conversationsMu.Unlock()
+
+	saveConversations()
+	logDebug("[%s] Stored summary of %d messages of thread %q of user %d", requestID, summarized, thread, userID)
+}
+
+// Pin the last n messages of the user's current thread, or unpin all
+// messages when n is 0. Returns the number of messages changed.
+func pinMessages(userID int64, n int, requestID string) int {
+	conversationsMu.Lock()
+	threads := userThreadsLocked(userID)
+	conversation := threads.Threads[threads.Current]
+	changed := 0
+	for i := range conversation.Messages {
+		pinned := n > 0 && i >= len(conversation.Messages)-n
+		if n == 0 && conversation.Messages[i].Pinned {
+			conversation.Messages[i].Pinned = false
+			changed++
+		} else if pinned && !conversation.Messages[i].Pinned {
+			conversation.Messages[i].Pinned = true
+			changed++
+		}
+	}
+	conversationsMu.Unlock()
+
+	saveConversations()
+	logDebug("[%s] Pinned %d messages of user %d (n=%d)", requestID, changed, userID, n)
+	return changed
+}
+
+// Handle the /context command
+func (b *Bot) handleContextCommand(ctx context.Context, chatID int64, userID int64, user User, args string, requestID string) {
+	fields := strings.Fields(strings.ToLower(args))
+	if len(fields) == 0 {
+		if user.CurrentModel == "" || user.Models[user.CurrentModel] == "" {
+			b.sendMessage(chatID, "Please select a model first with /setmodel <model_name>", requestID)
+			return
+		}
+		conversation := getConversation(userID)
+		modelID := user.Models[user.CurrentModel]
+		plan := planContext(conversation, "", user.Context, b.modelContextLength(ctx, modelID, requestID), effectiveParams(user))
+		b.sendMessage(chatID, formatContextPlan(conversation, user, plan)+"\n\n"+contextUsage, requestID)
+		return
+	}
+
+	switch fields[0] {
+	case "strategy":
+		if len(fields) != 2 || (fields[1] != ContextStrategyWindow && fields[1] != ContextStrategySummary) {
+			b.sendMessage(chatID, contextUsage, requestID)
+			return
+		}
+		modifyUser(userID, requestID, func(stored *User) { stored.Context.Strategy = fields[1] })
+		b.sendMessage(chatID, fmt.Sprintf("Context strategy set to %s.", fields[1]), requestID)
+	case "pin":
+		n := defaultPinnedMessages
+		if len(fields) == 2 {
+			parsed, err := strconv.Atoi(fields[1])
+			if err != nil || parsed <= 0 {
+				b.sendMessage(chatID, "The number of messages to pin must be a positive integer.", requestID)
+				return
+			}
+			n = parsed
+		} else if len(fields) > 2 {
+			b.sendMessage(chatID, contextUsage, requestID)
+			return
+		}
+		changed := pinMessages(userID, n, requestID)
+		b.sendMessage(chatID, fmt.Sprintf("Pinned %d messages. They are always kept in the context.", changed), requestID)
+	case "unpin":
+		changed := pinMessages(userID, 0, requestID)
+		b.sendMessage(chatID, fmt.Sprintf("Unpinned %d messages.", changed), requestID)
+	default:
+		b.sendMessage(chatID, contextUsage, requestID)
+	}
+}
+
+// Describe the context usage of a thread
+func formatContextPlan(conversation Conversation, user User, plan contextPlan) string {
+	used := plan.systemTokens + plan.summaryTokens + plan.pinnedTokens + plan.recentTokens
+	available := plan.contextLength - plan.reserved
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Context of thread %q with %s (%s):\n", conversation.Name, user.CurrentModel, user.Models[user.CurrentModel]))
+	sb.WriteString(fmt.Sprintf("Context length: %d tokens, %d reserved for the answer\n", plan.contextLength, plan.reserved))
+	sb.WriteString(fmt.Sprintf("In use: ~%d tokens (%d%% of %d)\n", used, used*100/max(available, 1), available))
+	if plan.systemTokens > 0 {
+		sb.WriteString(fmt.Sprintf("• System prompt: ~%d tokens\n", plan.systemTokens))
+	}
+	if plan.summaryTokens > 0 {
+		sb.WriteString(fmt.Sprintf("• Summary of %d older messages: ~%d tokens\n", conversation.Summarized, plan.summaryTokens))
+	}
+	if plan.pinned > 0 {
+		sb.WriteString(fmt.Sprintf("• Pinned messages: %d (~%d tokens)\n", plan.pinned, plan.pinnedTokens))
+	}
+	sb.WriteString(fmt.Sprintf("• Recent messages: %d (~%d tokens)\n", plan.recent, plan.recentTokens))
+	if plan.dropped > 0 {
+		sb.WriteString(fmt.Sprintf("• Left out: %d oldest messages\n", plan.dropped))
+	}
+	sb.WriteString("Strategy: " + user.Context.strategy())
+	return sb.String()
+}
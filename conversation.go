@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const conversationsFile = "data/conversations.json"
+
+// ConversationMessage is one message of a conversation with its details
+type ConversationMessage struct {
+	Role             string    `json:"role"`
+	Content          string    `json:"content"`
+	Model            string    `json:"model,omitempty"` // ID of the model that wrote an assistant message
+	Time             time.Time `json:"time"`
+	PromptTokens     int       `json:"prompt_tokens,omitempty"`
+	CompletionTokens int       `json:"completion_tokens,omitempty"`
+	Cost             float64   `json:"cost,omitempty"`   // cost of generating the message, in credits
+	Pinned           bool      `json:"pinned,omitempty"` // always kept in the context
+}
+
+// Conversation is a named thread of the chat history of a user, with its own
+// model and system prompt
+type Conversation struct {
+	Name         string                `json:"name"`
+	Title        string                `json:"title,omitempty"`         // generated from the first exchange
+	Model        string                `json:"model,omitempty"`         // model name used in this thread
+	SystemPrompt string                `json:"system_prompt,omitempty"` // sent before the history
+	Summary      string                `json:"summary,omitempty"`       // summary of the oldest messages
+	Summarized   int                   `json:"summarized,omitempty"`    // number of oldest messages covered by the summary
+	StartedAt    time.Time             `json:"started_at"`
+	Messages     []ConversationMessage `json:"messages"`
+}
+
+// UserThreads are the conversation threads of a user
+type UserThreads struct {
+	Current string                   `json:"current"` // name of the active thread
+	Threads map[string]*Conversation `json:"threads"`
+}
+
+var (
+	conversations     = make(map[int64]*UserThreads) // user ID -> conversation threads
+	conversationsMu   sync.Mutex
+	conversationsSave = newDelayedSave(writeConversations)
+)
+
+// Load conversations from file. Files written before threads existed hold
+// a single conversation per user, which becomes the default thread.
+func loadConversations() {
+	conversationsMu.Lock()
+	defer conversationsMu.Unlock()
+
+	data, err := os.ReadFile(conversationsFile)
+	if err != nil {
+		logInfo("Conversations file not found, starting with empty history")
+		return
+	}
+
+	var stored map[int64]json.RawMessage
+	if err := json.Unmarshal(data, &stored); err != nil {
+		logError("Failed to parse conversations file: %v", err)
+		return
+	}
+	for userID, raw := range stored {
+		var threads UserThreads
+		if err := json.Unmarshal(raw, &threads); err != nil {
+			logError("Failed to parse conversations of user %d: %v", userID, err)
+			continue
+		}
+		if threads.Threads == nil {
+			var conversation Conversation
+			if err := json.Unmarshal(raw, &conversation); err != nil {
+				logError("Failed to parse conversation of user %d: %v", userID, err)
+				continue
+			}
+			conversation.Name = defaultThreadName
+			threads = UserThreads{Current: defaultThreadName, Threads: map[string]*Conversation{defaultThreadName: &conversation}}
+			logInfo("Migrated the conversation of user %d to thread %q", userID, defaultThreadName)
+		}
+		conversations[userID] = &threads
+	}
+}
+
+// Save conversations to file. The file is written shortly after, together
+// with the changes made in the meantime.
+func saveConversations() {
+	conversationsSave.schedule()
+}
+
+// Write conversations to file
+func writeConversations() {
+	conversationsMu.Lock()
+	data, err := json.MarshalIndent(conversations, "", "  ")
+	conversationsMu.Unlock()
+	if err != nil {
+		logError("Failed to marshal conversations: %v", err)
+		return
+	}
+
+	if err := writeFileAtomic(conversationsFile, data, 0644); err != nil {
+		logError("Failed to write conversations file: %v", err)
+	} else {
+		logDebug("Conversations saved successfully")
+	}
+}
+
+// Get the threads of a user, creating the default thread if needed.
+// The caller must hold conversationsMu.
+func userThreadsLocked(userID int64) *UserThreads {
+	threads, exists := conversations[userID]
+	if !exists {
+		threads = &UserThreads{Threads: make(map[string]*Conversation)}
+		conversations[userID] = threads
+	}
+	if threads.Threads[threads.Current] == nil {
+		if len(threads.Threads) == 0 {
+			threads.Threads[defaultThreadName] = &Conversation{Name: defaultThreadName, StartedAt: time.Now()}
+		}
+		if threads.Threads[defaultThreadName] != nil {
+			threads.Current = defaultThreadName
+		} else {
+			threads.Current = sortedThreadNames(threads)[0]
+		}
+	}
+	return threads
+}
+
+// Copy a conversation so it can be used without holding the lock
+func (c *Conversation) copy() Conversation {
+	copied := *c
+	copied.Messages = append([]ConversationMessage(nil), c.Messages...)
+	return copied
+}
+
+// Get a copy of the user's current conversation
+func getConversation(userID int64) Conversation {
+	conversationsMu.Lock()
+	defer conversationsMu.Unlock()
+
+	threads := userThreadsLocked(userID)
+	return threads.Threads[threads.Current].copy()
+}
+
+// Add messages to a conversation thread of the user. Returns false if the
+// thread no longer exists.
+func appendToConversation(userID int64, thread string, messages []ConversationMessage, requestID string) bool {
+	conversationsMu.Lock()
+	conversation := userThreadsLocked(userID).Threads[thread]
+	if conversation != nil {
+		conversation.Messages = append(conversation.Messages, messages...)
+	}
+	conversationsMu.Unlock()
+
+	if conversation == nil {
+		logInfo("[%s] Thread %q of user %d was deleted, answer not saved", requestID, thread, userID)
+		return false
+	}
+
+	// Save after releasing the lock
+	saveConversations()
+	logDebug("[%s] Added %d messages to thread %q of user %d", requestID, len(messages), thread, userID)
+	return true
+}
+
+// Replace the messages of the user's current conversation, and its system
+// prompt if one is given. Returns the number of messages replaced.
+func replaceConversation(userID int64, messages []ConversationMessage, title string, systemPrompt string, requestID string) int {
+	conversationsMu.Lock()
+	threads := userThreadsLocked(userID)
+	conversation := threads.Threads[threads.Current]
+	count := len(conversation.Messages)
+	conversation.Messages = messages
+	conversation.Title = title
+	if systemPrompt != "" {
+		conversation.SystemPrompt = systemPrompt
+	}
+	conversation.Summary = ""
+	conversation.Summarized = 0
+	conversation.StartedAt = time.Now()
+	conversationsMu.Unlock()
+
+	saveConversations()
+	logDebug("[%s] Replaced the conversation of user %d (%d messages) with %d messages", requestID, userID, count, len(messages))
+	return count
+}
+
+// Start a new conversation in the user's current thread, keeping its model
+// and system prompt. Returns the number of messages forgotten.
+func resetConversation(userID int64, requestID string) int {
+	conversationsMu.Lock()
+	threads := userThreadsLocked(userID)
+	conversation := threads.Threads[threads.Current]
+	count := len(conversation.Messages)
+	conversation.Messages = nil
+	conversation.Title = ""
+	conversation.Summary = ""
+	conversation.Summarized = 0
+	conversation.StartedAt = time.Now()
+	conversationsMu.Unlock()
+
+	saveConversations()
+	logInfo("[%s] Started a new conversation for user %d, %d messages cleared", requestID, userID, count)
+	return count
+}
+
+// Get the total cost of the conversation
+func (c Conversation) totalCost() float64 {
+	total := 0.0
+	for _, message := range c.Messages {
+		total += message.Cost
+	}
+	return total
+}
+
+// Build the conversation messages for a query and the completion that answered it
+func exchangeMessages(query string, queryTime time.Time, completion *Completion) []ConversationMessage {
+	answer := ConversationMessage{
+		Role:    "assistant",
+		Content: completion.Content,
+		Model:   completion.Model,
+		Time:    time.Now(),
+	}
+	if completion.Usage != nil {
+		answer.PromptTokens = completion.Usage.PromptTokens
+		answer.CompletionTokens = completion.Usage.CompletionTokens
+		if !completion.Cached {
+			answer.Cost = completion.Usage.Cost
+		}
+	}
+	return []ConversationMessage{{Role: "user", Content: query, Time: queryTime}, answer}
+}
+
+// Handle the /new command
+func (b *Bot) handleNewCommand(chatID int64, userID int64, requestID string) {
+	count := resetConversation(userID, requestID)
+	if count == 0 {
+		b.sendMessage(chatID, "Started a new conversation.", requestID)
+		return
+	}
+	b.sendMessage(chatID, fmt.Sprintf("Started a new conversation. The previous one (%d messages) is forgotten.", count), requestID)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// Formats of exported conversations
+const (
+	ExportMarkdown = "md"
+	ExportJSON     = "json"
+	ExportHTML     = "html"
+)
+
+const exportUsage = `Usage:
+/export - Export the current conversation as Markdown
+/export md|json|html - Export it as Markdown, JSON (OpenAI messages format) or HTML`
+
+// Converts answers to HTML for exported documents
+var exportHTMLConverter = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// conversationExport is an exported conversation in JSON. The messages use
+// the OpenAI messages format, with the message details as extra fields.
+type conversationExport struct {
+	StartedAt  time.Time             `json:"started_at"`
+	ExportedAt time.Time             `json:"exported_at"`
+	TotalCost  float64               `json:"total_cost"`
+	Title      string                `json:"title,omitempty"`
+	Messages   []ConversationMessage `json:"messages"`
+}
+
+// Handle the /export command
+func (b *Bot) handleExportCommand(chatID int64, userID int64, args string, requestID string) {
+	format := strings.ToLower(strings.TrimSpace(args))
+	switch format {
+	case "", "markdown":
+		format = ExportMarkdown
+	case ExportMarkdown, ExportJSON, ExportHTML:
+	default:
+		b.sendMessage(chatID, exportUsage, requestID)
+		return
+	}
+
+	conversation := getConversation(userID)
+	if len(conversation.Messages) == 0 {
+		b.sendMessage(chatID, "The current conversation is empty, there is nothing to export.", requestID)
+		return
+	}
+
+	data, err := exportConversation(conversation, format)
+	if err != nil {
+		logError("[%s] Failed to export conversation: %v", requestID, err)
+		b.sendMessage(chatID, fmt.Sprintf("Error exporting conversation: %v", err), requestID)
+		return
+	}
+
+	name := fmt.Sprintf("%s-%s.%s", conversation.Name, conversation.StartedAt.Format("2006-01-02-1504"), format)
+	doc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{Name: name, Bytes: data})
+	doc.Caption = fmt.Sprintf("%d messages, total cost %s", len(conversation.Messages), formatCost(conversation.totalCost()))
+	if _, err := b.telegram.Send(doc); err != nil {
+		logError("[%s] Failed to send exported conversation: %v", requestID, err)
+		b.sendMessage(chatID, "Could not send the exported conversation.", requestID)
+		return
+	}
+	logInfo("[%s] Exported conversation of user %d as %s (%d bytes)", requestID, userID, format, len(data))
+}
+
+// Export a conversation in the given format
+func exportConversation(conversation Conversation, format string) ([]byte, error) {
+	if conversation.SystemPrompt != "" {
+		system := ConversationMessage{Role: "system", Content: conversation.SystemPrompt, Time: conversation.StartedAt}
+		conversation.Messages = append([]ConversationMessage{system}, conversation.Messages...)
+	}
+
+	switch format {
+	case ExportJSON:
+		export := conversationExport{
+			StartedAt:  conversation.StartedAt,
+			ExportedAt: time.Now(),
+			TotalCost:  conversation.totalCost(),
+			Title:      conversation.Title,
+			Messages:   conversation.Messages,
+		}
+		data, err := json.MarshalIndent(export, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal conversation: %v", err)
+		}
+		return data, nil
+	case ExportHTML:
+		return exportConversationHTML(conversation)
+	default:
+		return []byte(exportConversationMarkdown(conversation)), nil
+	}
+}
+
+// Export a conversation as a Markdown document
+func exportConversationMarkdown(conversation Conversation) string {
+	var sb strings.Builder
+	sb.WriteString("# " + conversationHeading(conversation) + "\n\n")
+	sb.WriteString(fmt.Sprintf("- Started: %s\n", formatExportTime(conversation.StartedAt)))
+	sb.WriteString(fmt.Sprintf("- Messages: %d\n", len(conversation.Messages)))
+	sb.WriteString(fmt.Sprintf("- Total cost: %s\n", formatCost(conversation.totalCost())))
+
+	for _, message := range conversation.Messages {
+		sb.WriteString("\n---\n\n")
+		sb.WriteString(fmt.Sprintf("## %s\n\n", messageHeading(message)))
+		sb.WriteString(fmt.Sprintf("*%s*\n\n", messageDetails(message)))
+		sb.WriteString(strings.TrimSpace(message.Content) + "\n")
+	}
+	return sb.String()
+}
+
+// Export a conversation as a self-contained HTML document
+func exportConversationHTML(conversation Conversation) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>` + html.EscapeString(conversationHeading(conversation)) + `</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; max-width: 860px; margin: 2em auto; padding: 0 1em; line-height: 1.5; color: #1f2328; }
+.message { border: 1px solid #d0d7de; border-radius: 8px; padding: 0 1em; margin: 1em 0; }
+.user { background: #f6f8fa; }
+.prompt { white-space: pre-wrap; }
+.details { color: #656d76; font-size: 0.85em; }
+pre { background: #f6f8fa; padding: 0.8em; overflow-x: auto; border-radius: 6px; }
+code { font-family: ui-monospace, Menlo, Consolas, monospace; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #d0d7de; padding: 0.3em 0.6em; }
+</style>
+</head>
+<body>
+<h1>` + html.EscapeString(conversationHeading(conversation)) + `</h1>
+`)
+	buf.WriteString(fmt.Sprintf("<p class=\"details\">Started %s · %d messages · total cost %s</p>\n",
+		html.EscapeString(formatExportTime(conversation.StartedAt)), len(conversation.Messages),
+		html.EscapeString(formatCost(conversation.totalCost()))))
+
+	for _, message := range conversation.Messages {
+		buf.WriteString(fmt.Sprintf("<div class=\"message %s\">\n", html.EscapeString(message.Role)))
+		buf.WriteString(fmt.Sprintf("<h3>%s</h3>\n", html.EscapeString(messageHeading(message))))
+		buf.WriteString(fmt.Sprintf("<p class=\"details\">%s</p>\n", html.EscapeString(messageDetails(message))))
+		if message.Role == "user" {
+			// Prompts are shown as typed
+			buf.WriteString(fmt.Sprintf("<p class=\"prompt\">%s</p>\n", html.EscapeString(message.Content)))
+		} else if err := exportHTMLConverter.Convert([]byte(message.Content), &buf); err != nil {
+			return nil, fmt.Errorf("failed to convert message to HTML: %v", err)
+		}
+		buf.WriteString("</div>\n")
+	}
+
+	buf.WriteString("</body>\n</html>\n")
+	return buf.Bytes(), nil
+}
+
+// Get the heading of an exported conversation
+func conversationHeading(conversation Conversation) string {
+	if conversation.Title != "" {
+		return conversation.Title
+	}
+	if conversation.Name != "" {
+		return "Conversation " + conversation.Name
+	}
+	return "Conversation"
+}
+
+// Get the heading of an exported message
+func messageHeading(message ConversationMessage) string {
+	switch message.Role {
+	case "user":
+		return "User"
+	case "assistant":
+		if message.Model != "" {
+			return "Assistant (" + message.Model + ")"
+		}
+		return "Assistant"
+	case "":
+		return "Message"
+	}
+	return strings.ToUpper(message.Role[:1]) + message.Role[1:]
+}
+
+// Describe the time, tokens and cost of an exported message
+func messageDetails(message ConversationMessage) string {
+	details := []string{formatExportTime(message.Time)}
+	if message.PromptTokens > 0 || message.CompletionTokens > 0 {
+		details = append(details, fmt.Sprintf("%d prompt + %d completion tokens", message.PromptTokens, message.CompletionTokens))
+	}
+	if message.Cost > 0 {
+		details = append(details, "cost "+formatCost(message.Cost))
+	}
+	return strings.Join(details, " · ")
+}
+
+// Format a timestamp for exported documents
+func formatExportTime(t time.Time) string {
+	if t.IsZero() {
+		return "unknown time"
+	}
+	return t.UTC().Format("2006-01-02 15:04:05 UTC")
+}
+
+// Format a cost in OpenRouter credits
+func formatCost(cost float64) string {
+	return fmt.Sprintf("$%.4f", cost)
+}
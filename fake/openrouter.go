@@ -0,0 +1,377 @@
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Response is a scripted answer of the fake OpenRouter
+type Response struct {
+	Content   string
+	Reasoning string
+	Model     string // model reported in the answer, by default the requested one
+	ToolCalls []ToolCall
+	Citations []Citation
+
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64
+
+	// Status, when not 200, makes the request fail with Error as the message
+	Status int
+	Error  string
+	Header map[string]string // extra response headers, such as Retry-After
+
+	// StreamError is sent as an error chunk after the content, as when a
+	// provider fails mid-generation
+	StreamError string
+
+	// Delay is waited before answering, or between streamed chunks when
+	// streaming. It is cut short when the bot cancels the request.
+	Delay time.Duration
+}
+
+// ToolCall is a tool the scripted answer asks the bot to run
+type ToolCall struct {
+	ID        string
+	Name      string
+	Arguments string // JSON object
+}
+
+// Citation is a web page cited by the scripted answer
+type Citation struct {
+	URL   string
+	Title string
+}
+
+// Request is a chat completion request received by the fake
+type Request struct {
+	Header   http.Header
+	Body     []byte
+	Model    string
+	Messages []RequestMessage
+	Stream   bool
+	Tools    []string // names of the tools offered to the model
+	// ToolChoice is "none" when the model must answer without calling tools
+	ToolChoice string
+}
+
+// RequestMessage is a message of a received request
+type RequestMessage struct {
+	Role       string `json:"role"`
+	Content    string `json:"content"`
+	ToolCallID string `json:"tool_call_id"`
+}
+
+// LastUserMessage returns the content of the last user message of the request
+func (r Request) LastUserMessage() string {
+	for i := len(r.Messages) - 1; i >= 0; i-- {
+		if r.Messages[i].Role == "user" {
+			return r.Messages[i].Content
+		}
+	}
+	return ""
+}
+
+// Model is an entry of the fake models catalog
+type Model struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	ContextLength int    `json:"context_length"`
+}
+
+// OpenRouter is an OpenAI-compatible API server answering with scripted
+// responses. Point the bot at it with OPENROUTER_BASE_URL set to BaseURL().
+type OpenRouter struct {
+	Server *httptest.Server
+
+	mu        sync.Mutex
+	responses []Response
+	requests  []Request
+
+	// Credits and Usage are returned by the credits endpoint
+	Credits float64
+	Usage   float64
+	// Models are returned by the models endpoint
+	Models []Model
+}
+
+// NewOpenRouter starts a fake OpenRouter. Requests without a scripted
+// response are answered with "Echo: " and the last user message.
+func NewOpenRouter() *OpenRouter {
+	f := &OpenRouter{Credits: 10}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/chat/completions", f.handleChat)
+	mux.HandleFunc("GET /api/v1/credits", f.handleCredits)
+	mux.HandleFunc("GET /api/v1/models", f.handleModels)
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+// BaseURL returns the API base URL of the fake
+func (f *OpenRouter) BaseURL() string {
+	return f.Server.URL + "/api/v1"
+}
+
+// Close stops the server
+func (f *OpenRouter) Close() {
+	f.Server.Close()
+}
+
+// Enqueue scripts the answers to the next requests, in order
+func (f *OpenRouter) Enqueue(responses ...Response) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, responses...)
+}
+
+// Requests returns the chat completion requests received so far
+func (f *OpenRouter) Requests() []Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Request(nil), f.requests...)
+}
+
+func (f *OpenRouter) handleChat(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var decoded struct {
+		Model    string           `json:"model"`
+		Messages []RequestMessage `json:"messages"`
+		Stream   bool             `json:"stream"`
+		Tools    []struct {
+			Function struct {
+				Name string `json:"name"`
+			} `json:"function"`
+		} `json:"tools"`
+		ToolChoice string `json:"tool_choice"`
+	}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: "+err.Error(), nil)
+		return
+	}
+	request := Request{Header: r.Header.Clone(), Body: body, Model: decoded.Model, Messages: decoded.Messages, Stream: decoded.Stream,
+		ToolChoice: decoded.ToolChoice}
+	for _, tool := range decoded.Tools {
+		request.Tools = append(request.Tools, tool.Function.Name)
+	}
+
+	f.mu.Lock()
+	f.requests = append(f.requests, request)
+	response := Response{Content: "Echo: " + request.LastUserMessage()}
+	if len(f.responses) > 0 {
+		response = f.responses[0]
+		f.responses = f.responses[1:]
+	}
+	f.mu.Unlock()
+
+	if response.Model == "" {
+		response.Model = request.Model
+	}
+	if response.Status != 0 && response.Status != http.StatusOK {
+		if !sleep(r, response.Delay) {
+			return
+		}
+		writeError(w, response.Status, response.Error, response.Header)
+		return
+	}
+	for name, value := range response.Header {
+		w.Header().Set(name, value)
+	}
+	if request.Stream {
+		streamResponse(w, r, response)
+	} else {
+		if !sleep(r, response.Delay) {
+			return
+		}
+		writeJSONResponse(w, response)
+	}
+}
+
+// Wait for a delay, returning false if the client went away meanwhile
+func sleep(r *http.Request, delay time.Duration) bool {
+	if delay <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(delay):
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string, header map[string]string) {
+	for name, value := range header {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{"code": status, "message": message}})
+}
+
+// Get the usage object of a response
+func usage(response Response) map[string]any {
+	return map[string]any{
+		"prompt_tokens":     response.PromptTokens,
+		"completion_tokens": response.CompletionTokens,
+		"total_tokens":      response.PromptTokens + response.CompletionTokens,
+		"cost":              response.Cost,
+	}
+}
+
+// Get the tool calls of a response in the API format
+func toolCalls(response Response, streamed bool) []map[string]any {
+	var calls []map[string]any
+	for i, call := range response.ToolCalls {
+		id := call.ID
+		if id == "" {
+			id = fmt.Sprintf("call_%d", i+1)
+		}
+		encoded := map[string]any{
+			"id":       id,
+			"type":     "function",
+			"function": map[string]any{"name": call.Name, "arguments": call.Arguments},
+		}
+		if streamed {
+			encoded["index"] = i
+		}
+		calls = append(calls, encoded)
+	}
+	return calls
+}
+
+// Get the citations of a response as annotations
+func annotations(response Response) []map[string]any {
+	var encoded []map[string]any
+	for _, citation := range response.Citations {
+		encoded = append(encoded, map[string]any{
+			"type":         "url_citation",
+			"url_citation": map[string]any{"url": citation.URL, "title": citation.Title},
+		})
+	}
+	return encoded
+}
+
+func writeJSONResponse(w http.ResponseWriter, response Response) {
+	message := map[string]any{"role": "assistant", "content": response.Content}
+	if response.Reasoning != "" {
+		message["reasoning"] = response.Reasoning
+	}
+	if calls := toolCalls(response, false); calls != nil {
+		message["tool_calls"] = calls
+	}
+	if citations := annotations(response); citations != nil {
+		message["annotations"] = citations
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":      "gen-fake",
+		"model":   response.Model,
+		"choices": []map[string]any{{"message": message, "finish_reason": "stop"}},
+		"usage":   usage(response),
+	})
+}
+
+// Stream a response as server-sent events: the reasoning and the content in
+// a few chunks each, then tool calls, citations and usage
+func streamResponse(w http.ResponseWriter, r *http.Request, response Response) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	flusher, _ := w.(http.Flusher)
+	send := func(chunk map[string]any) bool {
+		if !sleep(r, response.Delay) {
+			return false
+		}
+		chunk["id"] = "gen-fake"
+		chunk["model"] = response.Model
+		data, _ := json.Marshal(chunk)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+	delta := func(fields map[string]any) map[string]any {
+		return map[string]any{"choices": []map[string]any{{"delta": fields}}}
+	}
+
+	fmt.Fprint(w, ": OPENROUTER PROCESSING\n\n")
+	for _, part := range splitWords(response.Reasoning) {
+		if !send(delta(map[string]any{"reasoning": part})) {
+			return
+		}
+	}
+	for _, part := range splitWords(response.Content) {
+		if !send(delta(map[string]any{"content": part})) {
+			return
+		}
+	}
+	if response.StreamError != "" {
+		send(map[string]any{"error": map[string]any{"message": response.StreamError}})
+		return
+	}
+	if calls := toolCalls(response, true); calls != nil {
+		if !send(delta(map[string]any{"tool_calls": calls})) {
+			return
+		}
+	}
+	if citations := annotations(response); citations != nil {
+		if !send(delta(map[string]any{"annotations": citations})) {
+			return
+		}
+	}
+	if !send(map[string]any{"choices": []map[string]any{{"delta": map[string]any{}, "finish_reason": "stop"}}, "usage": usage(response)}) {
+		return
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+// Split text into chunks of a few words, keeping the spaces
+func splitWords(text string) []string {
+	var chunks []string
+	for len(text) > 0 {
+		end := len(text)
+		spaces := 0
+		for i, r := range text {
+			if r == ' ' {
+				spaces++
+				if spaces == 3 {
+					end = i + 1
+					break
+				}
+			}
+		}
+		chunks = append(chunks, text[:end])
+		text = text[end:]
+	}
+	return chunks
+}
+
+func (f *OpenRouter) handleCredits(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		writeError(w, http.StatusUnauthorized, "No auth credentials found", nil)
+		return
+	}
+	f.mu.Lock()
+	credits, used := f.Credits, f.Usage
+	f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"credits": credits, "usage": used})
+}
+
+func (f *OpenRouter) handleModels(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	models := append([]Model(nil), f.Models...)
+	f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"data": models})
+}
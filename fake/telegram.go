@@ -0,0 +1,232 @@
+// Package fake provides offline stand-ins for the Telegram Bot API and the
+// OpenRouter API, to run the bot's handlers end to end without network access.
+package fake
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Call is a request the bot made to Telegram
+type Call struct {
+	Method    string // Telegram API method, such as sendMessage
+	ChatID    int64
+	MessageID int    // message edited or deleted, or the ID given to a sent message
+	Text      string // text of messages, caption of files, action of chat actions
+	ParseMode string
+	FileName  string // name of an uploaded file
+	FileData  []byte // content of an uploaded file
+	Config    tgbotapi.Chattable
+}
+
+// Telegram records the requests of the bot instead of sending them. It
+// implements the bot's TelegramSender interface.
+type Telegram struct {
+	mu            sync.Mutex
+	calls         []Call
+	nextMessageID int
+	files         map[string][]byte // file ID -> content served by the file server
+	fileServer    *httptest.Server
+
+	// Err, when set, is returned by every request, as if Telegram were unreachable
+	Err error
+}
+
+// NewTelegram creates a recording fake Telegram. Close it to stop the file
+// server used for downloads.
+func NewTelegram() *Telegram {
+	t := &Telegram{nextMessageID: 1, files: make(map[string][]byte)}
+	t.fileServer = httptest.NewServer(http.HandlerFunc(t.serveFile))
+	return t
+}
+
+// Close stops the file server
+func (t *Telegram) Close() {
+	t.fileServer.Close()
+}
+
+// Send records a message or file and returns it as if it were sent
+func (t *Telegram) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	call := t.record(c)
+	if t.Err != nil {
+		return tgbotapi.Message{}, t.Err
+	}
+	return tgbotapi.Message{MessageID: call.MessageID, Chat: &tgbotapi.Chat{ID: call.ChatID}, Text: call.Text}, nil
+}
+
+// Request records a request that does not send a message, such as a chat
+// action or a deletion
+func (t *Telegram) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	t.record(c)
+	if t.Err != nil {
+		return nil, t.Err
+	}
+	return &tgbotapi.APIResponse{Ok: true, Result: []byte("true")}, nil
+}
+
+// GetFileDirectURL returns the download URL of a file added with AddFile
+func (t *Telegram) GetFileDirectURL(fileID string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, exists := t.files[fileID]; !exists {
+		return "", fmt.Errorf("file %s not found", fileID)
+	}
+	return t.fileServer.URL + "/file/" + fileID, nil
+}
+
+// GetMe returns the bot account, or Err
+func (t *Telegram) GetMe() (tgbotapi.User, error) {
+	if t.Err != nil {
+		return tgbotapi.User{}, t.Err
+	}
+	return tgbotapi.User{ID: 1, IsBot: true, FirstName: "Fake", UserName: "fake_bot"}, nil
+}
+
+// AddFile makes a file available for download, as if a user had sent it
+func (t *Telegram) AddFile(fileID string, data []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.files[fileID] = data
+}
+
+func (t *Telegram) serveFile(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	data, exists := t.files[strings.TrimPrefix(r.URL.Path, "/file/")]
+	t.mu.Unlock()
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(data)
+}
+
+// Record a request and describe it
+func (t *Telegram) record(c tgbotapi.Chattable) Call {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	call := Call{Config: c}
+	sendsMessage := false
+	switch config := c.(type) {
+	case tgbotapi.MessageConfig:
+		call.Method, call.ChatID, call.Text, call.ParseMode = "sendMessage", config.ChatID, config.Text, config.ParseMode
+		sendsMessage = true
+	case tgbotapi.EditMessageTextConfig:
+		call.Method, call.ChatID, call.MessageID = "editMessageText", config.ChatID, config.MessageID
+		call.Text, call.ParseMode = config.Text, config.ParseMode
+	case tgbotapi.DeleteMessageConfig:
+		call.Method, call.ChatID, call.MessageID = "deleteMessage", config.ChatID, config.MessageID
+	case tgbotapi.ChatActionConfig:
+		call.Method, call.ChatID, call.Text = "sendChatAction", config.ChatID, config.Action
+	case tgbotapi.DocumentConfig:
+		call.Method, call.ChatID, call.Text, call.ParseMode = "sendDocument", config.ChatID, config.Caption, config.ParseMode
+		call.FileName, call.FileData = uploadedFile(config.File)
+		sendsMessage = true
+	case tgbotapi.PhotoConfig:
+		call.Method, call.ChatID, call.Text, call.ParseMode = "sendPhoto", config.ChatID, config.Caption, config.ParseMode
+		call.FileName, call.FileData = uploadedFile(config.File)
+		sendsMessage = true
+	case tgbotapi.CallbackConfig:
+		call.Method, call.Text = "answerCallbackQuery", config.Text
+	case tgbotapi.SetMyCommandsConfig:
+		call.Method = "setMyCommands"
+		if config.Scope != nil {
+			call.ChatID = config.Scope.ChatID
+		}
+	default:
+		call.Method = fmt.Sprintf("%T", c)
+	}
+	if sendsMessage {
+		call.MessageID = t.nextMessageID
+		t.nextMessageID++
+	}
+	t.calls = append(t.calls, call)
+	return call
+}
+
+// Get the name and content of a file to upload
+func uploadedFile(file tgbotapi.RequestFileData) (string, []byte) {
+	if file == nil || !file.NeedsUpload() {
+		return "", nil
+	}
+	name, reader, err := file.UploadData()
+	if err != nil {
+		return name, nil
+	}
+	data, _ := io.ReadAll(reader)
+	return name, data
+}
+
+// Calls returns the recorded requests in order
+func (t *Telegram) Calls() []Call {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Call(nil), t.calls...)
+}
+
+// Messages returns the recorded requests of a chat that sent messages or
+// files, skipping chat actions, edits and deletions
+func (t *Telegram) Messages(chatID int64) []Call {
+	var messages []Call
+	for _, call := range t.Calls() {
+		if call.ChatID != chatID {
+			continue
+		}
+		switch call.Method {
+		case "sendMessage", "sendDocument", "sendPhoto":
+			messages = append(messages, call)
+		}
+	}
+	return messages
+}
+
+// Texts returns the texts of the messages sent to a chat
+func (t *Telegram) Texts(chatID int64) []string {
+	var texts []string
+	for _, call := range t.Messages(chatID) {
+		if call.Method == "sendMessage" {
+			texts = append(texts, call.Text)
+		}
+	}
+	return texts
+}
+
+// Reset forgets the recorded requests
+func (t *Telegram) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.calls = nil
+}
+
+// Message builds an incoming text message from a user in their private
+// chat. Text starting with / is marked as a command.
+func Message(userID int64, text string) *tgbotapi.Message {
+	message := &tgbotapi.Message{
+		MessageID: 1,
+		From:      &tgbotapi.User{ID: userID, FirstName: "Test"},
+		Chat:      &tgbotapi.Chat{ID: userID, Type: "private"},
+		Text:      text,
+	}
+	if strings.HasPrefix(text, "/") {
+		length := len(text)
+		if i := strings.IndexAny(text, " \n"); i >= 0 {
+			length = i
+		}
+		message.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: length}}
+	}
+	return message
+}
+
+// Document builds an incoming message with a file added with AddFile
+func Document(userID int64, fileID string, fileName string, caption string) *tgbotapi.Message {
+	message := Message(userID, "")
+	message.Document = &tgbotapi.Document{FileID: fileID, FileName: fileName}
+	message.Caption = caption
+	return message
+}
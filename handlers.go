@@ -2,22 +2,21 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"html"
-	"regexp"
-	"sort"
-	"strconv"
+	"log/slog"
+	"slices"
 	"strings"
 	"time"
 	"unicode/utf8"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var bot *tgbotapi.BotAPI
-
 // Check if user is authorized, or handle authorization
-func isAuthorized(userID int64, message *tgbotapi.Message, requestID string) bool {
+func (b *Bot) isAuthorized(userID int64, message *tgbotapi.Message, requestID string) bool {
 	configMu.Lock()
 	defer configMu.Unlock()
 
@@ -31,10 +30,10 @@ func isAuthorized(userID int64, message *tgbotapi.Message, requestID string) boo
 	if message.Text == getBotPassword() { // Use the function instead of hardcoded constant
 		logInfo("[%s] User %d successfully authorized with password", requestID, userID)
 		config.AuthorizedIDs[userID] = true
-		go saveConfig() // Save authorization status
+		saveConfig() // Save authorization status
 		// Inform user of successful authorization
 		msg := tgbotapi.NewMessage(message.Chat.ID, "✅ Authorization successful! You can now use the bot.")
-		_, err := bot.Send(msg)
+		_, err := b.telegram.Send(msg)
 		if err != nil {
 			logError("[%s] Failed to send authorization success message: %v", requestID, err)
 		}
@@ -44,7 +43,7 @@ func isAuthorized(userID int64, message *tgbotapi.Message, requestID string) boo
 	// Not authorized - send authorization request
 	logInfo("[%s] Unauthorized access attempt by user %d", requestID, userID)
 	msg := tgbotapi.NewMessage(message.Chat.ID, "⚠️ This bot is password protected. Please enter the password to continue.")
-	_, err := bot.Send(msg)
+	_, err := b.telegram.Send(msg)
 	if err != nil {
 		logError("[%s] Failed to send authorization request message: %v", requestID, err)
 	}
@@ -52,9 +51,22 @@ func isAuthorized(userID int64, message *tgbotapi.Message, requestID string) boo
 }
 
 // Handle incoming messages with context for timeout control
-func handleMessageWithContext(ctx context.Context, message *tgbotapi.Message, requestID string) {
+func (b *Bot) handleMessageWithContext(ctx context.Context, message *tgbotapi.Message, requestID string) {
 	userID := message.From.ID
 	chatID := message.Chat.ID
+	setRequestLogFields(requestID, slog.Int64("user_id", userID), slog.Int64("chat_id", chatID))
+	defer clearRequestLogFields(requestID)
+
+	ctx, span := tracer.Start(ctx, "handle_message", trace.WithAttributes(
+		attribute.String("request_id", requestID),
+		attribute.Int64("user_id", userID),
+		attribute.Int64("chat_id", chatID),
+	))
+	defer span.End()
+	defer setChatSpan(chatID, span)()
+	if spanContext := span.SpanContext(); spanContext.IsValid() {
+		setRequestLogFields(requestID, slog.String("trace_id", spanContext.TraceID().String()))
+	}
 
 	// Check if context is already done
 	select {
@@ -66,135 +78,56 @@ func handleMessageWithContext(ctx context.Context, message *tgbotapi.Message, re
 	}
 
 	// Check authorization first
-	if !isAuthorized(userID, message, requestID) {
+	_, authSpan := tracer.Start(ctx, "authorize")
+	authorized := b.isAuthorized(userID, message, requestID)
+	authSpan.SetAttributes(attribute.Bool("authorized", authorized))
+	authSpan.End()
+	if !authorized {
 		return
 	}
 
-	user := getUser(userID, requestID)
+	var user User
+	traceStorage(ctx, "get_user", func() {
+		getUser(userID, requestID) // Creates the profile of new users
+		user = recordActivity(userID, requestID)
+	})
 
 	// Check if the message is a command
 	if message.IsCommand() {
-		cmd := message.Command()
-		args := message.CommandArguments()
-		logInfo("[%s] Received command /%s from user %d", requestID, cmd, userID)
-
-		switch cmd {
-		case "start", "help":
-			sendMessage(chatID, helpText, requestID)
-		case "settoken":
-			if args == "" {
-				sendMessage(chatID, "Please provide your OpenRouter API token. Usage: /settoken <your_token>", requestID)
-				return
-			}
-			user.OpenRouterToken = strings.TrimSpace(args)
-			updateUser(userID, user, requestID)
-			sendMessage(chatID, "OpenRouter API token has been set! You can now chat with AI models.", requestID)
-		case "model":
-			if user.CurrentModel == "" {
-				sendMessage(chatID, "No model selected. Use /setmodel <name> to select a model.", requestID)
-			} else {
-				modelID := user.Models[user.CurrentModel]
-				sendMessage(chatID, fmt.Sprintf("Current model: %s (%s)", user.CurrentModel, modelID), requestID)
-			}
-		case "models":
-			if len(user.Models) == 0 {
-				sendMessage(chatID, "No models available. Use /addmodel to add some.", requestID)
-				return
-			}
-			var modelsList string
-			for name, id := range user.Models {
-				modelsList += fmt.Sprintf("• %s (%s)\n", name, id)
-			}
-			sendMessage(chatID, fmt.Sprintf("Available models:\n%s\nUse /setmodel <name> to select a model.\n Full models list (for getting ids) can be saw in: https://openrouter.ai/models?order=top-weekly", modelsList), requestID)
-		case "setmodel":
-			if args == "" {
-				sendMessage(chatID, "Please provide a model name. Usage: /setmodel <model_name>", requestID)
-				return
-			}
-			modelName := strings.TrimSpace(args)
-			if _, exists := user.Models[modelName]; !exists {
-				sendMessage(chatID, fmt.Sprintf("Model '%s' not found. Use /models to see available models.", modelName), requestID)
-				return
-			}
-			user.CurrentModel = modelName
-			updateUser(userID, user, requestID)
-			sendMessage(chatID, fmt.Sprintf("Model set to: %s (%s)", modelName, user.Models[modelName]), requestID)
-		case "addmodel":
-			parts := strings.SplitN(args, " ", 2)
-			if len(parts) < 2 {
-				sendMessage(chatID, "Please provide model name and ID. Usage: /addmodel <your_name> <openrouter_id>", requestID)
-				return
-			}
-			name := strings.TrimSpace(parts[0])
-			id := strings.TrimSpace(parts[1])
-			if name == "" || id == "" {
-				sendMessage(chatID, "Model name and ID cannot be empty.", requestID)
-				return
-			}
-			user.Models[name] = id
-			updateUser(userID, user, requestID)
-			sendMessage(chatID, fmt.Sprintf("Model added: %s (%s)", name, id), requestID)
-		case "removemodel":
-			if args == "" {
-				sendMessage(chatID, "Please provide a model name. Usage: /removemodel <name>", requestID)
-				return
-			}
-			modelName := strings.TrimSpace(args)
-			if _, exists := user.Models[modelName]; !exists {
-				sendMessage(chatID, fmt.Sprintf("Model '%s' not found.", modelName), requestID)
-				return
-			}
-			if user.CurrentModel == modelName {
-				user.CurrentModel = ""
-			}
-			delete(user.Models, modelName)
-			updateUser(userID, user, requestID)
-			sendMessage(chatID, fmt.Sprintf("Model '%s' removed.", modelName), requestID)
-		case "debug":
-			configMu.Lock()
-			if config.LogLevel == LogLevelDebug {
-				config.LogLevel = LogLevelInfo
-				configMu.Unlock()
-				saveConfig()
-				sendMessage(chatID, "Debug mode disabled.", requestID)
-			} else {
-				config.LogLevel = LogLevelDebug
-				configMu.Unlock()
-				saveConfig()
-				sendMessage(chatID, "Debug mode enabled. Check logs for detailed information.", requestID)
-			}
-		case "getcredits":
-			if user.OpenRouterToken == "" {
-				sendMessage(chatID, "Please set your OpenRouter API token first with /settoken <your_token>", requestID)
-				return
-			}
-			sendTypingAction(chatID, requestID)
-			credits, err := GetCredits(user.OpenRouterToken, requestID)
-			if err != nil {
-				errMsg := fmt.Sprintf("Error getting credits: %v", err)
-				logError("[%s] Failed to get credits: %v", requestID, err)
-				sendMessage(chatID, errMsg, requestID)
-				return
-			}
-			creditsInfo := FormatCreditsInfo(credits)
-			sendMessage(chatID, creditsInfo, requestID)
-		default:
-			sendMessage(chatID, "Unknown command. Use /help to see available commands.", requestID)
-		}
+		span.SetAttributes(attribute.String("command", message.Command()))
+		logInfo("[%s] Received command /%s from user %d", requestID, message.Command(), userID)
+		b.dispatchCommand(ctx, message, user, requestID)
 		return
 	}
 
 	// Handle regular messages (non-commands)
+	if message.Document != nil {
+		if !b.handleDocumentMessage(chatID, userID, message, requestID) {
+			b.sendMessage(chatID, "To import a conversation from this file, send /import first.", requestID)
+		}
+		return
+	}
+	cancelPendingImport(userID)
 	if message.Text == "" {
-		sendMessage(chatID, "Please send a text message.", requestID)
+		b.sendMessage(chatID, "Please send a text message.", requestID)
 		return
 	}
-	if user.OpenRouterToken == "" {
-		sendMessage(chatID, "Please set your OpenRouter API token first with /settoken <your_token>", requestID)
+	logDebug("[%s] Message text: %s", requestID, logContent(message.Text))
+	b.answerQuery(ctx, chatID, userID, user, message.Text, requestID)
+}
+
+// Answer a query in the user's current thread and store the exchange
+func (b *Bot) answerQuery(ctx context.Context, chatID int64, userID int64, user User, query string, requestID string) {
+	if user.OpenRouterToken == "" && currentProvider(user).needsOpenRouterToken() {
+		b.sendMessage(chatID, "Please set your OpenRouter API token first with /settoken <your_token>", requestID)
 		return
 	}
 	if user.CurrentModel == "" || user.Models[user.CurrentModel] == "" {
-		sendMessage(chatID, "Please select a model first with /setmodel <model_name>", requestID)
+		b.sendMessage(chatID, "Please select a model first with /setmodel <model_name>", requestID)
+		return
+	}
+	// Limit how fast a single user can send requests to the AI
+	if !b.takeRequestTokens(chatID, userID, 1, requestID) {
 		return
 	}
 
@@ -206,31 +139,136 @@ func handleMessageWithContext(ctx context.Context, message *tgbotapi.Message, re
 		// Continue
 	}
 
-	sendTypingAction(chatID, requestID)
+	modelID := user.Models[user.CurrentModel]
+	setRequestLogFields(requestID, slog.String("model", modelID))
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("llm.model", modelID))
+	status := StatusError
+	defer func() {
+		chatRequestsTotal.WithLabelValues(modelLabel(modelID), status).Inc()
+		if status == StatusError {
+			recordFailedRequest(modelID)
+		}
+	}()
+	b.sendTypingAction(chatID, requestID)
+	queryTime := time.Now()
+	conversation := getConversation(userID)
+
+	// Register the request so that it can be cancelled with /stop or the Cancel button
+	reqCtx, finish := startActiveRequest(ctx, chatID, user.CurrentModel, query, requestID)
+	defer finish()
+	placeholderID := b.sendPlaceholder(chatID, requestID)
+
+	// Fit the conversation into the model's context window
+	plan := b.buildContext(reqCtx, user, userID, conversation, query, requestID)
 
 	// Send query to OpenRouter
-	logInfo("[%s] Sending query to OpenRouter, model: %s, query length: %d chars",
-		requestID, user.CurrentModel, len(message.Text))
+	logInfo("[%s] Sending query to OpenRouter, model: %s, query length: %d chars, history: %d messages (%d left out)",
+		requestID, user.CurrentModel, len(query), plan.pinned+plan.recent, plan.dropped)
 
-	response, err := queryOpenRouterWithContext(ctx, user, message.Text, requestID)
+	completion, err := b.queryWithTools(reqCtx, user, plan.messages, requestID)
+	b.deleteMessage(chatID, placeholderID, requestID)
 	if err != nil {
-		errMsg := fmt.Sprintf("Error: %v", err)
+		if errors.Is(err, errStoppedByUser) {
+			status = StatusStopped
+			if completion != nil && strings.TrimSpace(completion.Content) != "" {
+				logInfo("[%s] Generation stopped by user, partial response: %d chars", requestID, len(completion.Content))
+				traceStorage(ctx, "record_usage", func() { recordUsage(userID, completion, requestID) })
+				traceStorage(ctx, "append_conversation", func() {
+					appendToConversation(userID, conversation.Name, exchangeMessages(query, queryTime, completion), requestID)
+				})
+				b.sendAnswer(chatID, user, completion, cleanModelPrefix(completion.Content)+"\n\n⏹ _Partial answer, generation was stopped._", requestID)
+			}
+			return
+		}
 		logError("[%s] API request failed: %v", requestID, err)
-		sendMessage(chatID, errMsg, requestID)
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
+			b.sendMessage(chatID, apiErr.UserMessage(), requestID)
+		} else {
+			b.sendMessage(chatID, fmt.Sprintf("Error: %v", err), requestID)
+		}
 		return
 	}
 
-	logInfo("[%s] Successfully received response from OpenRouter, length: %d chars",
-		requestID, len(response))
+	status = StatusOK
+	logInfo("[%s] Successfully received response from OpenRouter, model: %s, length: %d chars",
+		requestID, completion.Model, len(completion.Content))
+	traceStorage(ctx, "record_usage", func() { recordUsage(userID, completion, requestID) })
+	var saved bool
+	traceStorage(ctx, "append_conversation", func() {
+		saved = appendToConversation(userID, conversation.Name, exchangeMessages(query, queryTime, completion), requestID)
+	})
+	if saved && len(conversation.Messages) == 0 && conversation.Title == "" {
+		b.background.Add(1)
+		go func() {
+			defer b.background.Done()
+			b.generateThreadTitle(user, userID, conversation.Name, query, completion.Content, requestID)
+		}()
+	}
+
+	cleanedResponse := cleanModelPrefix(completion.Content)
+	if slices.Contains(fallbackModelIDs(user), completion.Model) {
+		cleanedResponse += fmt.Sprintf("\n\n↪️ _Answered by fallback model %s_", completion.Model)
+	}
+	if len(completion.ToolsUsed) > 0 {
+		cleanedResponse += "\n\n🔧 _Tools used: " + formatToolsUsed(completion.ToolsUsed) + "_"
+	}
+	if completion.Cached {
+		cleanedResponse += "\n\n♻️ _Cached answer, use /cache off to always ask the model_"
+	}
+	b.sendAnswer(chatID, user, completion, cleanedResponse, requestID)
+}
+
+// Send a model answer, with its reasoning above it unless the user hides it
+// and its web sources below it
+func (b *Bot) sendAnswer(chatID int64, user User, completion *Completion, text string, requestID string) {
+	logDebug("[%s] Sending answer to chat %d, length: %d chars", requestID, chatID, len(text))
+
+	if len(completion.Citations) > 0 {
+		text += "\n\n" + formatCitations(completion.Citations)
+	}
+	tokens, attachments := renderMarkdown(ensureUTF8(text), user.Output.renderOptions())
+	if !user.Reasoning.Hide && strings.TrimSpace(completion.Reasoning) != "" {
+		logDebug("[%s] Including %d chars of reasoning in the answer", requestID, len(completion.Reasoning))
+		reasoning := formatReasoningTokens(ensureUTF8(completion.Reasoning), completion.Usage.reasoningTokens())
+		tokens = append(reasoning, tokens...)
+	}
+
+	b.sendHTMLTokens(chatID, tokens, requestID)
+	b.sendAttachments(chatID, attachments, requestID)
+}
+
+// Send a placeholder message with a Cancel button while the answer is generated.
+// Returns the message ID, or 0 if the placeholder could not be sent.
+func (b *Bot) sendPlaceholder(chatID int64, requestID string) int {
+	msg := tgbotapi.NewMessage(chatID, "⏳ Generating answer...")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✖️ Cancel", stopCallbackPrefix+requestID),
+		),
+	)
+	sent, err := b.telegram.Send(msg)
+	if err != nil {
+		logError("[%s] Failed to send placeholder message: %v", requestID, err)
+		return 0
+	}
+	return sent.MessageID
+}
 
-	cleanedResponse := cleanModelPrefix(response)
-	sendMarkdownMessage(chatID, cleanedResponse, requestID)
+// Delete a message sent by the bot
+func (b *Bot) deleteMessage(chatID int64, messageID int, requestID string) {
+	if messageID == 0 {
+		return
+	}
+	if _, err := b.telegram.Request(tgbotapi.NewDeleteMessage(chatID, messageID)); err != nil {
+		logError("[%s] Failed to delete message %d: %v", requestID, messageID, err)
+	}
 }
 
 // Send typing action to indicate the bot is processing
-func sendTypingAction(chatID int64, requestID string) {
+func (b *Bot) sendTypingAction(chatID int64, requestID string) {
 	logDebug("[%s] Sending typing action to chat %d", requestID, chatID)
-	_, err := bot.Request(tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping))
+	_, err := b.telegram.Request(tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping))
 	if err != nil {
 		logError("[%s] Failed to send typing action: %v", requestID, err)
 	}
@@ -263,123 +301,40 @@ func cleanModelPrefix(text string) string {
 	return trimmedText
 }
 
-// Send a message in Markdown format (including splitting long messages if needed)
-func sendMarkdownMessage(chatID int64, text string, requestID string) {
+// Send a message in Markdown format (including splitting long messages and sending attachments if needed)
+func (b *Bot) sendMarkdownMessage(chatID int64, text string, options renderOptions, requestID string) {
 	logDebug("[%s] Sending Markdown message to chat %d, length: %d chars", requestID, chatID, len(text))
 
 	// Ensure text is UTF-8
 	text = ensureUTF8(text)
 
-	// Process the text for Telegram's Markdown
-	processedText := convertToTelegramHTML(text)
-
-	// Split if too long
-	if len(processedText) > 4000 {
-		logInfo("[%s] Message too long (%d chars), splitting into multiple parts", requestID, len(processedText))
-		sendMultipartHTMLMessage(chatID, processedText, requestID)
-		return
-	}
-
-	msg := tgbotapi.NewMessage(chatID, processedText)
-	msg.ParseMode = "HTML" // Switch to HTML for more reliable parsing
-
-	var err error
-	maxRetries := 3
-	for i := 0; i < maxRetries; i++ {
-		_, err = bot.Send(msg)
-		if err == nil {
-			logDebug("[%s] HTML message sent successfully", requestID)
-			return
-		}
-		logError("[%s] Failed to send HTML message (attempt %d/%d): %v", requestID, i+1, maxRetries, err)
-
-		// If HTML parse fails too, try sending as plain text
-		if strings.Contains(err.Error(), "can't parse entities") ||
-			strings.Contains(err.Error(), "Bad Request") {
-			logInfo("[%s] HTML parse failed, sending as plain text", requestID)
-			// Strip HTML tags and send as plain text
-			plainText := stripHTMLTags(processedText)
-			plainMsg := tgbotapi.NewMessage(chatID, plainText)
-			_, err = bot.Send(plainMsg)
-			if err == nil {
-				logDebug("[%s] Plain text message sent successfully", requestID)
-				return
-			}
-			logError("[%s] Failed to send as plain text: %v", requestID, err)
-		}
-		if i < maxRetries-1 {
-			time.Sleep(time.Duration(i+1) * time.Second) // Exponential backoff
-		}
-	}
-
-	logError("[%s] Failed to send message after %d attempts", requestID, maxRetries)
-	fallbackMsg := tgbotapi.NewMessage(chatID, "I received a response but couldn't display it properly. Please try again.")
-	bot.Send(fallbackMsg)
+	// Process the text for Telegram's HTML
+	tokens, attachments := renderMarkdown(text, options)
+	b.sendHTMLTokens(chatID, tokens, requestID)
+	b.sendAttachments(chatID, attachments, requestID)
 }
 
-// Split and send a large HTML message in multiple parts
-func sendMultipartHTMLMessage(chatID int64, text string, requestID string) {
-	const maxPartSize = 4000
-
-	var parts []string
-	remaining := text
-
-	for len(remaining) > maxPartSize {
-		splitIndex := findSplitPoint(remaining, maxPartSize)
-		// Ensure HTML tags are properly closed
-		part := remaining[:splitIndex]
-		part = ensureHTMLTagsClosed(part)
-		parts = append(parts, part)
-		remaining = remaining[splitIndex:]
-	}
-	if len(remaining) > 0 {
-		parts = append(parts, remaining)
+// Send rendered Telegram HTML, split into as many messages as needed
+func (b *Bot) sendHTMLTokens(chatID int64, tokens []htmlToken, requestID string) {
+	parts := splitHTMLTokens(tokens, maxPartSize)
+	totalParts := len(parts)
+	if totalParts > 1 {
+		logInfo("[%s] Message too long, splitting into %d parts", requestID, totalParts)
 	}
 
-	totalParts := len(parts)
 	for i, part := range parts {
-		header := ""
+		header, plainHeader := "", ""
 		if totalParts > 1 {
 			header = fmt.Sprintf("<b>Part %d/%d:</b>\n\n", i+1, totalParts)
+			plainHeader = fmt.Sprintf("Part %d/%d:\n\n", i+1, totalParts)
 		}
 
-		msg := tgbotapi.NewMessage(chatID, header+part)
-		msg.ParseMode = "HTML"
-
-		maxRetries := 3
-		success := false
-
-		for j := 0; j < maxRetries; j++ {
-			_, err := bot.Send(msg)
-			if err == nil {
-				logDebug("[%s] Part %d/%d sent successfully", requestID, i+1, totalParts)
-				success = true
-				break
-			}
-			logError("[%s] Failed to send HTML part %d/%d (attempt %d/%d): %v",
-				requestID, i+1, totalParts, j+1, maxRetries, err)
-
-			// If HTML fails, try plain text
-			if j == maxRetries-1 {
-				plainText := stripHTMLTags(header + part)
-				plainMsg := tgbotapi.NewMessage(chatID, plainText)
-				_, err = bot.Send(plainMsg)
-				if err == nil {
-					logDebug("[%s] Part %d/%d sent as plain text", requestID, i+1, totalParts)
-					success = true
-				} else {
-					logError("[%s] Failed to send part %d/%d as plain text: %v",
-						requestID, i+1, totalParts, err)
-				}
-			}
-
-			if j < maxRetries-1 {
-				time.Sleep(time.Duration(j+1) * time.Second)
-			}
-		}
-
-		if !success {
+		if !b.sendHTMLPart(chatID, header+serializeHTMLTokens(part), plainHeader+plainTextOfTokens(part), requestID) {
 			logError("[%s] Failed to send part %d/%d after all attempts", requestID, i+1, totalParts)
+			if totalParts == 1 {
+				fallbackMsg := tgbotapi.NewMessage(chatID, "I received a response but couldn't display it properly. Please try again.")
+				b.telegram.Send(fallbackMsg)
+			}
 		}
 		if i < totalParts-1 {
 			time.Sleep(500 * time.Millisecond)
@@ -387,266 +342,57 @@ func sendMultipartHTMLMessage(chatID int64, text string, requestID string) {
 	}
 }
 
-// Convert Markdown to Telegram HTML
-func convertToTelegramHTML(text string) string {
-	// Replace code blocks
-	codeBlockRegex := regexp.MustCompile("```(?:.*?)\n([\\s\\S]*?)```")
-	text = codeBlockRegex.ReplaceAllStringFunc(text, func(match string) string {
-		// Extract code content
-		content := codeBlockRegex.FindStringSubmatch(match)[1]
-		// Escape HTML special chars in code
-		content = html.EscapeString(content)
-		return "<pre>" + content + "</pre>"
-	})
-
-	// Replace inline code
-	inlineCodeRegex := regexp.MustCompile("`([^`]+)`")
-	text = inlineCodeRegex.ReplaceAllString(text, "<code>$1</code>")
-
-	// Replace bold
-	text = regexp.MustCompile(`\*\*(.*?)\*\*`).ReplaceAllString(text, "<b>$1</b>")
-	text = regexp.MustCompile(`\*(.*?)\*`).ReplaceAllString(text, "<b>$1</b>")
-
-	// Replace italic
-	text = regexp.MustCompile(`_(.*?)_`).ReplaceAllString(text, "<i>$1</i>")
-
-	// Handle links - this is simplified
-	linkRegex := regexp.MustCompile(`\[(.*?)\]\((.*?)\)`)
-	text = linkRegex.ReplaceAllString(text, "<a href=\"$2\">$1</a>")
-
-	// Convert tables to a simple format that works in Telegram
-	text = convertTableToTelegramFormat(text)
-
-	// Properly handle HTML entities
-	text = decodeHTMLEntities(text)
-
-	return text
-}
-
-// Convert markdown tables to a Telegram-friendly format
-func convertTableToTelegramFormat(text string) string {
-	// Find all table blocks (assuming they start with | and contain multiple lines)
-	tableBlockRegex := regexp.MustCompile(`(?m)^\|(.+)\|$[\r\n]+\|([-:| ]+)\|[\r\n]+((?:\|.+\|$[\r\n]?)+)`)
-
-	return tableBlockRegex.ReplaceAllStringFunc(text, func(tableBlock string) string {
-		// Split the table into lines
-		lines := strings.Split(tableBlock, "\n")
-		if len(lines) < 3 {
-			return tableBlock // Not enough lines for a table
-		}
-
-		// Process header row
-		headerRow := strings.Trim(lines[0], "\r\n")
-		headers := extractTableCells(headerRow)
+// Send one HTML message with retries, falling back to plain text if Telegram cannot parse it
+func (b *Bot) sendHTMLPart(chatID int64, htmlText string, plainText string, requestID string) bool {
+	msg := tgbotapi.NewMessage(chatID, htmlText)
+	msg.ParseMode = "HTML"
 
-		// Skip the separator line
-
-		// Process data rows
-		var resultTable strings.Builder
-		resultTable.WriteString("<b>Table:</b>\n\n")
-
-		// Add bold headers
-		for i, header := range headers {
-			header = strings.TrimSpace(header)
-			if i > 0 {
-				resultTable.WriteString(" | ")
-			}
-			resultTable.WriteString("<b>")
-			resultTable.WriteString(header)
-			resultTable.WriteString("</b>")
-		}
-		resultTable.WriteString("\n")
-
-		// Add separator
-		resultTable.WriteString(strings.Repeat("-", 30))
-		resultTable.WriteString("\n")
-
-		// Add data rows
-		for i := 2; i < len(lines); i++ {
-			if strings.TrimSpace(lines[i]) == "" {
-				continue
-			}
-
-			cells := extractTableCells(lines[i])
-			for j, cell := range cells {
-				cell = strings.TrimSpace(cell)
-				if j > 0 {
-					resultTable.WriteString(" | ")
-				}
-				resultTable.WriteString(cell)
-			}
-			resultTable.WriteString("\n")
-		}
-
-		return resultTable.String()
-	})
-}
-
-// Extract cells from a table row
-func extractTableCells(row string) []string {
-	// Remove the first and last pipe characters
-	row = strings.Trim(row, "\r\n")
-	if strings.HasPrefix(row, "|") {
-		row = row[1:]
-	}
-	if strings.HasSuffix(row, "|") {
-		row = row[:len(row)-1]
-	}
-
-	// Split by pipe character
-	cells := strings.Split(row, "|")
-
-	// Trim each cell
-	for i, cell := range cells {
-		cells[i] = strings.TrimSpace(cell)
-	}
-
-	return cells
-}
-
-// Decode HTML entities that may appear in the text
-func decodeHTMLEntities(text string) string {
-	// Define common HTML entities and their replacements
-	entities := map[string]string{
-		"&quot;":  "\"",
-		"&#34;":   "\"",
-		"&apos;":  "'",
-		"&#39;":   "'",
-		"&amp;":   "&",
-		"&#38;":   "&",
-		"&lt;":    "<",
-		"&#60;":   "<",
-		"&gt;":    ">",
-		"&#62;":   ">",
-		"&nbsp;":  " ",
-		"&#160;":  " ",
-		"&ndash;": "–",
-		"&#8211;": "–",
-		"&mdash;": "—",
-		"&#8212;": "—",
-	}
-
-	// Replace each entity with its character
-	for entity, char := range entities {
-		text = strings.ReplaceAll(text, entity, char)
-	}
-
-	// Use a more comprehensive approach for numeric entities
-	numericEntityRegex := regexp.MustCompile(`&#(\d+);`)
-	text = numericEntityRegex.ReplaceAllStringFunc(text, func(match string) string {
-		numStr := numericEntityRegex.FindStringSubmatch(match)[1]
-		num, err := strconv.Atoi(numStr)
-		if err != nil {
-			return match
+	maxRetries := 3
+	for i := 0; i < maxRetries; i++ {
+		_, err := b.telegram.Send(msg)
+		if err == nil {
+			logDebug("[%s] HTML message sent successfully", requestID)
+			return true
 		}
-		return string(rune(num))
-	})
-
-	return text
-}
+		logError("[%s] Failed to send HTML message (attempt %d/%d): %v", requestID, i+1, maxRetries, err)
 
-// Replace escapeNonTagHTML with a more table-friendly version
-func escapeNonTagHTML(text string) string {
-	// Don't escape content inside these tags
-	protectedTags := []string{"pre", "code", "b", "i", "a"}
-
-	// Find all protected tag blocks
-	var protectedBlocks []struct {
-		start, end int
-		content    string
-	}
-
-	for _, tag := range protectedTags {
-		openTagRegex := regexp.MustCompile(fmt.Sprintf("<%s[^>]*>", tag))
-		closeTagRegex := regexp.MustCompile(fmt.Sprintf("</%s>", tag))
-
-		openMatches := openTagRegex.FindAllStringIndex(text, -1)
-		closeMatches := closeTagRegex.FindAllStringIndex(text, -1)
-
-		if len(openMatches) > 0 && len(openMatches) == len(closeMatches) {
-			for i := 0; i < len(openMatches); i++ {
-				start := openMatches[i][0]
-				end := closeMatches[i][1]
-				if start < end {
-					protectedBlocks = append(protectedBlocks, struct {
-						start, end int
-						content    string
-					}{
-						start:   start,
-						end:     end,
-						content: text[start:end],
-					})
-				}
+		// If HTML parse fails, try sending as plain text
+		if strings.Contains(err.Error(), "can't parse entities") ||
+			strings.Contains(err.Error(), "Bad Request") {
+			logInfo("[%s] HTML parse failed, sending as plain text", requestID)
+			_, err = b.telegram.Send(tgbotapi.NewMessage(chatID, plainText))
+			if err == nil {
+				logDebug("[%s] Plain text message sent successfully", requestID)
+				return true
 			}
+			logError("[%s] Failed to send as plain text: %v", requestID, err)
 		}
-	}
-
-	// Sort protected blocks by start position
-	sort.Slice(protectedBlocks, func(i, j int) bool {
-		return protectedBlocks[i].start < protectedBlocks[j].start
-	})
-
-	// Build result with escaped text only outside protected blocks
-	var result strings.Builder
-	lastEnd := 0
-
-	for _, block := range protectedBlocks {
-		// Escape text before this block
-		if block.start > lastEnd {
-			result.WriteString(html.EscapeString(text[lastEnd:block.start]))
+		if i < maxRetries-1 {
+			time.Sleep(time.Duration(i+1) * time.Second) // Exponential backoff
 		}
-
-		// Add the protected block as-is
-		result.WriteString(block.content)
-		lastEnd = block.end
-	}
-
-	// Escape any remaining text
-	if lastEnd < len(text) {
-		result.WriteString(html.EscapeString(text[lastEnd:]))
 	}
-
-	return result.String()
-}
-
-// Strip HTML tags for plain text fallback
-func stripHTMLTags(text string) string {
-	return regexp.MustCompile("<[^>]*>").ReplaceAllString(text, "")
+	return false
 }
 
-// Ensure HTML tags are properly closed in a fragment
-func ensureHTMLTagsClosed(htmlFragment string) string {
-	// This is a simplified approach - for production use, consider a proper HTML parser
-	openTags := regexp.MustCompile("<([a-z]+)[^>]*>").FindAllStringSubmatch(htmlFragment, -1)
-	closedTags := regexp.MustCompile("</([a-z]+)>").FindAllStringSubmatch(htmlFragment, -1)
-
-	// Count open and closed tags
-	tagCount := make(map[string]int)
-	for _, tag := range openTags {
-		tagCount[tag[1]]++
-	}
-	for _, tag := range closedTags {
-		tagCount[tag[1]]--
-	}
-
-	// Add closing tags as needed
-	for tag, count := range tagCount {
-		for i := 0; i < count; i++ {
-			htmlFragment += "</" + tag + ">"
+// Get the visible text of rendered tokens, for the plain text fallback
+func plainTextOfTokens(tokens []htmlToken) string {
+	var sb strings.Builder
+	for _, token := range tokens {
+		if token.kind == tokenText || token.kind == tokenBreak {
+			sb.WriteString(token.text)
 		}
 	}
-
-	return htmlFragment
+	return sb.String()
 }
 
 // Send a simple text message (no special parse mode)
-func sendMessage(chatID int64, text string, requestID string) {
+func (b *Bot) sendMessage(chatID int64, text string, requestID string) {
 	logDebug("[%s] Sending message to chat %d, length: %d chars", requestID, chatID, len(text))
 	text = ensureUTF8(text)
 
-	if len(text) > 4000 {
+	if utf16Length(text) > maxPartSize {
 		logInfo("[%s] Message too long (%d chars), splitting into multiple messages", requestID, len(text))
-		sendMultipartMessage(chatID, text, requestID)
+		b.sendMultipartMessage(chatID, text, requestID)
 		return
 	}
 
@@ -654,7 +400,7 @@ func sendMessage(chatID int64, text string, requestID string) {
 
 	maxRetries := 3
 	for i := 0; i < maxRetries; i++ {
-		_, err := bot.Send(msg)
+		_, err := b.telegram.Send(msg)
 		if err == nil {
 			logDebug("[%s] Message sent successfully", requestID)
 			return
@@ -669,19 +415,10 @@ func sendMessage(chatID int64, text string, requestID string) {
 }
 
 // Send a long message by splitting it into multiple parts (plain text)
-func sendMultipartMessage(chatID int64, text string, requestID string) {
-	const maxPartSize = 4000
-
+func (b *Bot) sendMultipartMessage(chatID int64, text string, requestID string) {
 	var parts []string
-	remaining := text
-
-	for len(remaining) > maxPartSize {
-		splitIndex := findSplitPoint(remaining, maxPartSize)
-		parts = append(parts, remaining[:splitIndex])
-		remaining = remaining[splitIndex:]
-	}
-	if len(remaining) > 0 {
-		parts = append(parts, remaining)
+	for _, part := range splitHTMLTokens([]htmlToken{{kind: tokenText, text: text}}, maxPartSize) {
+		parts = append(parts, plainTextOfTokens(part))
 	}
 
 	totalParts := len(parts)
@@ -696,7 +433,7 @@ func sendMultipartMessage(chatID int64, text string, requestID string) {
 		success := false
 
 		for j := 0; j < maxRetries; j++ {
-			_, err := bot.Send(msg)
+			_, err := b.telegram.Send(msg)
 			if err == nil {
 				logDebug("[%s] Part %d/%d sent successfully", requestID, i+1, totalParts)
 				success = true
@@ -717,37 +454,6 @@ func sendMultipartMessage(chatID int64, text string, requestID string) {
 	}
 }
 
-// Find a good point to split a message
-func findSplitPoint(text string, maxSize int) int {
-	if len(text) <= maxSize {
-		return len(text)
-	}
-	for i := maxSize; i > maxSize/2; i-- {
-		if text[i] == '\n' && i > 0 && text[i-1] == '\n' {
-			return i + 1
-		}
-	}
-	for i := maxSize; i > maxSize/2; i-- {
-		if text[i] == '\n' {
-			return i + 1
-		}
-	}
-	for i := maxSize; i > maxSize/2; i-- {
-		if i < len(text) && (text[i] == '.' || text[i] == '?' || text[i] == '!') {
-			if i+1 < len(text) && text[i+1] == ' ' {
-				return i + 2
-			}
-			return i + 1
-		}
-	}
-	for i := maxSize; i > maxSize/2; i-- {
-		if text[i] == ' ' {
-			return i + 1
-		}
-	}
-	return maxSize
-}
-
 // Ensure text is UTF-8 compliant
 func ensureUTF8(text string) string {
 	if !utf8.ValidString(text) {
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"tgbot/fake"
+)
+
+const (
+	testPassword      = "test-password"
+	telegramMaxLength = 4096 // Most UTF-16 code units in a Telegram message
+)
+
+// Directory of the package sources, where the tests find testdata/
+var sourceDir string
+
+func TestMain(m *testing.M) {
+	var err error
+	if sourceDir, err = os.Getwd(); err != nil {
+		panic(err)
+	}
+	// The handlers save their data under data/, so they run in a temporary directory
+	dir, err := os.MkdirTemp("", "tgbot-test-")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	os.Setenv("BOT_PASSWORD", testPassword)
+
+	setupLogger(io.Discard)
+	initHTTPClient()
+	loadConfig(false)
+	loadConversations()
+	initResponseCache()
+
+	code := m.Run()
+	flushSaves()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// Create a bot using a fake Telegram and a fake OpenRouter
+func newTestBot(t *testing.T) (*Bot, *fake.Telegram, *fake.OpenRouter) {
+	t.Helper()
+	telegram := fake.NewTelegram()
+	t.Cleanup(telegram.Close)
+	api := fake.NewOpenRouter()
+	t.Cleanup(api.Close)
+	t.Setenv("OPENROUTER_BASE_URL", api.BaseURL())
+	b := newBot(telegram, newLLMClient())
+	// Wait for the thread titles before the fakes close, so that they do not
+	// reach the fakes of the next test
+	t.Cleanup(b.background.Wait)
+	return b, telegram, api
+}
+
+// Authorize a user and give them an API token, so that their messages are answered
+func authorizeTestUser(userID int64) {
+	configMu.Lock()
+	config.AuthorizedIDs[userID] = true
+	configMu.Unlock()
+	getUser(userID, "test")
+	modifyUser(userID, "test", func(user *User) { user.OpenRouterToken = "test-token" })
+}
+
+// Get the requests for the answers of the default model, leaving out the
+// utility requests such as thread titles
+func answerRequests(api *fake.OpenRouter) []fake.Request {
+	var requests []fake.Request
+	for _, request := range api.Requests() {
+		if request.Model == "openai/gpt-3.5-turbo" {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
+
+// Enable tool calling for a user
+func enableTestTools(userID int64) {
+	modifyUser(userID, "test", func(user *User) { user.Tools = ToolSettings{Enabled: true} })
+}
+
+// Wait until a condition holds, failing the test if it takes too long
+func waitUntil(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Check whether a reply containing the text was sent to a chat
+func hasReply(telegram *fake.Telegram, chatID int64, text string) bool {
+	return slices.ContainsFunc(telegram.Texts(chatID), func(reply string) bool { return strings.Contains(reply, text) })
+}
+
+// Handle a message as the update loop does, with the handler timeout
+func handleTestMessage(b *Bot, userID int64, text string) {
+	b.processMessage(chatJob{message: fake.Message(userID, text), requestID: "test", queuedAt: time.Now()})
+}
+
+func TestUnauthorizedUserIsRejected(t *testing.T) {
+	b, telegram, api := newTestBot(t)
+	const userID = 1001
+
+	handleTestMessage(b, userID, "hello")
+
+	texts := telegram.Texts(userID)
+	if len(texts) != 1 || !strings.Contains(texts[0], "password protected") {
+		t.Errorf("got replies %q, want the password request", texts)
+	}
+	if requests := api.Requests(); len(requests) != 0 {
+		t.Errorf("got %d model requests, want none", len(requests))
+	}
+}
+
+func TestPasswordLogin(t *testing.T) {
+	b, telegram, _ := newTestBot(t)
+	const userID = 1002
+
+	handleTestMessage(b, userID, "wrong password")
+	handleTestMessage(b, userID, testPassword)
+
+	texts := telegram.Texts(userID)
+	if len(texts) < 2 || !strings.Contains(texts[1], "Authorization successful") {
+		t.Fatalf("got replies %q, want the authorization confirmed", texts)
+	}
+	configMu.Lock()
+	authorized := config.AuthorizedIDs[userID]
+	configMu.Unlock()
+	if !authorized {
+		t.Error("the user is not authorized after sending the password")
+	}
+}
+
+func TestAddModelCommand(t *testing.T) {
+	b, telegram, _ := newTestBot(t)
+	const userID = 1003
+	authorizeTestUser(userID)
+
+	handleTestMessage(b, userID, "/addmodel fast openai/gpt-4o-mini")
+
+	if texts := telegram.Texts(userID); !slices.Contains(texts, "Model added: fast (openai/gpt-4o-mini)") {
+		t.Errorf("got replies %q, want the model added", texts)
+	}
+	if id := getUser(userID, "test").Models["fast"]; id != "openai/gpt-4o-mini" {
+		t.Errorf("the model fast has ID %q, want openai/gpt-4o-mini", id)
+	}
+}
+
+func TestLongAnswerIsSplit(t *testing.T) {
+	b, telegram, api := newTestBot(t)
+	const userID = 1004
+	authorizeTestUser(userID)
+
+	var paragraphs []string
+	for i := 0; i < 120; i++ {
+		paragraphs = append(paragraphs, strings.Repeat("word ", 15)+"end")
+	}
+	api.Enqueue(fake.Response{Content: strings.Join(paragraphs, "\n\n")})
+
+	handleTestMessage(b, userID, "Tell me a long story")
+
+	var parts []string
+	for _, text := range telegram.Texts(userID) {
+		if strings.Contains(text, "word") {
+			parts = append(parts, text)
+		}
+	}
+	if len(parts) < 2 {
+		t.Fatalf("the answer was sent in %d messages, want several", len(parts))
+	}
+	total := 0
+	for i, part := range parts {
+		if length := utf16Length(part); length > telegramMaxLength {
+			t.Errorf("part %d is %d UTF-16 code units, more than %d", i+1, length, telegramMaxLength)
+		}
+		total += strings.Count(part, "end")
+	}
+	if total != len(paragraphs) {
+		t.Errorf("the parts have %d paragraphs, want %d", total, len(paragraphs))
+	}
+}
+
+func TestAPIErrorIsExplained(t *testing.T) {
+	b, telegram, api := newTestBot(t)
+	const userID = 1005
+	authorizeTestUser(userID)
+
+	api.Enqueue(fake.Response{Status: 402, Error: "Insufficient credits"})
+
+	handleTestMessage(b, userID, "hello")
+
+	texts := telegram.Texts(userID)
+	if !slices.ContainsFunc(texts, func(text string) bool { return strings.Contains(text, "does not have enough credits") }) {
+		t.Errorf("got replies %q, want the credits error explained", texts)
+	}
+	if history := getConversation(userID); len(history.Messages) != 0 {
+		t.Errorf("the conversation has %d messages after a failed request, want none", len(history.Messages))
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	b, telegram, api := newTestBot(t)
+	b.timeout = 200 * time.Millisecond
+	const userID = 1006
+	authorizeTestUser(userID)
+
+	api.Enqueue(fake.Response{Content: "too late", Delay: 10 * time.Second})
+
+	start := time.Now()
+	handleTestMessage(b, userID, "hello")
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the message took %v to handle, want it cut at the timeout", elapsed)
+	}
+
+	texts := telegram.Texts(userID)
+	if !slices.Contains(texts, "Sorry, the operation timed out. Please try again.") {
+		t.Errorf("got replies %q, want the timeout message", texts)
+	}
+	if slices.ContainsFunc(texts, func(text string) bool { return strings.Contains(text, "too late") }) {
+		t.Error("the answer was sent after the timeout")
+	}
+}
+
+func TestWebCommandIsRateLimited(t *testing.T) {
+	b, telegram, api := newTestBot(t)
+	const userID = 1007
+	authorizeTestUser(userID)
+
+	for i := 0; i <= rateLimitBurst; i++ {
+		handleTestMessage(b, userID, "/web what is new today")
+	}
+
+	if requests := answerRequests(api); len(requests) != rateLimitBurst {
+		t.Errorf("got %d questions to the model, want %d", len(requests), rateLimitBurst)
+	}
+	texts := telegram.Texts(userID)
+	if !slices.ContainsFunc(texts, func(text string) bool { return strings.Contains(text, "sending messages too fast") }) {
+		t.Errorf("got replies %q, want the rate limit message", texts)
+	}
+}
+
+func TestCompareTakesATokenPerModel(t *testing.T) {
+	b, telegram, api := newTestBot(t)
+	const userID = 1008
+	authorizeTestUser(userID)
+
+	handleTestMessage(b, userID, "hello")
+	handleTestMessage(b, userID, "/compare openai/gpt-4o-mini anthropic/claude-3-haiku openai/gpt-4o google/gemini-flash-1.5 meta-llama/llama-3-8b-instruct -- hi")
+
+	for _, request := range api.Requests() {
+		if strings.Contains(request.Model, "claude") {
+			t.Fatal("the comparison started with fewer tokens than models")
+		}
+	}
+	texts := telegram.Texts(userID)
+	if !slices.ContainsFunc(texts, func(text string) bool { return strings.Contains(text, "sending messages too fast") }) {
+		t.Errorf("got replies %q, want the rate limit message", texts)
+	}
+}
+
+func TestToolResultsAreSentBack(t *testing.T) {
+	b, telegram, api := newTestBot(t)
+	const userID = 1009
+	authorizeTestUser(userID)
+	enableTestTools(userID)
+
+	api.Enqueue(
+		fake.Response{ToolCalls: []fake.ToolCall{{ID: "call_1", Name: "calculator", Arguments: `{"expression":"6*7"}`}}},
+		fake.Response{Content: "The answer is 42."},
+	)
+
+	handleTestMessage(b, userID, "What is 6 times 7?")
+
+	requests := answerRequests(api)
+	if len(requests) != 2 {
+		t.Fatalf("got %d model requests, want 2", len(requests))
+	}
+	if !slices.Contains(requests[0].Tools, "calculator") {
+		t.Errorf("the model was offered tools %q, want the calculator", requests[0].Tools)
+	}
+	messages := requests[1].Messages
+	last := messages[len(messages)-1]
+	if last.Role != "tool" || last.ToolCallID != "call_1" || !strings.Contains(last.Content, "42") {
+		t.Errorf("the second request ends with %+v, want the calculator result", last)
+	}
+	texts := telegram.Texts(userID)
+	if !slices.ContainsFunc(texts, func(text string) bool {
+		return strings.Contains(text, "The answer is 42.") && strings.Contains(text, "Tools used: calculator")
+	}) {
+		t.Errorf("got replies %q, want the answer with the tools used", texts)
+	}
+}
+
+func TestToolStepsAreLimited(t *testing.T) {
+	b, telegram, api := newTestBot(t)
+	const userID = 1010
+	authorizeTestUser(userID)
+	enableTestTools(userID)
+
+	call := fake.Response{ToolCalls: []fake.ToolCall{{Name: "get_current_time", Arguments: `{}`}}}
+	for i := 0; i < maxToolSteps; i++ {
+		api.Enqueue(call)
+	}
+	api.Enqueue(fake.Response{Content: "It is late."})
+
+	handleTestMessage(b, userID, "What time is it?")
+
+	requests := answerRequests(api)
+	if len(requests) != maxToolSteps+1 {
+		t.Fatalf("got %d model requests, want %d", len(requests), maxToolSteps+1)
+	}
+	for i, request := range requests {
+		want := ""
+		if i == maxToolSteps {
+			want = "none"
+		}
+		if request.ToolChoice != want {
+			t.Errorf("request %d has tool choice %q, want %q", i+1, request.ToolChoice, want)
+		}
+	}
+	texts := telegram.Texts(userID)
+	if !slices.ContainsFunc(texts, func(text string) bool {
+		return strings.Contains(text, "It is late.") && strings.Contains(text, fmt.Sprintf("get_current_time ×%d", maxToolSteps))
+	}) {
+		t.Errorf("got replies %q, want the answer with the tools used", texts)
+	}
+}
+
+func TestToolErrorsAreReported(t *testing.T) {
+	b, _, api := newTestBot(t)
+	const userID = 1011
+	authorizeTestUser(userID)
+	enableTestTools(userID)
+
+	api.Enqueue(
+		fake.Response{ToolCalls: []fake.ToolCall{
+			{ID: "call_1", Name: "no_such_tool", Arguments: `{}`},
+			{ID: "call_2", Name: "calculator", Arguments: `{"expression":"2+"}`},
+		}},
+		fake.Response{Content: "Something went wrong."},
+	)
+
+	handleTestMessage(b, userID, "Use the tools")
+
+	requests := answerRequests(api)
+	if len(requests) != 2 {
+		t.Fatalf("got %d model requests, want 2", len(requests))
+	}
+	results := make(map[string]string)
+	for _, message := range requests[1].Messages {
+		if message.Role == "tool" {
+			results[message.ToolCallID] = message.Content
+		}
+	}
+	if result := results["call_1"]; !strings.Contains(result, `unknown tool "no_such_tool"`) {
+		t.Errorf("the unknown tool returned %q, want an error", result)
+	}
+	if result := results["call_2"]; !strings.HasPrefix(result, "Error: ") {
+		t.Errorf("the failing calculator returned %q, want an error", result)
+	}
+}
+
+func TestStopKeepsPartialAnswer(t *testing.T) {
+	b, telegram, api := newTestBot(t)
+	const userID = 1012
+	authorizeTestUser(userID)
+
+	// The fake streams three words per chunk
+	var words []string
+	for i := 1; i <= 30; i++ {
+		words = append(words, fmt.Sprintf("word%d", i))
+	}
+	api.Enqueue(fake.Response{Content: strings.Join(words, " "), Delay: 100 * time.Millisecond})
+
+	done := make(chan struct{})
+	go func() {
+		handleTestMessage(b, userID, "Count to ten")
+		close(done)
+	}()
+	waitUntil(t, "the answer to start", func() bool { return len(api.Requests()) > 0 })
+	time.Sleep(350 * time.Millisecond)
+	b.handleUpdate(tgbotapi.Update{Message: fake.Message(userID, "/stop")}, "stop")
+	<-done
+
+	waitUntil(t, "the stop confirmation", func() bool { return hasReply(telegram, userID, "⏹ Stopped") })
+	var partial string
+	for _, text := range telegram.Texts(userID) {
+		if strings.Contains(text, "Partial answer") {
+			partial = text
+		}
+	}
+	if !strings.Contains(partial, "word1 ") || strings.Contains(partial, "word30") {
+		t.Errorf("got partial answer %q, want the words streamed before /stop", partial)
+	}
+	history := getConversation(userID)
+	if len(history.Messages) != 2 || !strings.Contains(history.Messages[1].Content, "word1 ") {
+		t.Errorf("the conversation has %+v, want the question and the partial answer", history.Messages)
+	}
+}
+
+func TestRateLimitedRequestIsRetried(t *testing.T) {
+	b, telegram, api := newTestBot(t)
+	const userID = 1013
+	authorizeTestUser(userID)
+
+	api.Enqueue(
+		fake.Response{Status: 429, Error: "Rate limit exceeded", Header: map[string]string{"Retry-After": "2"}},
+		fake.Response{Content: "Worth the wait."},
+	)
+
+	start := time.Now()
+	handleTestMessage(b, userID, "hello")
+
+	if elapsed := time.Since(start); elapsed < 2*time.Second {
+		t.Errorf("retried after %v, want at least the 2s of Retry-After", elapsed)
+	}
+	if requests := answerRequests(api); len(requests) != 2 {
+		t.Errorf("got %d model requests, want 2", len(requests))
+	}
+	if !hasReply(telegram, userID, "Worth the wait.") {
+		t.Errorf("got replies %q, want the answer of the retry", telegram.Texts(userID))
+	}
+}
+
+func TestProviderErrorUsesFallbackModels(t *testing.T) {
+	b, telegram, api := newTestBot(t)
+	const userID = 1014
+	const fallbackID = "anthropic/claude-3-haiku"
+	authorizeTestUser(userID)
+	modifyUser(userID, "test", func(user *User) {
+		user.Models["backup"] = fallbackID
+		user.FallbackModels = []string{"backup"}
+	})
+
+	api.Enqueue(
+		fake.Response{Status: 502, Error: "Provider returned error"},
+		fake.Response{Content: "From the backup.", Model: fallbackID},
+	)
+
+	handleTestMessage(b, userID, "hello")
+
+	requests := answerRequests(api)
+	if len(requests) != 2 {
+		t.Fatalf("got %d model requests, want 2", len(requests))
+	}
+	var body struct {
+		Models []string `json:"models"`
+		Route  string   `json:"route"`
+	}
+	if err := json.Unmarshal(requests[1].Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(body.Models, []string{"openai/gpt-3.5-turbo", fallbackID}) || body.Route != "fallback" {
+		t.Errorf("the retry asked for models %q with route %q, want the fallback after the current model", body.Models, body.Route)
+	}
+	if !hasReply(telegram, userID, "Answered by fallback model "+fallbackID) {
+		t.Errorf("got replies %q, want the fallback model named", telegram.Texts(userID))
+	}
+}
+
+func TestChatQueueKeepsOrder(t *testing.T) {
+	b, telegram, api := newTestBot(t)
+	const userID = 1015
+	authorizeTestUser(userID)
+
+	// The fake echoes the questions; they are not scripted, because the
+	// thread title is asked for in the background meanwhile
+	questions := []string{"first", "second", "third"}
+	for i, question := range questions {
+		b.handleUpdate(tgbotapi.Update{Message: fake.Message(userID, question)}, fmt.Sprintf("queued-%d", i))
+	}
+	waitUntil(t, "the last answer", func() bool { return hasReply(telegram, userID, "Echo: third") })
+	waitUntil(t, "the queue to empty", func() bool {
+		chatQueuesMu.Lock()
+		defer chatQueuesMu.Unlock()
+		return chatQueues[userID] == nil
+	})
+
+	var answers []string
+	for _, text := range telegram.Texts(userID) {
+		if strings.HasPrefix(text, "Echo: ") {
+			answers = append(answers, strings.TrimPrefix(text, "Echo: "))
+		}
+	}
+	if !slices.Equal(answers, questions) {
+		t.Errorf("got answers to %q, want them in the order asked %q", answers, questions)
+	}
+	if !hasReply(telegram, userID, "Queued (position 2)") {
+		t.Errorf("got replies %q, want the position of the queued messages", telegram.Texts(userID))
+	}
+	for i, request := range answerRequests(api) {
+		if got := request.LastUserMessage(); got != questions[i] {
+			t.Errorf("request %d asked %q, want %q", i+1, got, questions[i])
+		}
+	}
+}
+
+func TestThreadTitleUsageIsRecorded(t *testing.T) {
+	b, _, api := newTestBot(t)
+	const userID = 1016
+	authorizeTestUser(userID)
+
+	api.Enqueue(
+		fake.Response{Content: "Paris.", PromptTokens: 10, CompletionTokens: 2, Cost: 0.01},
+		fake.Response{Content: "Capital of France", PromptTokens: 30, CompletionTokens: 4, Cost: 0.002},
+	)
+
+	handleTestMessage(b, userID, "What is the capital of France?")
+	b.background.Wait()
+
+	usage := getUser(userID, "test").Usage
+	if usage.Requests != 2 || usage.PromptTokens != 40 || usage.CompletionTokens != 6 {
+		t.Errorf("got %d requests with %d+%d tokens, want the answer and the title counted", usage.Requests, usage.PromptTokens, usage.CompletionTokens)
+	}
+	if title := getConversation(userID).Title; title != "Capital of France" {
+		t.Errorf("the thread is titled %q, want the generated title", title)
+	}
+}
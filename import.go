@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const maxImportFileSize = 5 << 20 // Largest conversation file accepted by /import, in bytes
+
+const importUsage = `To import a conversation, send a JSON file with /import as its caption, or send /import and then the file.
+
+Supported formats:
+• OpenAI/OpenRouter messages: [{"role": "user", "content": "..."}, ...] or {"messages": [...]}
+• Files made with /export json
+• ChatGPT export (conversations.json); the most recent conversation is imported
+
+The imported messages replace the current conversation.`
+
+var (
+	awaitingImport   = make(map[int64]bool) // users who sent /import and are expected to send a file
+	awaitingImportMu sync.Mutex
+)
+
+// importedMessage is a message in the OpenAI messages format, with the
+// optional details written by /export
+type importedMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+	Model   string          `json:"model"`
+	Time    time.Time       `json:"time"`
+}
+
+// chatGPTConversation is a conversation in a ChatGPT data export
+type chatGPTConversation struct {
+	Title       string  `json:"title"`
+	UpdateTime  float64 `json:"update_time"`
+	CurrentNode string  `json:"current_node"`
+	Mapping     map[string]struct {
+		Parent  string `json:"parent"`
+		Message *struct {
+			Author struct {
+				Role string `json:"role"`
+			} `json:"author"`
+			Content struct {
+				ContentType string            `json:"content_type"`
+				Parts       []json.RawMessage `json:"parts"`
+			} `json:"content"`
+			CreateTime float64 `json:"create_time"`
+			Metadata   struct {
+				ModelSlug string `json:"model_slug"`
+			} `json:"metadata"`
+		} `json:"message"`
+	} `json:"mapping"`
+}
+
+// Handle the /import command: the next file the user sends is imported
+func (b *Bot) handleImportCommand(chatID int64, userID int64, requestID string) {
+	awaitingImportMu.Lock()
+	awaitingImport[userID] = true
+	awaitingImportMu.Unlock()
+	b.sendMessage(chatID, importUsage, requestID)
+}
+
+// Handle a document sent to the bot. Returns false if the user is not
+// importing a conversation.
+func (b *Bot) handleDocumentMessage(chatID int64, userID int64, message *tgbotapi.Message, requestID string) bool {
+	awaitingImportMu.Lock()
+	awaiting := awaitingImport[userID]
+	delete(awaitingImport, userID)
+	awaitingImportMu.Unlock()
+
+	if !awaiting && !isImportCaption(message.Caption) {
+		return false
+	}
+	b.importConversationFile(chatID, userID, message.Document, requestID)
+	return true
+}
+
+// Check whether a document caption is the /import command
+func isImportCaption(caption string) bool {
+	command := strings.Fields(caption)
+	if len(command) == 0 {
+		return false
+	}
+	name, _, _ := strings.Cut(command[0], "@")
+	return name == "/import"
+}
+
+// Cancel a pending /import when the user sends something other than a file
+func cancelPendingImport(userID int64) {
+	awaitingImportMu.Lock()
+	delete(awaitingImport, userID)
+	awaitingImportMu.Unlock()
+}
+
+// Download a conversation file and make it the user's current conversation
+func (b *Bot) importConversationFile(chatID int64, userID int64, document *tgbotapi.Document, requestID string) {
+	cancelPendingImport(userID)
+	if document.FileSize > maxImportFileSize {
+		b.sendMessage(chatID, fmt.Sprintf("❌ The file is too large to import (limit %d MB).", maxImportFileSize>>20), requestID)
+		return
+	}
+
+	data, err := b.downloadTelegramFile(document.FileID, maxImportFileSize)
+	if err != nil {
+		logError("[%s] Failed to download import file: %v", requestID, err)
+		b.sendMessage(chatID, "❌ Could not download the file. Please try again.", requestID)
+		return
+	}
+
+	messages, title, err := parseImportedConversation(data)
+	if err != nil {
+		logInfo("[%s] Rejected import file %s: %v", requestID, document.FileName, err)
+		b.sendMessage(chatID, fmt.Sprintf("❌ Could not import %s: %v\n\n%s", document.FileName, err, importUsage), requestID)
+		return
+	}
+
+	systemPrompt, messages := splitImportedSystemPrompt(messages)
+	if len(messages) == 0 {
+		b.sendMessage(chatID, fmt.Sprintf("❌ Could not import %s: the conversation has only a system prompt\n\n%s", document.FileName, importUsage), requestID)
+		return
+	}
+
+	replaced := replaceConversation(userID, messages, title, systemPrompt, requestID)
+	logInfo("[%s] Imported %d messages for user %d from %s", requestID, len(messages), userID, document.FileName)
+
+	reply := fmt.Sprintf("✅ Imported %d messages", len(messages))
+	if title != "" {
+		reply += fmt.Sprintf(" from \"%s\"", title)
+	}
+	reply += ". Send a message to continue the conversation."
+	if systemPrompt != "" {
+		reply += "\nIts system prompt is now the system prompt of the thread (see /thread system)."
+	}
+	if replaced > 0 {
+		reply += fmt.Sprintf("\nThe previous conversation (%d messages) was replaced.", replaced)
+	}
+	b.sendMessage(chatID, reply, requestID)
+}
+
+// Download a file sent to the bot
+func (b *Bot) downloadTelegramFile(fileID string, maxSize int64) ([]byte, error) {
+	fileURL, err := b.telegram.GetFileDirectURL(fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file URL: %v", err)
+	}
+	resp, err := httpClient.Get(fileURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download file: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download file: status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("file is larger than %d bytes", maxSize)
+	}
+	return data, nil
+}
+
+// Parse a conversation file in any of the supported formats. Returns the
+// messages and the conversation title, if the file has one.
+func parseImportedConversation(data []byte) ([]ConversationMessage, string, error) {
+	trimmed := strings.TrimSpace(string(data))
+	if trimmed == "" {
+		return nil, "", fmt.Errorf("the file is empty")
+	}
+
+	// A list of messages, or a ChatGPT export (a list of conversations)
+	if strings.HasPrefix(trimmed, "[") {
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, "", fmt.Errorf("invalid JSON: %v", err)
+		}
+		if len(items) > 0 && isChatGPTConversation(items[0]) {
+			return parseChatGPTExport(items)
+		}
+		var messages []importedMessage
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return nil, "", fmt.Errorf("invalid messages list: %v", err)
+		}
+		converted, err := convertImportedMessages(messages)
+		return converted, "", err
+	}
+
+	// An object with a messages list, or a single ChatGPT conversation
+	var object struct {
+		Title    string            `json:"title"`
+		Messages []importedMessage `json:"messages"`
+		Mapping  json.RawMessage   `json:"mapping"`
+	}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, "", fmt.Errorf("invalid JSON: %v", err)
+	}
+	if object.Mapping != nil {
+		return parseChatGPTExport([]json.RawMessage{json.RawMessage(data)})
+	}
+	if object.Messages == nil {
+		return nil, "", fmt.Errorf(`no "messages" list found`)
+	}
+	converted, err := convertImportedMessages(object.Messages)
+	return converted, object.Title, err
+}
+
+// Take the leading system message of an imported conversation, as written by
+// /export, so that it becomes the system prompt of the thread instead of a
+// message sent after it
+func splitImportedSystemPrompt(messages []ConversationMessage) (string, []ConversationMessage) {
+	if len(messages) == 0 || messages[0].Role != "system" {
+		return "", messages
+	}
+	return messages[0].Content, messages[1:]
+}
+
+// Validate messages in the OpenAI format and convert them to conversation messages
+func convertImportedMessages(messages []importedMessage) ([]ConversationMessage, error) {
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("the conversation has no messages")
+	}
+
+	converted := make([]ConversationMessage, 0, len(messages))
+	for i, message := range messages {
+		role, err := importedRole(message.Role)
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %v", i+1, err)
+		}
+		content, err := importedContent(message.Content)
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %v", i+1, err)
+		}
+		if strings.TrimSpace(content) == "" {
+			return nil, fmt.Errorf("message %d: content is empty", i+1)
+		}
+		converted = append(converted, ConversationMessage{Role: role, Content: content, Model: message.Model, Time: message.Time})
+	}
+	return converted, nil
+}
+
+// Check that a role can be sent to OpenRouter, mapping "developer" to "system"
+func importedRole(role string) (string, error) {
+	switch role {
+	case "system", "user", "assistant":
+		return role, nil
+	case "developer":
+		return "system", nil
+	case "":
+		return "", fmt.Errorf(`"role" is missing`)
+	case "tool", "function":
+		return "", fmt.Errorf("tool messages are not supported")
+	}
+	return "", fmt.Errorf("unknown role %q (expected system, user or assistant)", role)
+}
+
+// Get the text of message content, which is either a string or a list of parts
+func importedContent(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", fmt.Errorf(`"content" is missing`)
+	}
+
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil
+	}
+
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", fmt.Errorf(`"content" must be a string or a list of content parts`)
+	}
+	var texts []string
+	for _, part := range parts {
+		if part.Type == "text" {
+			texts = append(texts, part.Text)
+		}
+	}
+	if len(texts) == 0 {
+		return "", fmt.Errorf("only text content is supported")
+	}
+	return strings.Join(texts, "\n\n"), nil
+}
+
+// Check whether a JSON object is a conversation from a ChatGPT export
+func isChatGPTConversation(raw json.RawMessage) bool {
+	var probe struct {
+		Mapping json.RawMessage `json:"mapping"`
+	}
+	return json.Unmarshal(raw, &probe) == nil && probe.Mapping != nil
+}
+
+// Parse a ChatGPT export and convert its most recently updated conversation
+func parseChatGPTExport(items []json.RawMessage) ([]ConversationMessage, string, error) {
+	conversations := make([]chatGPTConversation, 0, len(items))
+	for i, item := range items {
+		var conversation chatGPTConversation
+		if err := json.Unmarshal(item, &conversation); err != nil {
+			return nil, "", fmt.Errorf("invalid ChatGPT conversation %d: %v", i+1, err)
+		}
+		conversations = append(conversations, conversation)
+	}
+	sort.SliceStable(conversations, func(i, j int) bool {
+		return conversations[i].UpdateTime > conversations[j].UpdateTime
+	})
+	latest := conversations[0]
+
+	// Walk from the current node up to the root to get the active branch. A
+	// node seen twice means the parent links of the file form a cycle.
+	var messages []ConversationMessage
+	visited := make(map[string]bool)
+	for id := latest.CurrentNode; id != ""; {
+		node, exists := latest.Mapping[id]
+		if !exists {
+			break
+		}
+		if visited[id] {
+			return nil, "", fmt.Errorf("the ChatGPT conversation has a cycle at message %q", id)
+		}
+		visited[id] = true
+		id = node.Parent
+		if node.Message == nil || node.Message.Content.ContentType != "text" {
+			continue
+		}
+		role := node.Message.Author.Role
+		if role != "user" && role != "assistant" {
+			continue
+		}
+		var texts []string
+		for _, part := range node.Message.Content.Parts {
+			var text string
+			if json.Unmarshal(part, &text) == nil && text != "" {
+				texts = append(texts, text)
+			}
+		}
+		if len(texts) == 0 {
+			continue
+		}
+		message := ConversationMessage{Role: role, Content: strings.Join(texts, "\n\n"), Model: node.Message.Metadata.ModelSlug}
+		if node.Message.CreateTime > 0 {
+			message.Time = time.Unix(0, int64(node.Message.CreateTime*float64(time.Second)))
+		}
+		messages = append(messages, message)
+	}
+	if len(messages) == 0 {
+		return nil, "", fmt.Errorf("the ChatGPT conversation has no text messages")
+	}
+
+	// Messages were collected from the newest to the oldest
+	slices.Reverse(messages)
+	return messages, latest.Title, nil
+}
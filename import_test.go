@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExportImportKeepsSystemPrompt(t *testing.T) {
+	conversation := Conversation{
+		StartedAt:    time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+		SystemPrompt: "Answer like a pirate.",
+		Messages: []ConversationMessage{
+			{Role: "user", Content: "Hello"},
+			{Role: "assistant", Content: "Ahoy!", Model: "openai/gpt-4o-mini"},
+		},
+	}
+	data, err := exportConversation(conversation, ExportJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, _, err := parseImportedConversation(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	systemPrompt, messages := splitImportedSystemPrompt(messages)
+	if systemPrompt != conversation.SystemPrompt {
+		t.Errorf("got system prompt %q, want %q", systemPrompt, conversation.SystemPrompt)
+	}
+	if len(messages) != 2 || messages[0].Role != "user" || messages[1].Content != "Ahoy!" {
+		t.Errorf("got messages %+v, want the exchange without the system prompt", messages)
+	}
+}
+
+func TestImportWithoutSystemPrompt(t *testing.T) {
+	messages, _, err := parseImportedConversation([]byte(`[{"role":"user","content":"Hi"},{"role":"system","content":"Later instructions"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	systemPrompt, messages := splitImportedSystemPrompt(messages)
+	if systemPrompt != "" || len(messages) != 2 {
+		t.Errorf("got system prompt %q and %d messages, want only a leading system message taken", systemPrompt, len(messages))
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Log output formats, chosen with the LOG_FORMAT environment variable
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+const (
+	redactedSecret    = "[REDACTED]"
+	minLogSecretRunes = 6 // Shorter secrets are not masked, to keep logs readable
+)
+
+var (
+	// Level of the logger, changed at runtime with /debug
+	logLevel slog.LevelVar
+	// Hide message content in logs, set with LOG_REDACT_CONTENT
+	redactContent bool
+
+	// Fields attached to the log records of a request, by request ID
+	requestLogFields   = make(map[string][]slog.Attr)
+	requestLogFieldsMu sync.Mutex
+
+	// Known secrets masked in every log record, such as the bot password
+	logSecrets         []string
+	logSecretsReplacer = strings.NewReplacer()
+	logSecretsMu       sync.RWMutex
+)
+
+// Patterns of secrets masked in logs even when they are not known
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`sk-or-v1-[A-Za-z0-9]+`),                                      // OpenRouter API keys
+	regexp.MustCompile(`sk-[A-Za-z0-9_-]{16,}`),                                      // OpenAI-style API keys
+	regexp.MustCompile(`\b\d{6,12}:[A-Za-z0-9_-]{30,}\b`),                            // Telegram bot tokens
+	regexp.MustCompile(`(?i)\b(bearer\s+)[A-Za-z0-9._~+/=-]+`),                       // Authorization headers
+	regexp.MustCompile(`(?i)("?(?:api_?key|token|password)"?\s*[:=]\s*"?)[^"\s,}]+`), // key=value and JSON fields
+}
+
+// logContent marks a log argument as message content, such as the text a
+// user sent. It is replaced by its length when LOG_REDACT_CONTENT is set.
+type logContent string
+
+// Create the logger writing to out. LOG_FORMAT=json writes one JSON object
+// per line instead of text.
+func setupLogger(out io.Writer) {
+	redactContent = isTruthy(os.Getenv("LOG_REDACT_CONTENT"))
+	options := &slog.HandlerOptions{Level: &logLevel, ReplaceAttr: redactLogAttr}
+	var handler slog.Handler
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), LogFormatJSON) {
+		handler = slog.NewJSONHandler(out, options)
+	} else {
+		handler = slog.NewTextHandler(out, options)
+	}
+	logger = slog.New(handler)
+	logger.Info("Logger initialized", "redact_content", redactContent)
+}
+
+// Check whether an environment variable value means yes
+func isTruthy(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	return false
+}
+
+// Set the level of the logger from a configured level name
+func setLogLevel(level string) {
+	switch level {
+	case LogLevelDebug:
+		logLevel.Set(slog.LevelDebug)
+	case LogLevelError:
+		logLevel.Set(slog.LevelError)
+	default:
+		logLevel.Set(slog.LevelInfo)
+	}
+}
+
+func logDebug(format string, v ...interface{}) {
+	logAt(slog.LevelDebug, format, v)
+}
+
+func logInfo(format string, v ...interface{}) {
+	logAt(slog.LevelInfo, format, v)
+}
+
+// Log a warning message
+func logWarning(format string, v ...interface{}) {
+	logAt(slog.LevelWarn, format, v)
+}
+
+func logError(format string, v ...interface{}) {
+	logAt(slog.LevelError, format, v)
+}
+
+// Log a printf-style message. A leading "[%s] " with the request ID as the
+// first argument becomes the request_id field, followed by the fields set
+// for the request with setRequestLogFields.
+func logAt(level slog.Level, format string, v []interface{}) {
+	ctx := context.Background()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	var attrs []slog.Attr
+	if rest, found := strings.CutPrefix(format, "[%s] "); found && len(v) > 0 {
+		if requestID, ok := v[0].(string); ok {
+			format, v = rest, v[1:]
+			attrs = append(attrs, slog.String("request_id", requestID))
+			attrs = append(attrs, getRequestLogFields(requestID)...)
+		}
+	}
+	logger.LogAttrs(ctx, level, fmt.Sprintf(format, contentArgs(v)...), attrs...)
+}
+
+// Replace message content among log arguments by its length if content is
+// redacted
+func contentArgs(v []interface{}) []interface{} {
+	args := slices.Clone(v)
+	for i, arg := range args {
+		if content, ok := arg.(logContent); ok {
+			if redactContent {
+				args[i] = fmt.Sprintf("[%d chars]", utf8.RuneCountInString(string(content)))
+			} else {
+				args[i] = string(content)
+			}
+		}
+	}
+	return args
+}
+
+// Attach fields, such as user_id, chat_id and model, to the log records of
+// a request. Fields with the same key are replaced.
+func setRequestLogFields(requestID string, attrs ...slog.Attr) {
+	requestLogFieldsMu.Lock()
+	defer requestLogFieldsMu.Unlock()
+	fields := requestLogFields[requestID]
+	for _, attr := range attrs {
+		fields = slices.DeleteFunc(fields, func(field slog.Attr) bool { return field.Key == attr.Key })
+		fields = append(fields, attr)
+	}
+	requestLogFields[requestID] = fields
+}
+
+// Get the fields attached to the log records of a request
+func getRequestLogFields(requestID string) []slog.Attr {
+	requestLogFieldsMu.Lock()
+	defer requestLogFieldsMu.Unlock()
+	return slices.Clone(requestLogFields[requestID])
+}
+
+// Forget the fields of a request that is done
+func clearRequestLogFields(requestID string) {
+	requestLogFieldsMu.Lock()
+	defer requestLogFieldsMu.Unlock()
+	delete(requestLogFields, requestID)
+}
+
+// Mask a secret, such as an API key, in all further log records
+func addLogSecret(secret string) {
+	secret = strings.TrimSpace(secret)
+	if utf8.RuneCountInString(secret) < minLogSecretRunes {
+		return
+	}
+	logSecretsMu.Lock()
+	defer logSecretsMu.Unlock()
+	if slices.Contains(logSecrets, secret) {
+		return
+	}
+	logSecrets = append(logSecrets, secret)
+	var pairs []string
+	for _, known := range logSecrets {
+		pairs = append(pairs, known, redactedSecret)
+	}
+	logSecretsReplacer = strings.NewReplacer(pairs...)
+}
+
+// Mask the secrets of a text
+func redactSecrets(text string) string {
+	logSecretsMu.RLock()
+	replacer := logSecretsReplacer
+	logSecretsMu.RUnlock()
+	text = replacer.Replace(text)
+	for _, pattern := range secretPatterns {
+		if pattern.NumSubexp() > 0 {
+			text = pattern.ReplaceAllString(text, "${1}"+redactedSecret)
+		} else {
+			text = pattern.ReplaceAllString(text, redactedSecret)
+		}
+	}
+	return text
+}
+
+// Mask the secrets of the message and the string fields of a log record
+func redactLogAttr(groups []string, attr slog.Attr) slog.Attr {
+	if attr.Value.Kind() == slog.KindString {
+		attr.Value = slog.StringValue(redactSecrets(attr.Value.String()))
+	}
+	return attr
+}
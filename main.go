@@ -1,9 +1,12 @@
 package main
 
 import (
-	"context"
-	"log"
+	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -17,83 +20,118 @@ const (
 	apiRequestTimeout = 120 * time.Second
 )
 
+// Start a local fake OpenRouter and return its base URL and a function
+// stopping it. Only set in builds with the fakeapi tag (repl_fake.go).
+var startFakeAPI func() (string, func())
+
 func main() {
-	setupLogger()
+	repl := flag.Bool("repl", false, "chat with the bot in the terminal instead of Telegram")
+	replUser := flag.Int64("repl-user", 1, "user ID of the terminal chat in -repl mode")
+	fakeAPI := new(bool)
+	if startFakeAPI != nil {
+		fakeAPI = flag.Bool("fake-api", false, "answer with a local fake OpenRouter that echoes messages (for -repl)")
+	}
+	flag.Parse()
+
+	// In the terminal, logs go to stderr so that they can be kept apart from the chat
+	logOutput := os.Stdout
+	if *repl {
+		logOutput = os.Stderr
+	}
+	setupLogger(logOutput)
 	logInfo("Starting bot...")
+	shutdownTracing := initTracing(logOutput)
+	defer shutdownTracing()
 
 	// Initialize HTTP client with timeout
 	initHTTPClient()
 
 	// Load configuration
-	loadConfig()
+	loadConfig(!*repl)
+	loadConversations()
+	defer flushSaves()
+	initResponseCache()
+
+	if *fakeAPI {
+		baseURL, stop := startFakeAPI()
+		defer stop()
+		os.Setenv("OPENROUTER_BASE_URL", baseURL)
+		logInfo("Using the fake OpenRouter at %s", baseURL)
+	}
+	if *repl {
+		runREPL(*replUser, newLLMClient())
+		return
+	}
 
-	var err error
-	bot, err = tgbotapi.NewBotAPI(config.TelegramToken)
+	api, err := tgbotapi.NewBotAPI(config.TelegramToken)
 	if err != nil {
 		logError("Failed to create Telegram bot: %v", err)
 		os.Exit(1)
 	}
+	b := newBot(tracingTelegram{metricsTelegram{api}}, newLLMClient())
+
+	logInfo("Bot authorized on account %s", api.Self.UserName)
+	b.registerBotCommands(uuid.New().String())
+	if addr := os.Getenv("BOT_METRICS_ADDR"); addr != "" {
+		b.startMetricsServer(addr)
+	}
 
-	logInfo("Bot authorized on account %s", bot.Self.UserName)
+	go handleShutdown(shutdownTracing)
 
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 60
 
-	updates := bot.GetUpdatesChan(u)
+	updates := api.GetUpdatesChan(u)
 
 	// Handle updates
 	for update := range updates {
-		if update.Message == nil {
-			continue
-		}
-
-		// Generate a request ID for this message
-		requestID := uuid.New().String()
-		logInfo("[%s] Received message from user %d: %s", requestID, update.Message.From.ID, update.Message.Text)
-
-		// Handle message with timeout
-		go func(message *tgbotapi.Message, reqID string) {
-			// Create a context with timeout
-			ctx, cancel := context.WithTimeout(context.Background(), handlerTimeout)
-			defer cancel()
-
-			// Create a done channel to signal completion
-			done := make(chan struct{})
-
-			go func() {
-				handleMessageWithContext(ctx, message, reqID)
-				close(done)
-			}()
-
-			select {
-			case <-done:
-				logInfo("[%s] Message handling completed normally", reqID)
-			case <-ctx.Done():
-				logError("[%s] Message handling timed out after %v", reqID, handlerTimeout)
-				sendMessage(message.Chat.ID, "Sorry, the operation timed out. Please try again.", reqID)
-			}
-		}(update.Message, requestID)
+		// Generate a request ID for this update
+		b.handleUpdate(update, uuid.New().String())
 	}
 }
 
-func setupLogger() {
-	// Log only to stdout, not to file
-	logger = log.New(os.Stdout, "", log.LstdFlags)
-	logger.Printf("Logger initialized")
-}
+// Handle an update from Telegram: messages are queued per chat, while /stop
+// and the stop buttons are handled right away
+func (b *Bot) handleUpdate(update tgbotapi.Update, requestID string) {
+	if update.CallbackQuery != nil {
+		if strings.HasPrefix(update.CallbackQuery.Data, stopCallbackPrefix) {
+			go b.handleStopCallback(update.CallbackQuery, requestID)
+		}
+		return
+	}
+	if update.Message == nil {
+		return
+	}
+
+	logInfo("[%s] Received message from user %d in chat %d (%d chars)", requestID, update.Message.From.ID, update.Message.Chat.ID, len(update.Message.Text))
 
-func logDebug(format string, v ...interface{}) {
-	if config.LogLevel == LogLevelDebug {
-		logger.Printf("[DEBUG] "+format, v...)
+	// /stop must not wait behind the message it is meant to interrupt
+	if update.Message.IsCommand() && update.Message.Command() == "stop" {
+		go b.handleStopCommand(update.Message, requestID)
+		return
 	}
-}
 
-func logInfo(format string, v ...interface{}) {
-	if config.LogLevel == LogLevelDebug || config.LogLevel == LogLevelInfo {
-		logger.Printf("[INFO] "+format, v...)
+	// Queue the message so that messages of a chat are handled in order
+	position, ok := b.enqueueMessage(update.Message, requestID)
+	if !ok {
+		logInfo("[%s] Queue is full for chat %d", requestID, update.Message.Chat.ID)
+		go b.sendMessage(update.Message.Chat.ID, "⚠️ Too many pending messages. Please wait for the current answers before sending more.", requestID)
+		return
+	}
+	if position > 0 {
+		logDebug("[%s] Message queued at position %d", requestID, position)
+		go b.sendMessage(update.Message.Chat.ID, fmt.Sprintf("⏳ Queued (position %d). Your message will be answered after the previous ones.", position), requestID)
 	}
 }
 
-func logError(format string, v ...interface{}) {
-	logger.Printf("[ERROR] "+format, v...)
+// Write the pending changes and traces when the bot is stopped, such as by
+// docker stop
+func handleShutdown(shutdownTracing func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	received := <-signals
+	logInfo("Received %v, saving data before exiting", received)
+	flushSaves()
+	shutdownTracing()
+	os.Exit(0)
 }
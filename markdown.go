@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	extast "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Markdown parser with the GitHub extensions models commonly use, plus ||spoilers||
+var markdownParser = goldmark.New(
+	goldmark.WithExtensions(
+		extension.Strikethrough,
+		extension.Table,
+		extension.TaskList,
+		spoilerExtension{},
+	),
+).Parser()
+
+// htmlTokenKind is the type of a rendered Telegram HTML token
+type htmlTokenKind int
+
+const (
+	tokenText  htmlTokenKind = iota // Plain text, escaped when serialized
+	tokenOpen                       // Opening tag
+	tokenClose                      // Closing tag
+	tokenBreak                      // Separator between blocks
+)
+
+// htmlToken is a piece of rendered Telegram HTML
+type htmlToken struct {
+	kind  htmlTokenKind
+	tag   string // Tag name of open and close tokens
+	attrs string // Escaped attributes of an open token, with a leading space
+	text  string // Unescaped text of text and break tokens
+}
+
+// Convert Markdown to Telegram HTML, keeping all elements inline
+func convertToTelegramHTML(markdown string) string {
+	tokens, _ := renderMarkdown(markdown, renderOptions{wideTables: TableOutputText, math: MathOutputUnicode})
+	return serializeHTMLTokens(tokens)
+}
+
+// Render Markdown into a stream of Telegram HTML tokens. Elements that are
+// too large to read inline are returned as attachments, depending on options.
+func renderMarkdown(markdown string, options renderOptions) ([]htmlToken, []attachment) {
+	markdown, math := extractMath(markdown)
+	source := []byte(markdown)
+	doc := markdownParser.Parse(text.NewReader(source))
+
+	r := &telegramRenderer{source: source, options: options, math: math}
+	r.renderBlocks(doc, "\n\n")
+	return r.tokens, r.attachments
+}
+
+// Serialize tokens into a Telegram HTML string
+func serializeHTMLTokens(tokens []htmlToken) string {
+	var sb strings.Builder
+	for _, token := range tokens {
+		switch token.kind {
+		case tokenText, tokenBreak:
+			sb.WriteString(escapeTelegramHTML(token.text))
+		case tokenOpen:
+			sb.WriteString("<" + token.tag + token.attrs + ">")
+		case tokenClose:
+			sb.WriteString("</" + token.tag + ">")
+		}
+	}
+	return sb.String()
+}
+
+// Escape the characters Telegram HTML requires to be escaped in text
+func escapeTelegramHTML(text string) string {
+	return telegramHTMLEscaper.Replace(text)
+}
+
+var telegramHTMLEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// Escape a value for use in a double-quoted attribute
+func escapeHTMLAttribute(value string) string {
+	return strings.ReplaceAll(escapeTelegramHTML(value), `"`, "&quot;")
+}
+
+// telegramRenderer walks a Markdown AST and emits only the tags Telegram supports
+type telegramRenderer struct {
+	source      []byte
+	options     renderOptions
+	tokens      []htmlToken
+	attachments []attachment
+	math        []mathSpan // math spans replaced by placeholders in the source
+	listDepth   int
+	quoteDepth  int
+	tables      int // number of tables seen, for attachment names
+	codeBlocks  int // number of code blocks seen, for attachment names
+	formulas    int // number of formula images, for attachment names
+}
+
+func (r *telegramRenderer) text(s string) {
+	if s == "" {
+		return
+	}
+	// Merge adjacent text so the token stream stays compact
+	if n := len(r.tokens); n > 0 && r.tokens[n-1].kind == tokenText {
+		r.tokens[n-1].text += s
+		return
+	}
+	r.tokens = append(r.tokens, htmlToken{kind: tokenText, text: s})
+}
+
+func (r *telegramRenderer) open(tag string, attrs string) {
+	r.tokens = append(r.tokens, htmlToken{kind: tokenOpen, tag: tag, attrs: attrs})
+}
+
+func (r *telegramRenderer) close(tag string) {
+	r.tokens = append(r.tokens, htmlToken{kind: tokenClose, tag: tag})
+}
+
+func (r *telegramRenderer) blockBreak(separator string) {
+	r.tokens = append(r.tokens, htmlToken{kind: tokenBreak, text: separator})
+}
+
+// Render the block children of a node separated by the separator
+func (r *telegramRenderer) renderBlocks(parent ast.Node, separator string) {
+	for child := parent.FirstChild(); child != nil; child = child.NextSibling() {
+		if child != parent.FirstChild() {
+			r.blockBreak(separator)
+		}
+		r.renderBlock(child)
+	}
+}
+
+func (r *telegramRenderer) renderBlock(node ast.Node) {
+	switch n := node.(type) {
+	case *ast.Paragraph, *ast.TextBlock:
+		r.renderInlines(n)
+	case *ast.Heading:
+		r.open("b", "")
+		r.renderInlines(n)
+		r.close("b")
+	case *ast.ThematicBreak:
+		r.text("──────────")
+	case *ast.FencedCodeBlock:
+		r.renderCodeBlock(n, string(n.Language(r.source)))
+	case *ast.CodeBlock:
+		r.renderCodeBlock(n, "")
+	case *ast.Blockquote:
+		// Telegram does not support nested blockquotes
+		if r.quoteDepth > 0 {
+			r.renderBlocks(n, "\n")
+			return
+		}
+		r.quoteDepth++
+		r.open("blockquote", "")
+		r.renderBlocks(n, "\n")
+		r.close("blockquote")
+		r.quoteDepth--
+	case *ast.List:
+		r.renderList(n)
+	case *ast.HTMLBlock:
+		r.textWithMath(strings.TrimRight(r.linesText(n), "\n"))
+	case *extast.Table:
+		r.renderTable(n)
+	default:
+		r.renderBlocks(n, "\n\n")
+	}
+}
+
+// Render a code block as <pre>, with the language class when it is known
+func (r *telegramRenderer) renderCodeBlock(node ast.Node, language string) {
+	code := strings.TrimRight(r.linesText(node), "\n")
+	if code == "" {
+		code = " "
+	}
+
+	r.codeBlocks++
+	if r.options.codeFiles && isLongCode(code) {
+		name := codeFileName(language, r.codeBlocks)
+		r.attachments = append(r.attachments, attachment{name: name, data: []byte(code + "\n")})
+		r.attachmentNote(fmt.Sprintf("Code (%d lines) attached as %s", strings.Count(code, "\n")+1, name))
+		return
+	}
+
+	r.open("pre", "")
+	if language != "" {
+		r.open("code", ` class="language-`+escapeHTMLAttribute(language)+`"`)
+	}
+	r.text(code)
+	if language != "" {
+		r.close("code")
+	}
+	r.close("pre")
+}
+
+// Render a list with bullets or numbers, indenting nested lists
+func (r *telegramRenderer) renderList(list *ast.List) {
+	indent := strings.Repeat("   ", r.listDepth)
+	number := list.Start
+	for item := list.FirstChild(); item != nil; item = item.NextSibling() {
+		if item != list.FirstChild() {
+			r.blockBreak("\n")
+		}
+		if list.IsOrdered() {
+			r.text(fmt.Sprintf("%s%d. ", indent, number))
+			number++
+		} else {
+			r.text(indent + "• ")
+		}
+
+		r.listDepth++
+		for child := item.FirstChild(); child != nil; child = child.NextSibling() {
+			if child != item.FirstChild() {
+				r.blockBreak("\n")
+				if _, nested := child.(*ast.List); !nested {
+					r.text(indent + "   ")
+				}
+			}
+			r.renderBlock(child)
+		}
+		r.listDepth--
+	}
+}
+
+// Render a table as an aligned monospaced block, or as an attachment when it
+// is too wide to read on a phone
+func (r *telegramRenderer) renderTable(table *extast.Table) {
+	var header []string
+	var rows [][]string
+	for row := table.FirstChild(); row != nil; row = row.NextSibling() {
+		var cells []string
+		for cell := row.FirstChild(); cell != nil; cell = cell.NextSibling() {
+			cells = append(cells, strings.TrimSpace(r.plainInlineText(cell)))
+		}
+		if _, isHeader := row.(*extast.TableHeader); isHeader {
+			header = cells
+		} else {
+			rows = append(rows, cells)
+		}
+	}
+
+	aligns := make([]string, len(table.Alignments))
+	for i, alignment := range table.Alignments {
+		switch alignment {
+		case extast.AlignRight:
+			aligns[i] = "right"
+		case extast.AlignCenter:
+			aligns[i] = "center"
+		default:
+			aligns[i] = "left"
+		}
+	}
+
+	r.tables++
+	wide := tableTextWidth(tableColumnWidths(header, rows)) > maxInlineTableWidth
+	if wide && r.options.wideTables != TableOutputText {
+		file, err := tableAttachment(header, rows, aligns, r.options.wideTables, r.tables)
+		if err == nil {
+			r.attachments = append(r.attachments, file)
+			r.attachmentNote(fmt.Sprintf("Table %d attached as %s", r.tables, file.name))
+			return
+		}
+		logError("Failed to create attachment for table %d, showing it inline: %v", r.tables, err)
+	}
+
+	r.open("pre", "")
+	r.text(formatAlignedTable(header, rows, aligns))
+	r.close("pre")
+}
+
+// Add a note in the text about an element sent as an attachment
+func (r *telegramRenderer) attachmentNote(note string) {
+	r.text("📎 ")
+	r.open("i", "")
+	r.text(note)
+	r.close("i")
+}
+
+// Get the visible text of inline content without formatting
+func (r *telegramRenderer) plainInlineText(node ast.Node) string {
+	options := r.options
+	if options.math == MathOutputImage {
+		options.math = MathOutputUnicode
+	}
+	inner := &telegramRenderer{source: r.source, options: options, math: r.math}
+	inner.renderInlines(node)
+	return plainTextOfTokens(inner.tokens)
+}
+
+// Render the inline children of a node
+func (r *telegramRenderer) renderInlines(parent ast.Node) {
+	for child := parent.FirstChild(); child != nil; child = child.NextSibling() {
+		r.renderInline(child)
+	}
+}
+
+func (r *telegramRenderer) renderInline(node ast.Node) {
+	switch n := node.(type) {
+	case *ast.Text:
+		value := n.Value(r.source)
+		if !n.IsRaw() {
+			value = util.ResolveEntityNames(util.ResolveNumericReferences(util.UnescapePunctuations(value)))
+		}
+		r.textWithMath(string(value))
+		if n.SoftLineBreak() || n.HardLineBreak() {
+			r.text("\n")
+		}
+	case *ast.String:
+		r.text(string(n.Value))
+	case *ast.CodeSpan:
+		r.open("code", "")
+		r.text(r.rawInlineText(n))
+		r.close("code")
+	case *ast.Emphasis:
+		tag := "i"
+		if n.Level >= 2 {
+			tag = "b"
+		}
+		r.open(tag, "")
+		r.renderInlines(n)
+		r.close(tag)
+	case *ast.Link:
+		r.renderLink(string(n.Destination), n)
+	case *ast.Image:
+		r.text("🖼 ")
+		r.renderLink(string(n.Destination), n)
+	case *ast.AutoLink:
+		link := string(n.URL(r.source))
+		if isTelegramLinkURL(link) {
+			r.open("a", ` href="`+escapeHTMLAttribute(link)+`"`)
+			r.text(string(n.Label(r.source)))
+			r.close("a")
+		} else {
+			r.text(string(n.Label(r.source)))
+		}
+	case *ast.RawHTML:
+		var raw strings.Builder
+		for i := 0; i < n.Segments.Len(); i++ {
+			segment := n.Segments.At(i)
+			raw.Write(segment.Value(r.source))
+		}
+		switch strings.ToLower(strings.ReplaceAll(raw.String(), " ", "")) {
+		case "<br>", "<br/>":
+			r.text("\n")
+		default:
+			r.text(raw.String())
+		}
+	case *extast.Strikethrough:
+		r.open("s", "")
+		r.renderInlines(n)
+		r.close("s")
+	case *spoilerNode:
+		r.open("tg-spoiler", "")
+		r.renderInlines(n)
+		r.close("tg-spoiler")
+	case *extast.TaskCheckBox:
+		if n.IsChecked {
+			r.text("☑ ")
+		} else {
+			r.text("☐ ")
+		}
+	default:
+		r.renderInlines(n)
+	}
+}
+
+// Render a link if its URL is usable in Telegram, otherwise just its text
+func (r *telegramRenderer) renderLink(destination string, label ast.Node) {
+	if !isTelegramLinkURL(destination) {
+		r.renderInlines(label)
+		return
+	}
+	r.open("a", ` href="`+escapeHTMLAttribute(destination)+`"`)
+	if label.FirstChild() == nil {
+		r.text(destination)
+	} else {
+		r.renderInlines(label)
+	}
+	r.close("a")
+}
+
+// Check whether Telegram accepts the URL in a link
+func isTelegramLinkURL(link string) bool {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "http", "https", "tg", "mailto", "ftp":
+		return true
+	}
+	return false
+}
+
+// Get the raw text of an inline node such as a code span
+func (r *telegramRenderer) rawInlineText(node ast.Node) string {
+	var sb strings.Builder
+	for child := node.FirstChild(); child != nil; child = child.NextSibling() {
+		switch c := child.(type) {
+		case *ast.Text:
+			sb.Write(bytes.ReplaceAll(c.Value(r.source), []byte("\n"), []byte(" ")))
+		case *ast.String:
+			sb.Write(c.Value)
+		}
+	}
+	return sb.String()
+}
+
+// Get the text of all lines of a block node
+func (r *telegramRenderer) linesText(node ast.Node) string {
+	var sb strings.Builder
+	lines := node.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		sb.Write(line.Value(r.source))
+	}
+	return sb.String()
+}
+
+// spoilerNode is ||hidden text|| rendered as a Telegram spoiler
+type spoilerNode struct {
+	ast.BaseInline
+}
+
+var kindSpoiler = ast.NewNodeKind("Spoiler")
+
+func (n *spoilerNode) Kind() ast.NodeKind {
+	return kindSpoiler
+}
+
+func (n *spoilerNode) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+// spoilerDelimiterProcessor matches pairs of || delimiters
+type spoilerDelimiterProcessor struct{}
+
+func (p spoilerDelimiterProcessor) IsDelimiter(b byte) bool {
+	return b == '|'
+}
+
+func (p spoilerDelimiterProcessor) CanOpenCloser(opener, closer *parser.Delimiter) bool {
+	return opener.Char == closer.Char
+}
+
+func (p spoilerDelimiterProcessor) OnMatch(consumes int) ast.Node {
+	return &spoilerNode{}
+}
+
+// spoilerParser parses ||spoiler|| delimiters
+type spoilerParser struct{}
+
+func (s spoilerParser) Trigger() []byte {
+	return []byte{'|'}
+}
+
+func (s spoilerParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	before := block.PrecendingCharacter()
+	line, segment := block.PeekLine()
+	node := parser.ScanDelimiter(line, before, 2, spoilerDelimiterProcessor{})
+	if node == nil || node.OriginalLength != 2 || before == '|' {
+		return nil
+	}
+	node.Segment = segment.WithStop(segment.Start + node.OriginalLength)
+	block.Advance(node.OriginalLength)
+	pc.PushDelimiter(node)
+	return node
+}
+
+func (s spoilerParser) CloseBlock(parent ast.Node, pc parser.Context) {}
+
+// spoilerExtension adds the ||spoiler|| syntax to the Markdown parser
+type spoilerExtension struct{}
+
+func (e spoilerExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithInlineParsers(
+		util.Prioritized(spoilerParser{}, 500),
+	))
+}
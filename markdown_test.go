@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestConvertToTelegramHTML(t *testing.T) {
+	tests := []struct {
+		name     string
+		markdown string
+		want     string
+	}{
+		{
+			name:     "comparison operators are escaped",
+			markdown: "If a < b and b > c, then a < c & we are done.",
+			want:     "If a &lt; b and b &gt; c, then a &lt; c &amp; we are done.",
+		},
+		{
+			name:     "snake_case identifiers are not emphasis",
+			markdown: "Call get_user_id and set max_tokens_per_request.",
+			want:     "Call get_user_id and set max_tokens_per_request.",
+		},
+		{
+			name:     "nested emphasis",
+			markdown: "This is **bold with *italic* inside** and ***both***.",
+			want:     "This is <b>bold with <i>italic</i> inside</b> and <i><b>both</b></i>.",
+		},
+		{
+			name:     "headings become bold lines",
+			markdown: "# Summary\n\n## Details\n\nThe answer is 42.",
+			want:     "<b>Summary</b>\n\n<b>Details</b>\n\nThe answer is 42.",
+		},
+		{
+			name:     "bullet, nested and numbered lists",
+			markdown: "Steps:\n\n- install\n- configure\n  - set the token\n\n1. first\n2. second",
+			want:     "Steps:\n\n• install\n• configure\n   • set the token\n\n1. first\n2. second",
+		},
+		{
+			name:     "blockquote with formatting",
+			markdown: "> quoted **text**\n> second line",
+			want:     "<blockquote>quoted <b>text</b>\nsecond line</blockquote>",
+		},
+		{
+			name:     "spoilers and strikethrough",
+			markdown: "The ending is ||a twist|| and the ~~old~~ plan failed.",
+			want:     "The ending is <tg-spoiler>a twist</tg-spoiler> and the <s>old</s> plan failed.",
+		},
+		{
+			name:     "fenced code with a language",
+			markdown: "Run this:\n\n```python\nprint(\"<hi>\")\n```",
+			want:     "Run this:\n\n<pre><code class=\"language-python\">print(\"&lt;hi&gt;\")</code></pre>",
+		},
+		{
+			name:     "fenced code without a language",
+			markdown: "```\nplain & simple\n```",
+			want:     "<pre>plain &amp; simple</pre>",
+		},
+		{
+			name:     "inline code is escaped",
+			markdown: "Use `a<b>` in the template.",
+			want:     "Use <code>a&lt;b&gt;</code> in the template.",
+		},
+		{
+			name:     "javascript links are dropped",
+			markdown: "[click me](javascript:alert(1)) or [docs](https://example.com/?a=1&b=2)",
+			want:     "click me or <a href=\"https://example.com/?a=1&amp;b=2\">docs</a>",
+		},
+		{
+			name:     "raw HTML is escaped",
+			markdown: "Raw <b>html</b> and <script>alert(1)</script>",
+			want:     "Raw &lt;b&gt;html&lt;/b&gt; and &lt;script&gt;alert(1)&lt;/script&gt;",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := convertToTelegramHTML(tt.markdown); got != tt.want {
+				t.Errorf("convertToTelegramHTML(%q)\n got: %q\nwant: %q", tt.markdown, got, tt.want)
+			}
+		})
+	}
+}
+
+// Recorded model answers mixing nested lists, code, tables, math and links
+func TestConvertRecordedAnswers(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join(sourceDir, "testdata", "answers", "*.md"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no recorded answers found: %v", err)
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			markdown, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			html := convertToTelegramHTML(string(markdown))
+			if err := validateTelegramHTML(html); err != nil {
+				t.Errorf("invalid Telegram HTML: %v\n%s", err, html)
+			}
+
+			// The default output settings, and the parts of a split answer,
+			// must be valid on their own too
+			tokens, _ := renderMarkdown(string(markdown), OutputSettings{}.renderOptions())
+			for i, part := range splitHTMLTokens(tokens, 500) {
+				if err := validateTelegramHTML(serializeHTMLTokens(part)); err != nil {
+					t.Errorf("invalid Telegram HTML in part %d: %v\n%s", i+1, err, serializeHTMLTokens(part))
+				}
+			}
+		})
+	}
+}
+
+var (
+	htmlTagPattern    = regexp.MustCompile(`^<(/?)([a-z-]+)((?: [a-z]+="[^"<>]*")*)>`)
+	htmlEntityPattern = regexp.MustCompile(`^&(?:lt|gt|amp|quot|#[0-9]+|#x[0-9a-fA-F]+);`)
+	htmlAttrPattern   = regexp.MustCompile(`([a-z]+)=`)
+)
+
+// Attributes allowed on each tag of the Telegram HTML parse mode
+var telegramTags = map[string][]string{
+	"b": nil, "strong": nil, "i": nil, "em": nil, "u": nil, "ins": nil,
+	"s": nil, "strike": nil, "del": nil, "tg-spoiler": nil,
+	"span": {"class"}, "a": {"href"}, "code": {"class"}, "pre": nil,
+	"blockquote": {"expandable"},
+}
+
+// Check that text is valid in the Telegram HTML parse mode: only supported
+// tags, properly nested, nothing inside code, and <, > and & escaped
+func validateTelegramHTML(html string) error {
+	if !utf8.ValidString(html) {
+		return fmt.Errorf("not valid UTF-8")
+	}
+	var open []string
+	for i := 0; i < len(html); {
+		switch html[i] {
+		case '<':
+			match := htmlTagPattern.FindStringSubmatch(html[i:])
+			if match == nil {
+				return fmt.Errorf("unescaped < at %d: %q", i, excerpt(html, i))
+			}
+			closing, tag, attrs := match[1] == "/", match[2], match[3]
+			allowed, known := telegramTags[tag]
+			if !known {
+				return fmt.Errorf("unsupported tag <%s> at %d", tag, i)
+			}
+			if closing {
+				if len(open) == 0 || open[len(open)-1] != tag {
+					return fmt.Errorf("</%s> at %d does not close the open tags %q", tag, i, open)
+				}
+				open = open[:len(open)-1]
+			} else {
+				for _, attr := range htmlAttrPattern.FindAllStringSubmatch(attrs, -1) {
+					if !slices.Contains(allowed, attr[1]) {
+						return fmt.Errorf("attribute %s not allowed on <%s>", attr[1], tag)
+					}
+				}
+				if len(open) > 0 {
+					parent := open[len(open)-1]
+					if parent == "code" || (parent == "pre" && tag != "code") {
+						return fmt.Errorf("<%s> inside <%s> at %d", tag, parent, i)
+					}
+				}
+				open = append(open, tag)
+			}
+			i += len(match[0])
+		case '&':
+			match := htmlEntityPattern.FindString(html[i:])
+			if match == "" {
+				return fmt.Errorf("unescaped & at %d: %q", i, excerpt(html, i))
+			}
+			i += len(match)
+		case '>':
+			return fmt.Errorf("unescaped > at %d: %q", i, excerpt(html, i))
+		default:
+			i++
+		}
+	}
+	if len(open) > 0 {
+		return fmt.Errorf("unclosed tags %q", open)
+	}
+	return nil
+}
+
+// Get the text around a position, for error messages
+func excerpt(text string, i int) string {
+	return strings.ToValidUTF8(text[max(0, i-20):min(len(text), i+20)], "")
+}
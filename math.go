@@ -0,0 +1,738 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Ways to output LaTeX math
+const (
+	MathOutputUnicode = "unicode" // convert to Unicode text
+	MathOutputImage   = "image"   // send display math as images, inline math as Unicode
+	MathOutputRaw     = "raw"     // keep the LaTeX source as code
+)
+
+// mathSpan is a LaTeX expression found in an answer
+type mathSpan struct {
+	tex     string // expression without delimiters
+	source  string // expression with delimiters, as written by the model
+	display bool   // display math ($$...$$ or \[...\]) rather than inline math
+}
+
+// Placeholders replacing math spans while the Markdown is parsed. They use
+// private-use characters that have no meaning in Markdown.
+const (
+	mathPlaceholderStart = ''
+	mathPlaceholderEnd   = ''
+)
+
+var mathPlaceholderRegex = regexp.MustCompile("([0-9]+)")
+
+// A line starting a list item, whose indented continuation lines are not code
+var listItemRegex = regexp.MustCompile(`^ {0,3}([-*+]|[0-9]{1,9}[.)])([ \t]|$)`)
+
+// Replace math spans in Markdown with placeholders, so that Markdown syntax
+// inside them (such as _ and *) is not interpreted. Code spans and fenced and
+// indented code blocks are left untouched.
+func extractMath(markdown string) (string, []mathSpan) {
+	var out strings.Builder
+	var spans []mathSpan
+
+	addSpan := func(tex string, source string, display bool) {
+		out.WriteRune(mathPlaceholderStart)
+		out.WriteString(strconv.Itoa(len(spans)))
+		out.WriteRune(mathPlaceholderEnd)
+		spans = append(spans, mathSpan{tex: strings.TrimSpace(tex), source: source, display: display})
+	}
+
+	fence := ""
+	lineStart := true
+	indentedCode := false // inside an indented code block
+	blankBefore := true   // the previous line was blank, so an indented code block can start
+	inList := false       // the previous lines are a list item, whose indented lines are not code
+	for i := 0; i < len(markdown); {
+		rest := markdown[i:]
+
+		// Indented code blocks are copied verbatim
+		if lineStart && fence == "" {
+			line, _, _ := strings.Cut(rest, "\n")
+			blank := strings.TrimSpace(line) == ""
+			indented := strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t")
+			if indentedCode && !blank && !indented {
+				indentedCode = false
+			}
+			if !indentedCode && indented && !blank && blankBefore && !inList {
+				indentedCode = true
+			}
+			if !blank && !indentedCode {
+				inList = listItemRegex.MatchString(line) || (inList && strings.HasPrefix(line, " "))
+			}
+			blankBefore = blank
+			if indentedCode {
+				out.WriteString(line)
+				i += len(line)
+				if i < len(markdown) {
+					out.WriteByte('\n')
+					i++
+				}
+				continue
+			}
+		}
+
+		// Fenced code blocks are copied verbatim
+		if lineStart {
+			trimmed := strings.TrimLeft(rest, " ")
+			if marker := codeFenceMarker(trimmed); marker != "" && len(rest)-len(trimmed) <= 3 {
+				if fence == "" {
+					fence = marker
+				} else if strings.HasPrefix(marker, fence) {
+					fence = ""
+				}
+			}
+		}
+		if fence != "" {
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				out.WriteString(rest)
+				break
+			}
+			out.WriteString(rest[:end+1])
+			i += end + 1
+			lineStart = true
+			continue
+		}
+		lineStart = false
+
+		switch {
+		case rest[0] == '\n':
+			out.WriteByte('\n')
+			i++
+			lineStart = true
+			continue
+		case rest[0] == '`':
+			// Code spans are copied verbatim
+			run := len(rest) - len(strings.TrimLeft(rest, "`"))
+			if end := strings.Index(rest[run:], rest[:run]); end >= 0 {
+				length := run + end + run
+				out.WriteString(rest[:length])
+				i += length
+				continue
+			}
+			out.WriteString(rest[:run])
+			i += run
+			continue
+		case strings.HasPrefix(rest, `\$`):
+			out.WriteString(`\$`)
+			i += 2
+			continue
+		case strings.HasPrefix(rest, "$$"):
+			if end := strings.Index(rest[2:], "$$"); end > 0 {
+				addSpan(rest[2:2+end], rest[:end+4], true)
+				i += end + 4
+				continue
+			}
+		case strings.HasPrefix(rest, `\[`):
+			if end := strings.Index(rest[2:], `\]`); end > 0 {
+				addSpan(rest[2:2+end], rest[:end+4], true)
+				i += end + 4
+				continue
+			}
+		case strings.HasPrefix(rest, `\(`):
+			if end := strings.Index(rest[2:], `\)`); end > 0 && !strings.Contains(rest[2:2+end], "\n\n") {
+				addSpan(rest[2:2+end], rest[:end+4], false)
+				i += end + 4
+				continue
+			}
+		case rest[0] == '$':
+			if end := inlineDollarEnd(rest); end > 0 {
+				addSpan(rest[1:end], rest[:end+1], false)
+				i += end + 1
+				continue
+			}
+		}
+
+		out.WriteByte(rest[0])
+		i++
+	}
+
+	return out.String(), spans
+}
+
+// Get the fence marker (``` or ~~~ run) a line starts with, if any
+func codeFenceMarker(line string) string {
+	for _, c := range []string{"`", "~"} {
+		run := len(line) - len(strings.TrimLeft(line, c))
+		if run >= 3 {
+			return line[:run]
+		}
+	}
+	return ""
+}
+
+// Find the closing $ of inline math starting at text[0]. Like Pandoc, the
+// opening $ must be followed by a non-space, the closing $ must be preceded by
+// a non-space and not followed by a digit. The first unescaped $ must be the
+// closing one, so prices like "$5 and $10" are not math. Returns 0 if there is
+// no valid closing $ on the same line.
+func inlineDollarEnd(text string) int {
+	if len(text) < 3 || text[1] == ' ' || text[1] == '\t' || text[1] == '\n' || text[1] == '$' {
+		return 0
+	}
+	for i := 2; i < len(text); i++ {
+		switch text[i] {
+		case '\n':
+			return 0
+		case '\\':
+			i++ // skip escaped character
+		case '$':
+			if text[i-1] == ' ' || text[i-1] == '\t' {
+				return 0
+			}
+			if i+1 < len(text) && text[i+1] >= '0' && text[i+1] <= '9' {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
+
+// mathNodeKind is the type of a parsed LaTeX node
+type mathNodeKind int
+
+const (
+	mathText    mathNodeKind = iota // Symbols or text
+	mathGroup                       // Sequence of nodes
+	mathScripts                     // Base with superscript and/or subscript
+	mathFrac                        // Fraction
+	mathSqrt                        // Square or n-th root
+	mathAccent                      // Accent above a node
+	mathNewline                     // Line break in display math
+	mathSpace                       // Whitespace in the source, kept between terms in Unicode text
+)
+
+// mathNode is a node of a parsed LaTeX expression
+type mathNode struct {
+	kind     mathNodeKind
+	text     string      // text of mathText nodes, accent character of mathAccent nodes
+	children []*mathNode // content of mathGroup nodes
+	base     *mathNode   // base of scripts, body of roots and accents, numerator of fractions
+	sup      *mathNode   // superscript, or root index
+	sub      *mathNode   // subscript, or denominator of fractions
+}
+
+// texParser parses the subset of LaTeX math models commonly produce
+type texParser struct {
+	src []rune
+	pos int
+}
+
+// Parse a LaTeX math expression into a node tree
+func parseTeX(tex string) *mathNode {
+	p := &texParser{src: []rune(tex)}
+	return &mathNode{kind: mathGroup, children: p.parseRow(0)}
+}
+
+// Parse nodes until the stop character (or the end when stop is 0)
+func (p *texParser) parseRow(stop rune) []*mathNode {
+	var nodes []*mathNode
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if stop != 0 && c == stop {
+			p.pos++
+			return nodes
+		}
+		if c == '^' || c == '_' {
+			p.pos++
+			script := p.parseArgument()
+			var base *mathNode
+			for n := len(nodes); n > 0 && nodes[n-1].kind == mathSpace; n-- {
+				nodes = nodes[:n-1]
+			}
+			if n := len(nodes); n > 0 && nodes[n-1].kind != mathNewline {
+				base = nodes[n-1]
+				nodes = nodes[:n-1]
+			} else {
+				base = &mathNode{kind: mathText}
+			}
+			if base.kind != mathScripts {
+				base = &mathNode{kind: mathScripts, base: base}
+			}
+			if c == '^' {
+				base.sup = script
+			} else {
+				base.sub = script
+			}
+			nodes = append(nodes, base)
+			continue
+		}
+		if node := p.parseAtom(); node != nil {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// Parse a command argument: a {group} or a single atom
+func (p *texParser) parseArgument() *mathNode {
+	p.skipSpaces()
+	if p.pos >= len(p.src) {
+		return &mathNode{kind: mathText}
+	}
+	if p.src[p.pos] == '{' {
+		p.pos++
+		return &mathNode{kind: mathGroup, children: p.parseRow('}')}
+	}
+	if node := p.parseAtom(); node != nil {
+		return node
+	}
+	return &mathNode{kind: mathText}
+}
+
+// Read the raw text of a {group}, used for \text and environment names
+func (p *texParser) parseRawArgument() string {
+	p.skipSpaces()
+	if p.pos >= len(p.src) || p.src[p.pos] != '{' {
+		return ""
+	}
+	depth := 0
+	start := p.pos + 1
+	for ; p.pos < len(p.src); p.pos++ {
+		switch p.src[p.pos] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				raw := string(p.src[start:p.pos])
+				p.pos++
+				return raw
+			}
+		}
+	}
+	return string(p.src[start:])
+}
+
+func (p *texParser) skipSpaces() {
+	for p.pos < len(p.src) && unicode.IsSpace(p.src[p.pos]) {
+		p.pos++
+	}
+}
+
+// Parse a single atom. Returns nil for input that produces no output.
+func (p *texParser) parseAtom() *mathNode {
+	c := p.src[p.pos]
+	switch {
+	case unicode.IsSpace(c):
+		// Spaces do not change the rendered formula, but the Unicode text
+		// keeps them so that x + y does not become x+y
+		p.skipSpaces()
+		return &mathNode{kind: mathSpace}
+	case c == '{':
+		p.pos++
+		return &mathNode{kind: mathGroup, children: p.parseRow('}')}
+	case c == '}':
+		p.pos++
+		return nil
+	case c == '&':
+		p.pos++
+		return &mathNode{kind: mathText, text: "  "}
+	case c == '\\':
+		return p.parseCommand()
+	}
+	p.pos++
+	text := string(c)
+	if isMathRelation(text) {
+		text = " " + text + " "
+	}
+	return &mathNode{kind: mathText, text: text}
+}
+
+// Parse a \command
+func (p *texParser) parseCommand() *mathNode {
+	p.pos++ // backslash
+	if p.pos >= len(p.src) {
+		return nil
+	}
+
+	// Single-character commands such as \, \{ and \\
+	if c := p.src[p.pos]; !unicode.IsLetter(c) {
+		p.pos++
+		switch c {
+		case '\\':
+			return &mathNode{kind: mathNewline}
+		case ',', ':', ';', ' ':
+			return &mathNode{kind: mathText, text: " "}
+		case '!':
+			return nil
+		}
+		return &mathNode{kind: mathText, text: string(c)}
+	}
+
+	start := p.pos
+	for p.pos < len(p.src) && unicode.IsLetter(p.src[p.pos]) {
+		p.pos++
+	}
+	name := string(p.src[start:p.pos])
+
+	if symbol, known := texSymbols[name]; known {
+		if isMathRelation(symbol) {
+			symbol = " " + symbol + " "
+		}
+		return &mathNode{kind: mathText, text: symbol}
+	}
+	if accent, known := texAccents[name]; known {
+		return &mathNode{kind: mathAccent, text: accent, base: p.parseArgument()}
+	}
+
+	switch name {
+	case "frac", "dfrac", "tfrac", "cfrac":
+		num := p.parseArgument()
+		return &mathNode{kind: mathFrac, base: num, sub: p.parseArgument()}
+	case "binom":
+		top := p.parseArgument()
+		bottom := p.parseArgument()
+		return &mathNode{kind: mathGroup, children: []*mathNode{
+			{kind: mathText, text: "C("}, top, {kind: mathText, text: ", "}, bottom, {kind: mathText, text: ")"},
+		}}
+	case "sqrt":
+		node := &mathNode{kind: mathSqrt}
+		p.skipSpaces()
+		if p.pos < len(p.src) && p.src[p.pos] == '[' {
+			p.pos++
+			node.sup = &mathNode{kind: mathGroup, children: p.parseRow(']')}
+		}
+		node.base = p.parseArgument()
+		return node
+	case "text", "textrm", "textit", "textbf", "mbox", "operatorname", "mathrm":
+		return &mathNode{kind: mathText, text: p.parseRawArgument()}
+	case "mathbb":
+		return &mathNode{kind: mathText, text: mapRunes(p.parseRawArgument(), doubleStruckLetters)}
+	case "mathbf", "mathit", "mathsf", "mathtt", "mathcal", "boldsymbol", "bm", "displaystyle", "textstyle":
+		if name == "displaystyle" || name == "textstyle" {
+			return nil
+		}
+		return p.parseArgument()
+	case "left", "right", "big", "Big", "bigg", "Bigg", "bigl", "bigr", "Bigl", "Bigr", "middle":
+		// Size modifiers: keep the delimiter that follows, drop the invisible "."
+		p.skipSpaces()
+		if p.pos < len(p.src) && p.src[p.pos] == '.' {
+			p.pos++
+		}
+		return nil
+	case "begin", "end":
+		environment := p.parseRawArgument()
+		return environmentDelimiter(environment, name == "begin")
+	case "quad":
+		return &mathNode{kind: mathText, text: "  "}
+	case "qquad":
+		return &mathNode{kind: mathText, text: "    "}
+	}
+
+	// Named operators such as \sin are shown as their name
+	return &mathNode{kind: mathText, text: name}
+}
+
+// Get the delimiter shown at the start or end of a LaTeX environment
+func environmentDelimiter(environment string, begin bool) *mathNode {
+	delimiters := map[string][2]string{
+		"pmatrix": {"(", ")"},
+		"bmatrix": {"[", "]"},
+		"Bmatrix": {"{", "}"},
+		"vmatrix": {"|", "|"},
+		"cases":   {"{ ", ""},
+	}
+	pair, known := delimiters[environment]
+	if !known {
+		return nil
+	}
+	if begin {
+		return &mathNode{kind: mathText, text: pair[0]}
+	}
+	return &mathNode{kind: mathText, text: pair[1]}
+}
+
+// Check whether a symbol is a relation or arrow that is surrounded by spaces
+func isMathRelation(symbol string) bool {
+	switch symbol {
+	case "=", "<", ">", "≤", "≥", "≠", "≈", "≡", "∼", "≃", "≅", "∝", "∈", "∉", "⊂", "⊆", "⊃", "⊇",
+		"→", "←", "↔", "⇒", "⇐", "⇔", "↦", "⟶", "⟹", "⟺":
+		return true
+	}
+	return false
+}
+
+// Convert a LaTeX math expression to Unicode text
+func texToUnicode(tex string) string {
+	text := mathNodeToUnicode(parseTeX(tex))
+	return strings.TrimSpace(collapseSpaces(text))
+}
+
+func mathNodeToUnicode(node *mathNode) string {
+	if node == nil {
+		return ""
+	}
+	switch node.kind {
+	case mathText:
+		return node.text
+	case mathNewline:
+		return "\n"
+	case mathGroup:
+		texts := make([]string, len(node.children))
+		for i, child := range node.children {
+			texts[i] = mathNodeToUnicode(child)
+		}
+		var sb strings.Builder
+		for i, child := range node.children {
+			if child.kind == mathSpace {
+				if i+1 < len(texts) && separatesMathTerms(sb.String(), texts[i+1]) {
+					sb.WriteString(" ")
+				}
+				continue
+			}
+			sb.WriteString(texts[i])
+		}
+		return sb.String()
+	case mathScripts:
+		text := mathNodeToUnicode(node.base)
+		if node.sub != nil {
+			text += scriptToUnicode(strings.TrimSpace(mathNodeToUnicode(node.sub)), subscriptRunes, "_")
+		}
+		if node.sup != nil {
+			text += scriptToUnicode(strings.TrimSpace(mathNodeToUnicode(node.sup)), superscriptRunes, "^")
+		}
+		if isBigOperator(node.base) {
+			text += " "
+		}
+		return text
+	case mathFrac:
+		num := strings.TrimSpace(mathNodeToUnicode(node.base))
+		den := strings.TrimSpace(mathNodeToUnicode(node.sub))
+		return parenthesize(num) + "/" + parenthesize(den)
+	case mathSqrt:
+		root := "√"
+		if node.sup != nil {
+			root = scriptToUnicode(strings.TrimSpace(mathNodeToUnicode(node.sup)), superscriptRunes, "") + root
+		}
+		return root + parenthesize(strings.TrimSpace(mathNodeToUnicode(node.base)))
+	case mathAccent:
+		body := mathNodeToUnicode(node.base)
+		if len([]rune(body)) == 1 {
+			return body + node.text
+		}
+		return body
+	}
+	return ""
+}
+
+// Check whether a source space between two pieces of Unicode math separates
+// terms, as around the + of x + y. It is dropped at the edges, inside
+// brackets and next to the spacing of relations and spacing commands.
+func separatesMathTerms(previous string, next string) bool {
+	if previous == "" || next == "" {
+		return false
+	}
+	last, _ := utf8.DecodeLastRuneInString(previous)
+	first, _ := utf8.DecodeRuneInString(next)
+	return !unicode.IsSpace(last) && !unicode.IsSpace(first) &&
+		!strings.ContainsRune("([{⟨", last) && !strings.ContainsRune(")]}⟩", first)
+}
+
+// Write a script with Unicode super- or subscript characters if they all
+// exist, otherwise with a ^ or _ marker
+func scriptToUnicode(script string, runes map[rune]rune, marker string) string {
+	script = strings.ReplaceAll(script, " ", "")
+	if script == "" {
+		return ""
+	}
+	if mapped, ok := mapAllRunes(script, runes); ok {
+		return mapped
+	}
+	return marker + parenthesize(script)
+}
+
+// Wrap an expression in parentheses unless it is a single term
+func parenthesize(expr string) string {
+	simple := true
+	for _, r := range expr {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.Is(unicode.Mn, r) && r != '.' {
+			simple = false
+			break
+		}
+	}
+	if simple || utf8.RuneCountInString(expr) == 1 || isParenthesized(expr) {
+		return expr
+	}
+	return "(" + expr + ")"
+}
+
+// Check whether an expression is entirely wrapped in one pair of parentheses
+func isParenthesized(expr string) bool {
+	if !strings.HasPrefix(expr, "(") || !strings.HasSuffix(expr, ")") {
+		return false
+	}
+	depth := 0
+	for i, r := range expr {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 && i < len(expr)-1 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Check whether a node is a large operator such as a sum or an integral,
+// which is followed by a space after its limits
+func isBigOperator(node *mathNode) bool {
+	if node == nil || node.kind != mathText {
+		return false
+	}
+	switch node.text {
+	case "∑", "∏", "∐", "∫", "∬", "∭", "∮", "⋃", "⋂":
+		return true
+	}
+	return false
+}
+
+// Map every rune of s, reporting false if a rune has no mapping
+func mapAllRunes(s string, mapping map[rune]rune) (string, bool) {
+	var sb strings.Builder
+	for _, r := range s {
+		mapped, ok := mapping[r]
+		if !ok {
+			return "", false
+		}
+		sb.WriteRune(mapped)
+	}
+	return sb.String(), true
+}
+
+// Map the runes of s that have a mapping, keeping the others
+func mapRunes(s string, mapping map[rune]rune) string {
+	return strings.Map(func(r rune) rune {
+		if mapped, ok := mapping[r]; ok {
+			return mapped
+		}
+		return r
+	}, s)
+}
+
+// Collapse runs of spaces produced by spacing commands and relations
+func collapseSpaces(s string) string {
+	for strings.Contains(s, "   ") {
+		s = strings.ReplaceAll(s, "   ", "  ")
+	}
+	return s
+}
+
+var superscriptRunes = map[rune]rune{
+	'0': '⁰', '1': '¹', '2': '²', '3': '³', '4': '⁴', '5': '⁵', '6': '⁶', '7': '⁷', '8': '⁸', '9': '⁹',
+	'+': '⁺', '-': '⁻', '−': '⁻', '=': '⁼', '(': '⁽', ')': '⁾',
+	'a': 'ᵃ', 'b': 'ᵇ', 'c': 'ᶜ', 'd': 'ᵈ', 'e': 'ᵉ', 'f': 'ᶠ', 'g': 'ᵍ', 'h': 'ʰ', 'i': 'ⁱ', 'j': 'ʲ',
+	'k': 'ᵏ', 'l': 'ˡ', 'm': 'ᵐ', 'n': 'ⁿ', 'o': 'ᵒ', 'p': 'ᵖ', 'r': 'ʳ', 's': 'ˢ', 't': 'ᵗ', 'u': 'ᵘ',
+	'v': 'ᵛ', 'w': 'ʷ', 'x': 'ˣ', 'y': 'ʸ', 'z': 'ᶻ', 'T': 'ᵀ', '′': '′', '*': '*', '∗': '*',
+}
+
+var subscriptRunes = map[rune]rune{
+	'0': '₀', '1': '₁', '2': '₂', '3': '₃', '4': '₄', '5': '₅', '6': '₆', '7': '₇', '8': '₈', '9': '₉',
+	'+': '₊', '-': '₋', '−': '₋', '=': '₌', '(': '₍', ')': '₎',
+	'a': 'ₐ', 'e': 'ₑ', 'h': 'ₕ', 'i': 'ᵢ', 'j': 'ⱼ', 'k': 'ₖ', 'l': 'ₗ', 'm': 'ₘ', 'n': 'ₙ', 'o': 'ₒ',
+	'p': 'ₚ', 'r': 'ᵣ', 's': 'ₛ', 't': 'ₜ', 'u': 'ᵤ', 'v': 'ᵥ', 'x': 'ₓ',
+}
+
+var doubleStruckLetters = map[rune]rune{
+	'C': 'ℂ', 'H': 'ℍ', 'N': 'ℕ', 'P': 'ℙ', 'Q': 'ℚ', 'R': 'ℝ', 'Z': 'ℤ', 'E': '𝔼', '1': '𝟙',
+}
+
+// Combining characters for accent commands
+var texAccents = map[string]string{
+	"hat": "̂", "widehat": "̂", "bar": "̄", "overline": "̅",
+	"vec": "⃗", "dot": "̇", "ddot": "̈", "tilde": "̃", "widetilde": "̃",
+}
+
+// Unicode characters for LaTeX symbol commands
+var texSymbols = map[string]string{
+	// Greek letters
+	"alpha": "α", "beta": "β", "gamma": "γ", "delta": "δ", "epsilon": "ϵ", "varepsilon": "ε",
+	"zeta": "ζ", "eta": "η", "theta": "θ", "vartheta": "ϑ", "iota": "ι", "kappa": "κ",
+	"lambda": "λ", "mu": "μ", "nu": "ν", "xi": "ξ", "pi": "π", "varpi": "ϖ", "rho": "ρ",
+	"varrho": "ϱ", "sigma": "σ", "varsigma": "ς", "tau": "τ", "upsilon": "υ", "phi": "ϕ",
+	"varphi": "φ", "chi": "χ", "psi": "ψ", "omega": "ω",
+	"Gamma": "Γ", "Delta": "Δ", "Theta": "Θ", "Lambda": "Λ", "Xi": "Ξ", "Pi": "Π",
+	"Sigma": "Σ", "Upsilon": "Υ", "Phi": "Φ", "Psi": "Ψ", "Omega": "Ω",
+	// Operators
+	"times": "×", "cdot": "·", "pm": "±", "mp": "∓", "div": "÷", "ast": "∗", "star": "⋆",
+	"circ": "∘", "bullet": "•", "oplus": "⊕", "otimes": "⊗", "cup": "∪", "cap": "∩",
+	"setminus": "∖", "wedge": "∧", "land": "∧", "vee": "∨", "lor": "∨", "neg": "¬", "lnot": "¬",
+	"sum": "∑", "prod": "∏", "coprod": "∐", "int": "∫", "iint": "∬", "iiint": "∭", "oint": "∮",
+	"bigcup": "⋃", "bigcap": "⋂", "nabla": "∇", "partial": "∂",
+	// Relations
+	"leq": "≤", "le": "≤", "geq": "≥", "ge": "≥", "neq": "≠", "ne": "≠", "approx": "≈",
+	"equiv": "≡", "sim": "∼", "simeq": "≃", "cong": "≅", "propto": "∝", "ll": "≪", "gg": "≫",
+	"in": "∈", "notin": "∉", "ni": "∋", "subset": "⊂", "subseteq": "⊆", "supset": "⊃",
+	"supseteq": "⊇", "mid": "∣", "parallel": "∥", "perp": "⊥", "vdash": "⊢", "models": "⊨",
+	// Arrows
+	"to": "→", "rightarrow": "→", "leftarrow": "←", "gets": "←", "leftrightarrow": "↔",
+	"Rightarrow": "⇒", "implies": "⇒", "Leftarrow": "⇐", "Leftrightarrow": "⇔", "iff": "⇔",
+	"mapsto": "↦", "longrightarrow": "⟶", "Longrightarrow": "⟹", "Longleftrightarrow": "⟺",
+	"uparrow": "↑", "downarrow": "↓",
+	// Other symbols
+	"infty": "∞", "emptyset": "∅", "varnothing": "∅", "forall": "∀", "exists": "∃",
+	"nexists": "∄", "ldots": "…", "dots": "…", "cdots": "⋯", "vdots": "⋮", "ddots": "⋱",
+	"angle": "∠", "degree": "°", "prime": "′", "hbar": "ℏ", "ell": "ℓ", "Re": "ℜ", "Im": "ℑ",
+	"aleph": "ℵ", "langle": "⟨", "rangle": "⟩", "lfloor": "⌊", "rfloor": "⌋",
+	"lceil": "⌈", "rceil": "⌉", "lbrace": "{", "rbrace": "}", "vert": "|", "Vert": "‖",
+	"therefore": "∴", "because": "∵", "top": "⊤", "bot": "⊥", "checkmark": "✓",
+	"percent": "%",
+}
+
+// Render text that may contain math placeholders
+func (r *telegramRenderer) textWithMath(s string) {
+	for {
+		loc := mathPlaceholderRegex.FindStringSubmatchIndex(s)
+		if loc == nil {
+			r.text(s)
+			return
+		}
+		r.text(s[:loc[0]])
+		index, err := strconv.Atoi(s[loc[2]:loc[3]])
+		if err == nil && index < len(r.math) {
+			r.renderMath(r.math[index])
+		}
+		s = s[loc[1]:]
+	}
+}
+
+// Render a math span according to the math output setting
+func (r *telegramRenderer) renderMath(span mathSpan) {
+	switch r.options.math {
+	case MathOutputRaw:
+		r.open("code", "")
+		r.text(span.source)
+		r.close("code")
+		return
+	case MathOutputImage:
+		if span.display {
+			r.formulas++
+			data, err := renderMathPNG(span.tex)
+			if err == nil {
+				name := fmt.Sprintf("formula-%d.png", r.formulas)
+				r.attachments = append(r.attachments, imageAttachment(name, data))
+				r.text(texToUnicode(span.tex) + "\n")
+				r.attachmentNote(fmt.Sprintf("Formula %d attached as %s", r.formulas, name))
+				return
+			}
+			logError("Failed to render formula %d, showing it as text: %v", r.formulas, err)
+		}
+	}
+	r.text(texToUnicode(span.tex))
+}
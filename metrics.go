@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	healthCheckTimeout  = 10 * time.Second
+	telegramCheckMaxAge = 30 * time.Second // How long a Telegram connectivity check is reused
+)
+
+// Outcomes of chat requests
+const (
+	StatusOK      = "ok"
+	StatusError   = "error"
+	StatusStopped = "stopped"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	chatRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tgbot_chat_requests_total",
+		Help: "Messages answered by a model, by model and outcome (ok, error, stopped).",
+	}, []string{"model", "status"})
+	apiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tgbot_api_request_duration_seconds",
+		Help:    "Duration of chat completion requests to the model APIs, by provider, model and HTTP status.",
+		Buckets: []float64{0.25, 0.5, 1, 2, 5, 10, 20, 30, 60, 120},
+	}, []string{"provider", "model", "status"})
+	telegramFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tgbot_telegram_send_failures_total",
+		Help: "Failed requests to the Telegram Bot API, by request type.",
+	}, []string{"method"})
+	tokensTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tgbot_tokens_total",
+		Help: "Tokens spent on answers, by model and type (prompt, completion).",
+	}, []string{"model", "type"})
+	costTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tgbot_cost_dollars_total",
+		Help: "Cost of answers reported by the model APIs in dollars, by model.",
+	}, []string{"model"})
+	cacheHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tgbot_cache_hits_total",
+		Help: "Answers served from the response cache.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		chatRequestsTotal, apiRequestDuration, telegramFailuresTotal, tokensTotal, costTotal, cacheHitsTotal,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "tgbot_queue_depth",
+			Help: "Messages waiting in the chat queues.",
+		}, func() float64 { return float64(queuedMessages()) }),
+	)
+}
+
+// Label of the models missing from the OpenRouter catalog, such as the models
+// of other providers, so that model IDs typed by users do not each add series
+const otherModelLabel = "other"
+
+// Get the model label of a metric: the model ID if the catalog has it
+func modelLabel(modelID string) string {
+	catalogMu.Lock()
+	_, known := catalogModels[modelID]
+	catalogMu.Unlock()
+	if !known {
+		return otherModelLabel
+	}
+	return modelID
+}
+
+// Count the tokens and cost of an answer
+func observeUsage(completion *Completion) {
+	if completion.Cached {
+		cacheHitsTotal.Inc()
+		return
+	}
+	if completion.Usage == nil {
+		return
+	}
+	model := modelLabel(completion.Model)
+	tokensTotal.WithLabelValues(model, "prompt").Add(float64(completion.Usage.PromptTokens))
+	tokensTotal.WithLabelValues(model, "completion").Add(float64(completion.Usage.CompletionTokens))
+	costTotal.WithLabelValues(model).Add(completion.Usage.Cost)
+}
+
+// Get the status label of a model API request
+func apiStatus(err error) string {
+	var apiErr *APIError
+	switch {
+	case err == nil:
+		return strconv.Itoa(http.StatusOK)
+	case errors.As(err, &apiErr) && apiErr.StatusCode != 0:
+		return strconv.Itoa(apiErr.StatusCode)
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	}
+	return StatusError
+}
+
+// metricsLLMClient times the chat requests of another LLMClient
+type metricsLLMClient struct {
+	LLMClient
+}
+
+func (c metricsLLMClient) Chat(ctx context.Context, provider Provider, request OpenRouterRequest, requestID string) (*Completion, error) {
+	start := time.Now()
+	completion, err := c.LLMClient.Chat(ctx, provider, request, requestID)
+	apiRequestDuration.WithLabelValues(provider.Name, modelLabel(request.Model), apiStatus(err)).Observe(time.Since(start).Seconds())
+	return completion, err
+}
+
+// metricsTelegram counts the failed requests of another TelegramSender
+type metricsTelegram struct {
+	TelegramSender
+}
+
+// Get the name of a Telegram request, such as MessageConfig
+func chattableName(c tgbotapi.Chattable) string {
+	name := fmt.Sprintf("%T", c)
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+func (t metricsTelegram) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	message, err := t.TelegramSender.Send(c)
+	if err != nil {
+		telegramFailuresTotal.WithLabelValues(chattableName(c)).Inc()
+	}
+	return message, err
+}
+
+func (t metricsTelegram) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	response, err := t.TelegramSender.Request(c)
+	if err != nil {
+		telegramFailuresTotal.WithLabelValues(chattableName(c)).Inc()
+	}
+	return response, err
+}
+
+// Last Telegram connectivity check, reused for telegramCheckMaxAge so that
+// frequent probes do not flood the Bot API
+var (
+	telegramCheckTime time.Time
+	telegramCheckErr  error
+	telegramCheckMu   sync.Mutex
+)
+
+// Check that the Telegram Bot API can be reached with the bot token
+func (b *Bot) checkTelegram() error {
+	telegramCheckMu.Lock()
+	defer telegramCheckMu.Unlock()
+	if time.Since(telegramCheckTime) < telegramCheckMaxAge {
+		return telegramCheckErr
+	}
+	_, telegramCheckErr = b.telegram.GetMe()
+	telegramCheckTime = time.Now()
+	return telegramCheckErr
+}
+
+// Check that the data directory can be written
+func checkStorage() error {
+	dir := filepath.Dir(configFile)
+	file, err := os.CreateTemp(dir, ".healthcheck-*")
+	if err != nil {
+		return err
+	}
+	name := file.Name()
+	file.Close()
+	return os.Remove(name)
+}
+
+// Run health checks and write their results, with status 503 if one failed
+func writeHealth(w http.ResponseWriter, checks map[string]func() error) {
+	healthy := true
+	var sb strings.Builder
+	for _, name := range sortedKeys(checks) {
+		if err := checks[name](); err != nil {
+			healthy = false
+			sb.WriteString(fmt.Sprintf("%s: %v\n", name, err))
+		} else {
+			sb.WriteString(fmt.Sprintf("%s: ok\n", name))
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprint(w, sb.String())
+}
+
+// Start the HTTP server of /metrics, /healthz and /readyz in the background.
+// /healthz checks that the bot can store its data; /readyz also checks that
+// Telegram can be reached.
+func (b *Bot) startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, map[string]func() error{"storage": checkStorage})
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, map[string]func() error{"storage": checkStorage, "telegram": b.checkTelegram})
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: healthCheckTimeout}
+	go func() {
+		logInfo("Serving metrics and health checks on %s", addr)
+		if err := server.ListenAndServe(); err != nil {
+			logError("Metrics server stopped: %v", err)
+		}
+	}()
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -11,13 +12,30 @@ import (
 	"strings"
 	"time"
 	"unicode/utf8"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
-	openRouterAPI        = "https://openrouter.ai/api/v1/chat/completions"
-	openRouterCreditsAPI = "https://openrouter.ai/api/v1/credits" // Credits endpoint
+	defaultOpenRouterBaseURL = "https://openrouter.ai/api/v1"
+	openRouterChatPath       = "/chat/completions"
+	openRouterCreditsPath    = "/credits"           // Credits endpoint
+	utilityModel             = "openai/gpt-4o-mini" // Cheap model for thread titles and summaries
 )
 
+// Get the URL of an OpenRouter API endpoint. The OPENROUTER_BASE_URL
+// environment variable points the bot at another OpenAI-compatible server,
+// such as a local fake for testing.
+func openRouterURL(path string) string {
+	base := os.Getenv("OPENROUTER_BASE_URL")
+	if base == "" {
+		base = defaultOpenRouterBaseURL
+	}
+	return strings.TrimRight(base, "/") + path
+}
+
 type CreditsResponse struct {
 	Credits float64 `json:"credits"`
 	Usage   float64 `json:"usage"`
@@ -28,13 +46,21 @@ type CreditsResponse struct {
 }
 
 // GetCredits retrieves the current credits status from OpenRouter
-func GetCredits(apiToken string, requestID string) (*CreditsResponse, error) {
+func (b *Bot) GetCredits(apiToken string, requestID string) (*CreditsResponse, error) {
 	if apiToken == "" {
 		return nil, fmt.Errorf("OpenRouter API token is not set")
 	}
 
+	// Send request with timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return b.llm.Credits(ctx, apiToken, requestID)
+}
+
+// Credits retrieves the credits status of an API token from OpenRouter
+func (c *httpLLMClient) Credits(ctx context.Context, apiToken string, requestID string) (*CreditsResponse, error) {
 	// Create HTTP request
-	req, err := http.NewRequest("GET", openRouterCreditsAPI, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", openRouterURL(openRouterCreditsPath), nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
@@ -48,12 +74,7 @@ func GetCredits(apiToken string, requestID string) (*CreditsResponse, error) {
 	startTime := time.Now()
 	logDebug("[%s] Sending request to OpenRouter Credits API", requestID)
 
-	// Send request with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	req = req.WithContext(ctx)
-	resp, err := httpClient.Do(req)
+	resp, err := c.client.Do(req)
 	if err != nil {
 		logError("[%s] OpenRouter Credits API request failed: %v", requestID, err)
 		return nil, fmt.Errorf("request to Credits API failed: %v", err)
@@ -76,7 +97,7 @@ func GetCredits(apiToken string, requestID string) (*CreditsResponse, error) {
 	if resp.StatusCode != http.StatusOK {
 		logError("[%s] OpenRouter Credits API returned non-OK status: %d, body: %s",
 			requestID, resp.StatusCode, string(bodyBytes))
-		return nil, fmt.Errorf("API returned error status: %d", resp.StatusCode)
+		return nil, parseAPIError(resp.StatusCode, resp.Header, bodyBytes)
 	}
 
 	// Parse response
@@ -119,14 +140,59 @@ func FormatCreditsInfo(credits *CreditsResponse) string {
 
 // OpenRouterRequest represents a request to the OpenRouter API
 type OpenRouterRequest struct {
-	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
+	Model      string           `json:"model"`
+	Models     []string         `json:"models,omitempty"` // Fallback chain tried in order by OpenRouter
+	Route      string           `json:"route,omitempty"`
+	Messages   []Message        `json:"messages"`
+	Stream     bool             `json:"stream,omitempty"`
+	Reasoning  *ReasoningConfig `json:"reasoning,omitempty"`
+	Usage      *UsageOptions    `json:"usage,omitempty"`
+	Tools      []ToolDefinition `json:"tools,omitempty"`
+	ToolChoice string           `json:"tool_choice,omitempty"` // "none" forces an answer without tool calls
+	Plugins    []Plugin         `json:"plugins,omitempty"`
+	GenerationParams
+}
+
+// UsageOptions asks OpenRouter to include token usage and cost in the response
+type UsageOptions struct {
+	Include bool `json:"include"`
+}
+
+// Usage is the token usage reported for a request
+type Usage struct {
+	PromptTokens            int     `json:"prompt_tokens"`
+	CompletionTokens        int     `json:"completion_tokens"`
+	TotalTokens             int     `json:"total_tokens"`
+	Cost                    float64 `json:"cost,omitempty"`
+	CompletionTokensDetails *struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"completion_tokens_details,omitempty"`
+}
+
+// Get the number of tokens spent on reasoning
+func (u *Usage) reasoningTokens() int {
+	if u == nil || u.CompletionTokensDetails == nil {
+		return 0
+	}
+	return u.CompletionTokensDetails.ReasoningTokens
 }
 
 // Message represents a message in the OpenRouter API
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`   // tools the assistant asked to run
+	ToolCallID string     `json:"tool_call_id,omitempty"` // call answered by a tool message
+}
+
+// ToolCall is a request of the model to run a tool
+type ToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"` // JSON object
+	} `json:"function"`
 }
 
 // OpenRouterResponse represents a response from the OpenRouter API
@@ -135,119 +201,370 @@ type OpenRouterResponse struct {
 	Model   string `json:"model"`
 	Choices []struct {
 		Message struct {
-			Role    string `json:"role"`
-			Content string `json:"content"`
+			Role        string       `json:"role"`
+			Content     string       `json:"content"`
+			Reasoning   string       `json:"reasoning"`
+			ToolCalls   []ToolCall   `json:"tool_calls"`
+			Annotations []Annotation `json:"annotations"`
 		} `json:"message"`
 	} `json:"choices"`
+	Usage *Usage `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// OpenRouterStreamChunk represents a single server-sent event of a streamed response
+type OpenRouterStreamChunk struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Delta struct {
+			Content   string `json:"content"`
+			Reasoning string `json:"reasoning"`
+			ToolCalls []struct {
+				Index int `json:"index"`
+				ToolCall
+			} `json:"tool_calls"` // fragments of tool calls, joined by index
+			Annotations []Annotation `json:"annotations"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *Usage `json:"usage"`
 	Error *struct {
 		Message string `json:"message"`
 	} `json:"error"`
 }
 
-// Query the OpenRouter API with context for timeout control
-func queryOpenRouterWithContext(ctx context.Context, user User, query string, requestID string) (string, error) {
+// Completion is the answer produced by a model
+type Completion struct {
+	Content   string
+	Reasoning string // Thinking output of reasoning models
+	Model     string // ID of the model that actually answered (may be a fallback)
+	Usage     *Usage
+	Cached    bool       // Answer reused from the response cache
+	ToolCalls []ToolCall // Tools the model asked to run instead of answering
+	ToolsUsed []string   // Names of the tools run to produce the answer
+	Citations []Citation // Web pages the answer is based on
+}
+
+// Query the OpenRouter API with context for timeout control. The messages are
+// the conversation so far, ending with the user's query. The response is
+// streamed, so if the context is cancelled mid-generation the partial output
+// received so far is returned together with the error. Transient errors are
+// retried, and the user's fallback models are tried by OpenRouter when the
+// current model fails. Identical requests are answered from the response
+// cache when the user enabled it.
+func (b *Bot) queryOpenRouterWithContext(ctx context.Context, user User, messages []Message, requestID string) (*Completion, error) {
+	return b.queryOpenRouter(ctx, user, OpenRouterRequest{Messages: messages}, requestID)
+}
+
+// Send a chat request with the user's model, fallbacks, reasoning and
+// generation parameters filled in. Only the messages and tools are taken from
+// the given request. The request goes to the provider of the model and only
+// uses the features the provider supports.
+func (b *Bot) queryOpenRouter(ctx context.Context, user User, request OpenRouterRequest, requestID string) (*Completion, error) {
 	modelID := user.Models[user.CurrentModel]
 	if modelID == "" {
-		return "", fmt.Errorf("model ID not found for %s", user.CurrentModel)
+		return nil, fmt.Errorf("model ID not found for %s", user.CurrentModel)
 	}
+	provider, providerModel := resolveProvider(user, modelID)
+	capabilities := provider.Capabilities
 
 	// Check if context is already done
 	select {
 	case <-ctx.Done():
-		return "", fmt.Errorf("operation cancelled or timed out before API request")
+		return nil, fmt.Errorf("operation cancelled or timed out before API request")
 	default:
 		// Continue processing
 	}
 
 	// Create request
 	requestBody := OpenRouterRequest{
-		Model: modelID,
-		Messages: []Message{
-			{
-				Role:    "user",
-				Content: query,
-			},
-		},
+		Model:            providerModel,
+		Messages:         request.Messages,
+		Stream:           capabilities.Streaming,
+		GenerationParams: effectiveParams(user),
+	}
+	if capabilities.Tools {
+		requestBody.Tools = request.Tools
+		requestBody.ToolChoice = request.ToolChoice
+	}
+	if capabilities.WebSearch {
+		requestBody.Plugins = requestPlugins(user)
+	}
+	if capabilities.Reasoning {
+		requestBody.Reasoning = reasoningConfig(user.Reasoning)
+	}
+	if capabilities.Usage {
+		requestBody.Usage = &UsageOptions{Include: true}
+	}
+	if fallbacks := fallbackModelIDs(user); capabilities.Fallbacks && len(fallbacks) > 0 {
+		requestBody.Models = append([]string{providerModel}, fallbacks...)
+		requestBody.Route = "fallback"
 	}
 
 	jsonData, err := json.Marshal(requestBody)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %v", err)
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	cacheKey, cacheable := responseCacheKey(user, provider, jsonData)
+	if cacheable {
+		if completion, hit := responseCache.Get(cacheKey); hit {
+			logInfo("[%s] Answered from the response cache, model: %s", requestID, completion.Model)
+			trace.SpanFromContext(ctx).AddEvent("response cache hit")
+			completion.Cached = true
+			return completion, nil
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		completion, err := b.llm.Chat(ctx, provider, requestBody, requestID)
+		if err == nil && cacheable {
+			responseCache.Put(cacheKey, completion)
+		}
+		if err == nil || attempt >= maxAPIRetries || !isRetryableError(err) {
+			return completion, err
+		}
+
+		delay := retryDelay(attempt+1, err)
+		logInfo("[%s] Transient %s error (%v), retrying in %v (attempt %d/%d)",
+			requestID, provider.Name, err, delay, attempt+1, maxAPIRetries)
+		if sleepErr := sleepWithContext(ctx, delay); sleepErr != nil {
+			return nil, fmt.Errorf("generation interrupted: %w", sleepErr)
+		}
+	}
+}
+
+// Ask a model for a short answer, for background tasks such as titling
+// threads. The response is not streamed and failures are not retried. The
+// caller records the usage of the completion.
+func (b *Bot) queryUtilityModel(ctx context.Context, user User, modelID string, messages []Message, requestID string) (*Completion, error) {
+	provider, providerModel := resolveProvider(user, modelID)
+	request := OpenRouterRequest{Model: providerModel, Messages: messages}
+	if provider.Capabilities.Usage {
+		request.Usage = &UsageOptions{Include: true}
+	}
+	return b.llm.Chat(ctx, provider, request, requestID)
+}
+
+// Resolve the user's fallback model names to model IDs. Only OpenRouter
+// models can be fallbacks.
+func fallbackModelIDs(user User) []string {
+	primary := user.Models[user.CurrentModel]
+	var ids []string
+	for _, name := range user.FallbackModels {
+		id := user.Models[name]
+		if id == "" || id == primary {
+			continue
+		}
+		if provider, _ := resolveProvider(user, id); provider.Name != openRouterProviderName {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Chat sends a single chat completion request to a provider and reads the answer
+func (c *httpLLMClient) Chat(ctx context.Context, provider Provider, request OpenRouterRequest, requestID string) (*Completion, error) {
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
 	}
 
 	// Create HTTP request with context
-	req, err := http.NewRequestWithContext(ctx, "POST", openRouterAPI, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", provider.url(openRouterChatPath), bytes.NewBuffer(jsonData))
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %v", err)
+		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
 
 	// Set headers
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+user.OpenRouterToken)
+	if header, value := provider.authHeader(); header != "" {
+		req.Header.Set(header, value)
+	}
 	req.Header.Set("HTTP-Referer", "https://t.me/openrouter_bot")
 	req.Header.Set("X-Title", "Telegram OpenRouter Bot")
 	req.Header.Set("X-Request-ID", requestID) // Add request ID to headers for tracing
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 
 	startTime := time.Now()
-	logDebug("[%s] Sending request to OpenRouter API, model: %s", requestID, modelID)
+	logDebug("[%s] Sending request to %s API", requestID, provider.Name)
 
 	// Send request with context and timeout
-	resp, err := httpClient.Do(req)
+	client := c.client
+	if !provider.Trusted {
+		client = c.publicClient
+	}
+	resp, err := client.Do(req)
 	if err != nil {
-		if os.IsTimeout(err) || strings.Contains(err.Error(), "context deadline exceeded") ||
-			strings.Contains(err.Error(), "timeout") {
-			logError("[%s] OpenRouter API request timed out after %v", requestID, time.Since(startTime))
-			return "", fmt.Errorf("request to AI service timed out (after %v). Please try again", time.Since(startTime))
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("generation interrupted: %w", context.Cause(ctx))
 		}
-		logError("[%s] OpenRouter API request failed: %v", requestID, err)
-		return "", fmt.Errorf("request to AI service failed: %v", err)
+		if os.IsTimeout(err) || strings.Contains(err.Error(), "timeout") {
+			logError("[%s] %s API request timed out after %v", requestID, provider.Name, time.Since(startTime))
+			return nil, fmt.Errorf("request to AI service timed out (after %v). Please try again", time.Since(startTime))
+		}
+		logError("[%s] %s API request failed: %v", requestID, provider.Name, err)
+		return nil, &APIError{Kind: ErrKindNetwork, Message: err.Error()}
 	}
 	defer resp.Body.Close()
 
+	logInfo("[%s] %s API responded with status %d in %v",
+		requestID, provider.Name, resp.StatusCode, time.Since(startTime))
+
+	// Check status code
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		logError("[%s] %s API returned non-OK status: %d, body: %s",
+			requestID, provider.Name, resp.StatusCode, string(bodyBytes))
+		return nil, parseAPIError(resp.StatusCode, resp.Header, bodyBytes)
+	}
+
+	var completion *Completion
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		completion, err = readStreamResponse(ctx, resp.Body, requestID)
+	} else {
+		completion, err = readJSONResponse(ctx, resp.Body, requestID)
+	}
+	if completion != nil {
+		// Clean up any special characters or formatting issues that could cause UTF-8 problems
+		completion.Content = sanitizeResponse(completion.Content, requestID)
+		completion.Reasoning = sanitizeResponse(completion.Reasoning, requestID)
+	}
+	if err != nil {
+		return completion, err
+	}
+
+	logDebug("[%s] Received valid response from model %s in %v, length: %d chars",
+		requestID, completion.Model, time.Since(startTime), len(completion.Content))
+
+	return completion, nil
+}
+
+// Read a streamed (server-sent events) response and collect the generated content
+func readStreamResponse(ctx context.Context, body io.Reader, requestID string) (*Completion, error) {
+	var content, reasoning strings.Builder
+	var model string
+	var usage *Usage
+	var toolCalls []ToolCall
+	var citations []Citation
+	collected := func() *Completion {
+		return &Completion{Content: content.String(), Reasoning: reasoning.String(), Model: model, Usage: usage,
+			ToolCalls: toolCalls, Citations: citations}
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		// Skip empty lines and SSE comments (OpenRouter sends ": OPENROUTER PROCESSING" keep-alives)
+		if line == "" || strings.HasPrefix(line, ":") || !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk OpenRouterStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			logError("[%s] Failed to parse stream chunk: %v, data: %s", requestID, err, logContent(data))
+			continue
+		}
+
+		// Errors that happen after streaming has started are sent as a chunk
+		if chunk.Error != nil {
+			logError("[%s] API returned error message mid-stream: %s", requestID, chunk.Error.Message)
+			return collected(),
+				&APIError{Kind: classifyAPIError(0, chunk.Error.Message), Message: chunk.Error.Message}
+		}
+		if chunk.Model != "" {
+			model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+
+		for _, choice := range chunk.Choices {
+			content.WriteString(choice.Delta.Content)
+			reasoning.WriteString(choice.Delta.Reasoning)
+			citations = appendCitations(citations, choice.Delta.Annotations)
+			for _, delta := range choice.Delta.ToolCalls {
+				if delta.Index < 0 || delta.Index > len(toolCalls) {
+					logError("[%s] Tool call with unexpected index %d in stream", requestID, delta.Index)
+					continue
+				}
+				if delta.Index == len(toolCalls) {
+					toolCalls = append(toolCalls, ToolCall{Type: "function"})
+				}
+				call := &toolCalls[delta.Index]
+				if delta.ID != "" {
+					call.ID = delta.ID
+				}
+				call.Function.Name += delta.Function.Name
+				call.Function.Arguments += delta.Function.Arguments
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			logInfo("[%s] Stream interrupted after %d chars: %v", requestID, content.Len(), context.Cause(ctx))
+			return collected(),
+				fmt.Errorf("generation interrupted: %w", context.Cause(ctx))
+		}
+		logError("[%s] Failed to read response stream: %v", requestID, err)
+		return collected(), fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if content.Len() == 0 && len(toolCalls) == 0 {
+		logError("[%s] API returned empty stream", requestID)
+		return nil, fmt.Errorf("no response received from the model")
+	}
+
+	return collected(), nil
+}
+
+// Read a regular (non-streamed) JSON response
+func readJSONResponse(ctx context.Context, body io.Reader, requestID string) (*Completion, error) {
 	// Read response body with timeout
 	var bodyBytes []byte
 	bodyChan := make(chan []byte, 1)
 	errChan := make(chan error, 1)
 
 	go func() {
-		body, err := io.ReadAll(resp.Body)
+		data, err := io.ReadAll(body)
 		if err != nil {
 			errChan <- err
 			return
 		}
-		bodyChan <- body
+		bodyChan <- data
 	}()
 
 	// Wait for body read or timeout
 	select {
 	case <-ctx.Done():
 		logError("[%s] Context deadline exceeded while reading response body", requestID)
-		return "", fmt.Errorf("timeout while reading response from AI service")
+		return nil, fmt.Errorf("generation interrupted: %w", context.Cause(ctx))
 	case err := <-errChan:
 		logError("[%s] Failed to read response body: %v", requestID, err)
-		return "", fmt.Errorf("failed to read response: %v", err)
+		return nil, fmt.Errorf("failed to read response: %v", err)
 	case bodyBytes = <-bodyChan:
 		// Successfully read body
 	}
 
-	// Log API response status and timing
-	elapsed := time.Since(startTime)
-	logInfo("[%s] OpenRouter API responded with status %d in %v",
-		requestID, resp.StatusCode, elapsed)
-
-	// Check status code
-	if resp.StatusCode != http.StatusOK {
-		logError("[%s] OpenRouter API returned non-OK status: %d, body: %s",
-			requestID, resp.StatusCode, string(bodyBytes))
-		return "", fmt.Errorf("API returned error status: %d", resp.StatusCode)
-	}
-
 	// Parse response
 	var openRouterResp OpenRouterResponse
 	if err := json.Unmarshal(bodyBytes, &openRouterResp); err != nil {
 		logError("[%s] Failed to parse API response: %v, body: %s",
-			requestID, err, string(bodyBytes))
-		return "", fmt.Errorf("failed to parse response: %v", err)
+			requestID, err, logContent(bodyBytes))
+		return nil, fmt.Errorf("failed to parse response: %v", err)
 	}
 
 	// Log successful response parsing
@@ -256,23 +573,23 @@ func queryOpenRouterWithContext(ctx context.Context, user User, query string, re
 	// Check for errors
 	if openRouterResp.Error != nil {
 		logError("[%s] API returned error message: %s", requestID, openRouterResp.Error.Message)
-		return "", fmt.Errorf("API error: %s", openRouterResp.Error.Message)
+		return nil, &APIError{Kind: classifyAPIError(0, openRouterResp.Error.Message), Message: openRouterResp.Error.Message}
 	}
 
 	// Check for empty response
 	if len(openRouterResp.Choices) == 0 {
 		logError("[%s] API returned empty choices array", requestID)
-		return "", fmt.Errorf("no response received from the model")
+		return nil, fmt.Errorf("no response received from the model")
 	}
 
-	responseContent := openRouterResp.Choices[0].Message.Content
-	logDebug("[%s] Received valid response from model, length: %d chars",
-		requestID, len(responseContent))
-
-	// Clean up any special characters or formatting issues that could cause UTF-8 problems
-	responseContent = sanitizeResponse(responseContent, requestID)
-
-	return responseContent, nil
+	return &Completion{
+		Content:   openRouterResp.Choices[0].Message.Content,
+		Reasoning: openRouterResp.Choices[0].Message.Reasoning,
+		Model:     openRouterResp.Model,
+		Usage:     openRouterResp.Usage,
+		ToolCalls: openRouterResp.Choices[0].Message.ToolCalls,
+		Citations: appendCitations(nil, openRouterResp.Choices[0].Message.Annotations),
+	}, nil
 }
 
 // Sanitize response to ensure proper encoding and formatting for Telegram Markdown
@@ -293,8 +610,3 @@ func sanitizeResponse(text string, requestID string) string {
 
 	return text
 }
-
-// Log a warning message
-func logWarning(format string, v ...interface{}) {
-	logger.Printf("[WARNING] "+format, v...)
-}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"image/png"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	maxInlineTableWidth = 40   // Widest table (in characters) shown inline on a phone
+	maxInlineCodeLines  = 80   // Longer code blocks are sent as files
+	maxInlineCodeChars  = 3000 // Larger code blocks are sent as files
+)
+
+// Ways to output a table that is too wide to read inline
+const (
+	TableOutputAuto     = "auto"     // image
+	TableOutputText     = "text"     // always an aligned monospaced block
+	TableOutputCSV      = "csv"      // CSV document
+	TableOutputMarkdown = "markdown" // Markdown document
+	TableOutputImage    = "image"    // PNG image
+)
+
+// Ways to output long code blocks
+const (
+	CodeOutputAuto   = "auto"   // file when over the threshold
+	CodeOutputInline = "inline" // always in the message
+)
+
+// OutputSettings are the user's preferences for large answer elements
+type OutputSettings struct {
+	Tables string `json:"tables,omitempty"` // output of wide tables
+	Code   string `json:"code,omitempty"`   // output of long code blocks
+	Math   string `json:"math,omitempty"`   // output of LaTeX math
+}
+
+// renderOptions control how Markdown elements are rendered
+type renderOptions struct {
+	wideTables string // how to output tables wider than maxInlineTableWidth
+	codeFiles  bool   // send long code blocks as files
+	math       string // how to output LaTeX math
+}
+
+// attachment is a file sent after the message text, such as a wide table or a long code block
+type attachment struct {
+	name  string
+	data  []byte
+	image bool // send as a photo instead of a document
+}
+
+const outputUsage = `Usage:
+/output - Show output settings
+/output tables auto|text|csv|markdown|image - How to send wide tables
+/output code auto|inline - Send long code blocks as files (auto) or in the message
+/output math unicode|image|raw - Show LaTeX math as Unicode text, images or source`
+
+// Get the render options for the user's settings
+func (s OutputSettings) renderOptions() renderOptions {
+	options := renderOptions{wideTables: s.Tables, codeFiles: s.Code != CodeOutputInline, math: s.Math}
+	if options.wideTables == "" {
+		options.wideTables = TableOutputAuto
+	}
+	if options.math == "" {
+		options.math = MathOutputUnicode
+	}
+	return options
+}
+
+// Describe the output settings
+func (s OutputSettings) format() string {
+	tables, code, math := s.Tables, s.Code, s.Math
+	if tables == "" {
+		tables = TableOutputAuto
+	}
+	if code == "" {
+		code = CodeOutputAuto
+	}
+	if math == "" {
+		math = MathOutputUnicode
+	}
+	return fmt.Sprintf("Wide tables: %s\nLong code blocks: %s\nMath: %s", tables, code, math)
+}
+
+// Handle the /output command
+func (b *Bot) handleOutputCommand(chatID int64, userID int64, user User, args string, requestID string) {
+	fields := strings.Fields(strings.ToLower(args))
+	if len(fields) == 0 {
+		b.sendMessage(chatID, user.Output.format()+"\n\n"+outputUsage, requestID)
+		return
+	}
+	if len(fields) != 2 {
+		b.sendMessage(chatID, outputUsage, requestID)
+		return
+	}
+
+	switch fields[0] {
+	case "tables":
+		switch fields[1] {
+		case TableOutputAuto, TableOutputText, TableOutputCSV, TableOutputMarkdown, TableOutputImage:
+			user.Output.Tables = fields[1]
+		default:
+			b.sendMessage(chatID, outputUsage, requestID)
+			return
+		}
+	case "code":
+		switch fields[1] {
+		case CodeOutputAuto, CodeOutputInline:
+			user.Output.Code = fields[1]
+		default:
+			b.sendMessage(chatID, outputUsage, requestID)
+			return
+		}
+	case "math":
+		switch fields[1] {
+		case MathOutputUnicode, MathOutputImage, MathOutputRaw:
+			user.Output.Math = fields[1]
+		default:
+			b.sendMessage(chatID, outputUsage, requestID)
+			return
+		}
+	default:
+		b.sendMessage(chatID, outputUsage, requestID)
+		return
+	}
+
+	modifyUser(userID, requestID, func(stored *User) { stored.Output = user.Output })
+	b.sendMessage(chatID, "Output settings updated.\n\n"+user.Output.format(), requestID)
+}
+
+// Get the width of a table laid out as aligned monospaced text
+func tableTextWidth(widths []int) int {
+	total := 0
+	for i, w := range widths {
+		if i > 0 {
+			total += 3 // " | "
+		}
+		total += w
+	}
+	return total
+}
+
+// Get the width of each column in characters
+func tableColumnWidths(header []string, rows [][]string) []int {
+	widths := make([]int, len(header))
+	for _, row := range append([][]string{header}, rows...) {
+		for col := 0; col < len(widths) && col < len(row); col++ {
+			if w := len([]rune(row[col])); w > widths[col] {
+				widths[col] = w
+			}
+		}
+	}
+	return widths
+}
+
+// Lay out a table as aligned monospaced text
+func formatAlignedTable(header []string, rows [][]string, aligns []string) string {
+	widths := tableColumnWidths(header, rows)
+
+	formatRow := func(row []string) string {
+		cells := make([]string, len(widths))
+		for col := range widths {
+			cell := ""
+			if col < len(row) {
+				cell = row[col]
+			}
+			cells[col] = padCell(cell, widths[col], alignmentOf(aligns, col))
+		}
+		return strings.TrimRight(strings.Join(cells, " | "), " ")
+	}
+
+	var sb strings.Builder
+	sb.WriteString(formatRow(header) + "\n")
+	separators := make([]string, len(widths))
+	for col, w := range widths {
+		separators[col] = strings.Repeat("-", w)
+	}
+	sb.WriteString(strings.Join(separators, "-+-") + "\n")
+	for i, row := range rows {
+		sb.WriteString(formatRow(row))
+		if i < len(rows)-1 {
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+// Pad a cell to the width with the given alignment
+func padCell(cell string, width int, align string) string {
+	gap := width - len([]rune(cell))
+	if gap <= 0 {
+		return cell
+	}
+	switch align {
+	case "right":
+		return strings.Repeat(" ", gap) + cell
+	case "center":
+		return strings.Repeat(" ", gap/2) + cell + strings.Repeat(" ", gap-gap/2)
+	}
+	return cell + strings.Repeat(" ", gap)
+}
+
+// Build a table attachment in the requested format. Tables too large for an
+// image are sent as CSV instead.
+func tableAttachment(header []string, rows [][]string, aligns []string, format string, number int) (attachment, error) {
+	base := fmt.Sprintf("table-%d", number)
+	switch format {
+	case TableOutputCSV:
+		return tableCSVAttachment(base, header, rows)
+	case TableOutputMarkdown:
+		return attachment{name: base + ".md", data: []byte(formatMarkdownTable(header, rows, aligns))}, nil
+	default:
+		data, err := renderTablePNG(header, rows, aligns)
+		if errors.Is(err, errTableTooLarge) {
+			logInfo("Sending table %d as CSV: %v", number, err)
+			return tableCSVAttachment(base, header, rows)
+		}
+		if err != nil {
+			return attachment{}, err
+		}
+		return imageAttachment(base+".png", data), nil
+	}
+}
+
+// Build a CSV attachment of a table
+func tableCSVAttachment(base string, header []string, rows [][]string) (attachment, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write(header)
+	writer.WriteAll(rows)
+	if err := writer.Error(); err != nil {
+		return attachment{}, fmt.Errorf("failed to write CSV: %v", err)
+	}
+	return attachment{name: base + ".csv", data: buf.Bytes()}, nil
+}
+
+// Build an attachment for a PNG image, sent as a photo if Telegram accepts its size
+func imageAttachment(name string, data []byte) attachment {
+	photo := false
+	if cfg, err := png.DecodeConfig(bytes.NewReader(data)); err == nil {
+		photo = fitsTelegramPhoto(cfg.Width, cfg.Height)
+	}
+	return attachment{name: name, data: data, image: photo}
+}
+
+// Lay out a table as an aligned Markdown table
+func formatMarkdownTable(header []string, rows [][]string, aligns []string) string {
+	escape := func(row []string) []string {
+		escaped := make([]string, len(row))
+		for i, cell := range row {
+			escaped[i] = strings.ReplaceAll(cell, "|", `\|`)
+		}
+		return escaped
+	}
+	header = escape(header)
+	escapedRows := make([][]string, len(rows))
+	for i, row := range rows {
+		escapedRows[i] = escape(row)
+	}
+	rows = escapedRows
+
+	widths := tableColumnWidths(header, rows)
+	for col := range widths {
+		widths[col] = max(widths[col], 3)
+	}
+
+	formatRow := func(row []string) string {
+		cells := make([]string, len(widths))
+		for col := range widths {
+			cell := ""
+			if col < len(row) {
+				cell = row[col]
+			}
+			cells[col] = padCell(cell, widths[col], alignmentOf(aligns, col))
+		}
+		return "| " + strings.Join(cells, " | ") + " |\n"
+	}
+
+	var sb strings.Builder
+	sb.WriteString(formatRow(header))
+	separators := make([]string, len(widths))
+	for col, w := range widths {
+		switch alignmentOf(aligns, col) {
+		case "right":
+			separators[col] = strings.Repeat("-", w-1) + ":"
+		case "center":
+			separators[col] = ":" + strings.Repeat("-", w-2) + ":"
+		default:
+			separators[col] = strings.Repeat("-", w)
+		}
+	}
+	sb.WriteString("| " + strings.Join(separators, " | ") + " |\n")
+	for _, row := range rows {
+		sb.WriteString(formatRow(row))
+	}
+	return sb.String()
+}
+
+// Check whether a code block is too long to show inline
+func isLongCode(code string) bool {
+	return strings.Count(code, "\n")+1 > maxInlineCodeLines || len([]rune(code)) > maxInlineCodeChars
+}
+
+// Get a file name for a code block from its fence language
+func codeFileName(language string, number int) string {
+	language = strings.ToLower(strings.TrimSpace(language))
+	switch language {
+	case "dockerfile":
+		return "Dockerfile"
+	case "makefile", "make":
+		return "Makefile"
+	}
+	extension, known := codeExtensions[language]
+	if !known {
+		extension = "txt"
+	}
+	return fmt.Sprintf("code-%d.%s", number, extension)
+}
+
+// File extensions for common fence languages
+var codeExtensions = map[string]string{
+	"go": "go", "golang": "go",
+	"python": "py", "py": "py",
+	"javascript": "js", "js": "js", "jsx": "jsx",
+	"typescript": "ts", "ts": "ts", "tsx": "tsx",
+	"java": "java", "kotlin": "kt", "kt": "kt", "scala": "scala",
+	"c": "c", "h": "h", "cpp": "cpp", "c++": "cpp", "cc": "cpp", "hpp": "hpp",
+	"csharp": "cs", "c#": "cs", "cs": "cs",
+	"rust": "rs", "rs": "rs", "swift": "swift", "dart": "dart",
+	"ruby": "rb", "rb": "rb", "php": "php", "perl": "pl", "lua": "lua", "r": "r",
+	"haskell": "hs", "hs": "hs", "elixir": "ex", "erlang": "erl", "clojure": "clj",
+	"bash": "sh", "sh": "sh", "shell": "sh", "zsh": "sh", "powershell": "ps1", "ps1": "ps1",
+	"sql": "sql", "graphql": "graphql", "proto": "proto", "protobuf": "proto",
+	"html": "html", "css": "css", "scss": "scss", "xml": "xml", "svg": "svg",
+	"json": "json", "yaml": "yaml", "yml": "yaml", "toml": "toml", "ini": "ini",
+	"markdown": "md", "md": "md", "latex": "tex", "tex": "tex",
+	"diff": "diff", "patch": "patch", "text": "txt", "plaintext": "txt",
+}
+
+// Send files that belong to an answer
+func (b *Bot) sendAttachments(chatID int64, attachments []attachment, requestID string) {
+	for _, file := range attachments {
+		data := tgbotapi.FileBytes{Name: file.name, Bytes: file.data}
+
+		if file.image {
+			if _, err := b.telegram.Send(tgbotapi.NewPhoto(chatID, data)); err == nil {
+				logDebug("[%s] Sent image attachment %s", requestID, file.name)
+				continue
+			} else {
+				logError("[%s] Failed to send %s as photo, sending as document: %v", requestID, file.name, err)
+			}
+		}
+
+		if _, err := b.telegram.Send(tgbotapi.NewDocument(chatID, data)); err != nil {
+			logError("[%s] Failed to send attachment %s: %v", requestID, file.name, err)
+			b.sendMessage(chatID, fmt.Sprintf("⚠️ Could not send the attachment %s.", file.name), requestID)
+			continue
+		}
+		logDebug("[%s] Sent document attachment %s", requestID, file.name)
+	}
+}
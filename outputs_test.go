@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestFormatAlignedTable(t *testing.T) {
+	header := []string{"Name", "Qty", "Note"}
+	rows := [][]string{{"apple", "3", "red"}, {"kiwi", "12", "green"}}
+
+	got := formatAlignedTable(header, rows, []string{"left", "right", "center"})
+	want := "Name  | Qty | Note\n" +
+		"------+-----+------\n" +
+		"apple |   3 |  red\n" +
+		"kiwi  |  12 | green"
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFormatAlignedTableMissingCells(t *testing.T) {
+	got := formatAlignedTable([]string{"A", "B"}, [][]string{{"long value"}}, nil)
+	want := "A          | B\n" +
+		"-----------+--\n" +
+		"long value |"
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWideTableThreshold(t *testing.T) {
+	table := func(width int) string {
+		return "| h |\n|---|\n| " + strings.Repeat("x", width) + " |"
+	}
+	options := renderOptions{wideTables: TableOutputCSV}
+
+	if _, attachments := renderMarkdown(table(maxInlineTableWidth), options); len(attachments) != 0 {
+		t.Errorf("a table %d characters wide was attached, want it inline", maxInlineTableWidth)
+	}
+	tokens, attachments := renderMarkdown(table(maxInlineTableWidth+1), options)
+	if len(attachments) != 1 || attachments[0].name != "table-1.csv" {
+		t.Fatalf("got attachments %v for a table %d characters wide, want table-1.csv", attachments, maxInlineTableWidth+1)
+	}
+	if html := serializeHTMLTokens(tokens); !strings.Contains(html, "Table 1 attached as table-1.csv") {
+		t.Errorf("got %q, want a note about the attached table", html)
+	}
+
+	options.wideTables = TableOutputText
+	if _, attachments := renderMarkdown(table(maxInlineTableWidth+1), options); len(attachments) != 0 {
+		t.Error("a wide table was attached with the text output")
+	}
+}
+
+func TestCodeFileName(t *testing.T) {
+	tests := []struct {
+		language string
+		want     string
+	}{
+		{"go", "code-1.go"},
+		{"Python", "code-1.py"},
+		{" c++ ", "code-1.cpp"},
+		{"yml", "code-1.yaml"},
+		{"dockerfile", "Dockerfile"},
+		{"make", "Makefile"},
+		{"", "code-1.txt"},
+		{"brainfuck", "code-1.txt"},
+	}
+	for _, test := range tests {
+		if got := codeFileName(test.language, 1); got != test.want {
+			t.Errorf("codeFileName(%q) = %q, want %q", test.language, got, test.want)
+		}
+	}
+}
+
+func TestTableAttachment(t *testing.T) {
+	header := []string{"City", "Population"}
+	rows := [][]string{{"Paris, France", "2102650"}, {"Oslo", "709037"}}
+	aligns := []string{"left", "right"}
+
+	tests := []struct {
+		format string
+		name   string
+		image  bool
+		data   string // expected content of text files
+	}{
+		{TableOutputCSV, "table-2.csv", false, "City,Population\n\"Paris, France\",2102650\nOslo,709037\n"},
+		{TableOutputMarkdown, "table-2.md", false, "| City          | Population |\n| ------------- | ---------: |\n| Paris, France |    2102650 |\n| Oslo          |     709037 |\n"},
+		{TableOutputImage, "table-2.png", true, ""},
+		{TableOutputAuto, "table-2.png", true, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			file, err := tableAttachment(header, rows, aligns, test.format, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if file.name != test.name || file.image != test.image {
+				t.Errorf("got %s (image: %v), want %s (image: %v)", file.name, file.image, test.name, test.image)
+			}
+			if test.image {
+				if _, err := png.Decode(bytes.NewReader(file.data)); err != nil {
+					t.Errorf("the image is not a valid PNG: %v", err)
+				}
+			} else if string(file.data) != test.data {
+				t.Errorf("got\n%s\nwant\n%s", file.data, test.data)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// GenerationParams holds the optional sampling parameters sent with a request.
+// Unset (nil/empty) parameters are left to the model's defaults.
+type GenerationParams struct {
+	Temperature      *float64        `json:"temperature,omitempty"`
+	TopP             *float64        `json:"top_p,omitempty"`
+	MaxTokens        *int            `json:"max_tokens,omitempty"`
+	Stop             []string        `json:"stop,omitempty"`
+	Seed             *int            `json:"seed,omitempty"`
+	FrequencyPenalty *float64        `json:"frequency_penalty,omitempty"`
+	PresencePenalty  *float64        `json:"presence_penalty,omitempty"`
+	ResponseFormat   *ResponseFormat `json:"response_format,omitempty"`
+}
+
+// ResponseFormat asks the model for a specific output format
+type ResponseFormat struct {
+	Type string `json:"type"` // "text" or "json_object"
+}
+
+const maxStopSequences = 4
+
+// Parameter names accepted by /params, with their allowed values
+var paramDescriptions = []struct {
+	name        string
+	description string
+}{
+	{"temperature", "0 to 2, lower is more deterministic"},
+	{"top_p", "greater than 0 up to 1"},
+	{"max_tokens", "positive integer, limits the answer length"},
+	{"stop", fmt.Sprintf("up to %d stop sequences separated by spaces (use \\n for a newline)", maxStopSequences)},
+	{"seed", "integer, for reproducible sampling"},
+	{"frequency_penalty", "-2 to 2"},
+	{"presence_penalty", "-2 to 2"},
+	{"response_format", "text or json"},
+}
+
+const paramsUsage = `Usage:
+/params - Show parameters for the current model
+/params <name> <value> - Set a default parameter
+/params <name> reset - Remove a default parameter
+/params @<model> <name> <value> - Override a parameter for one model
+/params @<model> <name> reset - Remove a model override
+/params reset or /params @<model> reset - Remove all parameters`
+
+// Return params with the set fields of override applied on top
+func (p GenerationParams) merge(override GenerationParams) GenerationParams {
+	if override.Temperature != nil {
+		p.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		p.TopP = override.TopP
+	}
+	if override.MaxTokens != nil {
+		p.MaxTokens = override.MaxTokens
+	}
+	if len(override.Stop) > 0 {
+		p.Stop = override.Stop
+	}
+	if override.Seed != nil {
+		p.Seed = override.Seed
+	}
+	if override.FrequencyPenalty != nil {
+		p.FrequencyPenalty = override.FrequencyPenalty
+	}
+	if override.PresencePenalty != nil {
+		p.PresencePenalty = override.PresencePenalty
+	}
+	if override.ResponseFormat != nil {
+		p.ResponseFormat = override.ResponseFormat
+	}
+	return p
+}
+
+// Check whether no parameter is set
+func (p GenerationParams) isEmpty() bool {
+	return p.Temperature == nil && p.TopP == nil && p.MaxTokens == nil && len(p.Stop) == 0 &&
+		p.Seed == nil && p.FrequencyPenalty == nil && p.PresencePenalty == nil && p.ResponseFormat == nil
+}
+
+// Get the parameters to use for the user's current model
+func effectiveParams(user User) GenerationParams {
+	return user.Params.merge(user.ModelParams[user.CurrentModel])
+}
+
+// Validate and set a single parameter
+func (p *GenerationParams) set(name string, value string) error {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return fmt.Errorf("no value given for %s", name)
+	}
+
+	switch name {
+	case "temperature":
+		v, err := parseFloatInRange(name, value, 0, 2)
+		if err != nil {
+			return err
+		}
+		p.Temperature = &v
+	case "top_p":
+		v, err := parseFloatInRange(name, value, 0, 1)
+		if err != nil {
+			return err
+		}
+		if v == 0 {
+			return fmt.Errorf("top_p must be greater than 0")
+		}
+		p.TopP = &v
+	case "max_tokens":
+		v, err := strconv.Atoi(value)
+		if err != nil || v < 1 {
+			return fmt.Errorf("max_tokens must be a positive integer")
+		}
+		p.MaxTokens = &v
+	case "stop":
+		sequences := strings.Fields(value)
+		if len(sequences) > maxStopSequences {
+			return fmt.Errorf("at most %d stop sequences are allowed", maxStopSequences)
+		}
+		for i, seq := range sequences {
+			sequences[i] = strings.ReplaceAll(seq, `\n`, "\n")
+		}
+		p.Stop = sequences
+	case "seed":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("seed must be an integer")
+		}
+		p.Seed = &v
+	case "frequency_penalty":
+		v, err := parseFloatInRange(name, value, -2, 2)
+		if err != nil {
+			return err
+		}
+		p.FrequencyPenalty = &v
+	case "presence_penalty":
+		v, err := parseFloatInRange(name, value, -2, 2)
+		if err != nil {
+			return err
+		}
+		p.PresencePenalty = &v
+	case "response_format":
+		switch strings.ToLower(value) {
+		case "text":
+			p.ResponseFormat = &ResponseFormat{Type: "text"}
+		case "json", "json_object":
+			p.ResponseFormat = &ResponseFormat{Type: "json_object"}
+		default:
+			return fmt.Errorf("response_format must be text or json")
+		}
+	default:
+		return fmt.Errorf("unknown parameter '%s'", name)
+	}
+	return nil
+}
+
+// Remove a single parameter
+func (p *GenerationParams) reset(name string) error {
+	switch name {
+	case "temperature":
+		p.Temperature = nil
+	case "top_p":
+		p.TopP = nil
+	case "max_tokens":
+		p.MaxTokens = nil
+	case "stop":
+		p.Stop = nil
+	case "seed":
+		p.Seed = nil
+	case "frequency_penalty":
+		p.FrequencyPenalty = nil
+	case "presence_penalty":
+		p.PresencePenalty = nil
+	case "response_format":
+		p.ResponseFormat = nil
+	default:
+		return fmt.Errorf("unknown parameter '%s'", name)
+	}
+	return nil
+}
+
+// Format the set parameters, one per line
+func (p GenerationParams) format() string {
+	var sb strings.Builder
+	if p.Temperature != nil {
+		sb.WriteString(fmt.Sprintf("• temperature: %g\n", *p.Temperature))
+	}
+	if p.TopP != nil {
+		sb.WriteString(fmt.Sprintf("• top_p: %g\n", *p.TopP))
+	}
+	if p.MaxTokens != nil {
+		sb.WriteString(fmt.Sprintf("• max_tokens: %d\n", *p.MaxTokens))
+	}
+	if len(p.Stop) > 0 {
+		sb.WriteString(fmt.Sprintf("• stop: %q\n", p.Stop))
+	}
+	if p.Seed != nil {
+		sb.WriteString(fmt.Sprintf("• seed: %d\n", *p.Seed))
+	}
+	if p.FrequencyPenalty != nil {
+		sb.WriteString(fmt.Sprintf("• frequency_penalty: %g\n", *p.FrequencyPenalty))
+	}
+	if p.PresencePenalty != nil {
+		sb.WriteString(fmt.Sprintf("• presence_penalty: %g\n", *p.PresencePenalty))
+	}
+	if p.ResponseFormat != nil {
+		sb.WriteString(fmt.Sprintf("• response_format: %s\n", p.ResponseFormat.Type))
+	}
+	if sb.Len() == 0 {
+		return "• (model defaults)\n"
+	}
+	return sb.String()
+}
+
+// Parse a float and check that it is within [min, max]. NaN and infinities
+// are rejected since they cannot be sent in a JSON request.
+func parseFloatInRange(name string, value string, min float64, max float64) (float64, error) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) || v < min || v > max {
+		return 0, fmt.Errorf("%s must be a number from %g to %g", name, min, max)
+	}
+	return v, nil
+}
+
+// Handle the /params command
+func (b *Bot) handleParamsCommand(chatID int64, userID int64, user User, args string, requestID string) {
+	fields := strings.Fields(args)
+
+	// Show the parameters
+	if len(fields) == 0 {
+		var sb strings.Builder
+		sb.WriteString("Default parameters:\n")
+		sb.WriteString(user.Params.format())
+		if override, exists := user.ModelParams[user.CurrentModel]; exists {
+			sb.WriteString(fmt.Sprintf("\nOverrides for %s:\n", user.CurrentModel))
+			sb.WriteString(override.format())
+		}
+		sb.WriteString(fmt.Sprintf("\nEffective for %s:\n", user.CurrentModel))
+		sb.WriteString(effectiveParams(user).format())
+		sb.WriteString("\nAvailable parameters:\n")
+		for _, param := range paramDescriptions {
+			sb.WriteString(fmt.Sprintf("• %s - %s\n", param.name, param.description))
+		}
+		sb.WriteString("\n" + paramsUsage)
+		b.sendMessage(chatID, sb.String(), requestID)
+		return
+	}
+
+	// Select the parameter set to edit
+	params := user.Params
+	modelName := ""
+	if strings.HasPrefix(fields[0], "@") {
+		modelName = strings.TrimPrefix(fields[0], "@")
+		if _, exists := user.Models[modelName]; !exists {
+			b.sendMessage(chatID, fmt.Sprintf("Model '%s' not found. Use /models to see available models.", modelName), requestID)
+			return
+		}
+		params = user.ModelParams[modelName]
+		fields = fields[1:]
+	}
+
+	var reply string
+	switch {
+	case len(fields) == 1 && fields[0] == "reset":
+		params = GenerationParams{}
+		reply = "All parameters removed."
+	case len(fields) < 2:
+		b.sendMessage(chatID, paramsUsage, requestID)
+		return
+	case len(fields) == 2 && fields[1] == "reset":
+		if err := params.reset(fields[0]); err != nil {
+			b.sendMessage(chatID, fmt.Sprintf("Error: %v\n\n%s", err, paramsUsage), requestID)
+			return
+		}
+		reply = fmt.Sprintf("Parameter %s removed.", fields[0])
+	default:
+		if err := params.set(fields[0], strings.Join(fields[1:], " ")); err != nil {
+			b.sendMessage(chatID, fmt.Sprintf("Error: %v", err), requestID)
+			return
+		}
+		reply = fmt.Sprintf("Parameter %s set.", fields[0])
+	}
+
+	modifyUser(userID, requestID, func(stored *User) {
+		switch {
+		case modelName == "":
+			stored.Params = params
+		case params.isEmpty():
+			delete(stored.ModelParams, modelName)
+		default:
+			if stored.ModelParams == nil {
+				stored.ModelParams = make(map[string]GenerationParams)
+			}
+			stored.ModelParams[modelName] = params
+		}
+	})
+	if modelName != "" {
+		reply += fmt.Sprintf(" (for model %s)", modelName)
+	}
+	b.sendMessage(chatID, reply, requestID)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const openRouterProviderName = "openrouter"
+
+// Ways a provider expects the API key
+const (
+	AuthBearer = "bearer" // Authorization: Bearer <key> (default)
+	AuthNone   = "none"   // no authentication
+	AuthHeader = "header" // the key as the value of a custom header, as in header:X-Api-Key
+)
+
+const providerUsage = `Usage:
+/provider - List the API providers
+/provider add <name> <base_url> [key=<api_key>] [auth=bearer|none|header:<Name>] [caps=<capabilities>] - Register an OpenAI-compatible server
+/provider remove <name> - Remove one of your providers
+
+Use a provider's models with /addmodel <your_name> <provider>:<model>, for example /addmodel coder local:qwen2.5-coder:7b.
+Capabilities (comma separated, default stream,tools): stream, tools, usage, reasoning, web, fallbacks.`
+
+// Names of providers: lower case letters, digits, dashes and underscores
+var providerNameRegex = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// ProviderCapabilities are the API features a provider supports. Requests
+// only use the features the provider has.
+type ProviderCapabilities struct {
+	Streaming bool `json:"streaming"`
+	Tools     bool `json:"tools"`
+	Usage     bool `json:"usage"`      // reports token usage and cost when asked with usage.include
+	Reasoning bool `json:"reasoning"`  // accepts the OpenRouter reasoning parameter
+	WebSearch bool `json:"web_search"` // supports the OpenRouter web plugin
+	Fallbacks bool `json:"fallbacks"`  // tries a chain of models with models and route
+}
+
+// Provider is an OpenAI-compatible chat completions API
+type Provider struct {
+	Name         string               `json:"name"`
+	BaseURL      string               `json:"base_url"`             // such as http://localhost:11434/v1
+	AuthStyle    string               `json:"auth_style,omitempty"` // bearer (default), none or header:<Name>
+	APIKey       string               `json:"api_key,omitempty"`
+	Capabilities ProviderCapabilities `json:"capabilities"`
+	Trusted      bool                 `json:"trusted,omitempty"` // registered by an admin, may be on a private network
+}
+
+// Get the OpenRouter provider, authenticated with the user's token
+func openRouterProvider(user User) Provider {
+	return Provider{
+		Name:    openRouterProviderName,
+		BaseURL: openRouterURL(""),
+		APIKey:  user.OpenRouterToken,
+		Trusted: true,
+		Capabilities: ProviderCapabilities{
+			Streaming: true, Tools: true, Usage: true, Reasoning: true, WebSearch: true, Fallbacks: true,
+		},
+	}
+}
+
+// Get the providers available to a user: OpenRouter, the providers of the
+// bot configuration and the user's own providers, which take precedence
+func userProviders(user User) map[string]Provider {
+	providers := make(map[string]Provider)
+	configMu.Lock()
+	for name, provider := range config.Providers {
+		// Set up by the operator of the bot
+		provider.Trusted = true
+		providers[name] = provider
+	}
+	configMu.Unlock()
+
+	maps.Copy(providers, user.Providers)
+	providers[openRouterProviderName] = openRouterProvider(user)
+	return providers
+}
+
+// Find the provider of a model ID. IDs of other providers are written as
+// <provider>:<model>; all other IDs are OpenRouter models. Returns the
+// provider and the model ID to send to it.
+func resolveProvider(user User, modelID string) (Provider, string) {
+	if name, model, found := strings.Cut(modelID, ":"); found && providerNameRegex.MatchString(name) {
+		if provider, exists := userProviders(user)[name]; exists {
+			return provider, model
+		}
+	}
+	return openRouterProvider(user), modelID
+}
+
+// Get the provider of the user's current model
+func currentProvider(user User) Provider {
+	provider, _ := resolveProvider(user, user.Models[user.CurrentModel])
+	return provider
+}
+
+// Get the model for background tasks such as titles and summaries. Threads
+// with a model of another provider use that model, so that their messages
+// are not sent to OpenRouter.
+func utilityModelID(user User) string {
+	modelID := user.Models[user.CurrentModel]
+	if provider, _ := resolveProvider(user, modelID); provider.Name != openRouterProviderName {
+		return modelID
+	}
+	return utilityModel
+}
+
+// Check whether requests to the provider need the user's OpenRouter token
+func (p Provider) needsOpenRouterToken() bool {
+	return p.Name == openRouterProviderName
+}
+
+// Get the URL of an endpoint of the provider
+func (p Provider) url(path string) string {
+	return strings.TrimRight(p.BaseURL, "/") + path
+}
+
+// Get the header carrying the API key and its value. The header is empty
+// when the provider needs no authentication.
+func (p Provider) authHeader() (string, string) {
+	switch {
+	case p.AuthStyle == AuthNone || p.APIKey == "":
+		return "", ""
+	case strings.HasPrefix(p.AuthStyle, AuthHeader+":"):
+		return strings.TrimPrefix(p.AuthStyle, AuthHeader+":"), p.APIKey
+	}
+	return "Authorization", "Bearer " + p.APIKey
+}
+
+// Parse a comma-separated list of capabilities
+func parseCapabilities(list string) (ProviderCapabilities, error) {
+	var capabilities ProviderCapabilities
+	for _, name := range strings.Split(list, ",") {
+		switch strings.TrimSpace(name) {
+		case "stream", "streaming":
+			capabilities.Streaming = true
+		case "tools":
+			capabilities.Tools = true
+		case "usage":
+			capabilities.Usage = true
+		case "reasoning":
+			capabilities.Reasoning = true
+		case "web":
+			capabilities.WebSearch = true
+		case "fallbacks":
+			capabilities.Fallbacks = true
+		case "", "none":
+		default:
+			return capabilities, fmt.Errorf("unknown capability %q", name)
+		}
+	}
+	return capabilities, nil
+}
+
+// Describe the capabilities of a provider
+func (c ProviderCapabilities) String() string {
+	var names []string
+	for _, capability := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"stream", c.Streaming}, {"tools", c.Tools}, {"usage", c.Usage},
+		{"reasoning", c.Reasoning}, {"web", c.WebSearch}, {"fallbacks", c.Fallbacks},
+	} {
+		if capability.enabled {
+			names = append(names, capability.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// Parse the arguments of /provider add into a provider. Providers of users
+// who are not trusted cannot be on private addresses.
+func parseProvider(fields []string, trusted bool) (Provider, error) {
+	if len(fields) < 2 {
+		return Provider{}, fmt.Errorf("name the provider and its base URL")
+	}
+	provider := Provider{
+		Name:         strings.ToLower(fields[0]),
+		BaseURL:      strings.TrimRight(fields[1], "/"),
+		AuthStyle:    AuthBearer,
+		Capabilities: ProviderCapabilities{Streaming: true, Tools: true},
+		Trusted:      trusted,
+	}
+	if !providerNameRegex.MatchString(provider.Name) {
+		return Provider{}, fmt.Errorf("provider names can only contain lower case letters, digits, - and _")
+	}
+	if provider.Name == openRouterProviderName {
+		return Provider{}, fmt.Errorf("%q is the built-in provider", provider.Name)
+	}
+	parsed, err := url.Parse(provider.BaseURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return Provider{}, fmt.Errorf("the base URL must be an http or https URL, such as http://localhost:11434/v1")
+	}
+	// Host names are checked when connecting, since they can resolve to
+	// another address later
+	if ip := net.ParseIP(parsed.Hostname()); !trusted && (parsed.Hostname() == "localhost" || ip != nil && !isPublicIP(ip)) {
+		return Provider{}, fmt.Errorf("only admins can register providers on local or private addresses")
+	}
+
+	for _, option := range fields[2:] {
+		key, value, _ := strings.Cut(option, "=")
+		switch strings.ToLower(key) {
+		case "key":
+			provider.APIKey = value
+		case "auth":
+			if value != AuthBearer && value != AuthNone && !(strings.HasPrefix(value, AuthHeader+":") && len(value) > len(AuthHeader)+1) {
+				return Provider{}, fmt.Errorf("auth must be bearer, none or header:<Name>")
+			}
+			provider.AuthStyle = value
+		case "caps":
+			if provider.Capabilities, err = parseCapabilities(strings.ToLower(value)); err != nil {
+				return Provider{}, err
+			}
+		default:
+			return Provider{}, fmt.Errorf("unknown option %q", option)
+		}
+	}
+	return provider, nil
+}
+
+// Handle the /provider command
+func (b *Bot) handleProviderCommand(chatID int64, userID int64, user User, args string, requestID string) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		b.sendMessage(chatID, formatProviders(user)+"\n\n"+providerUsage, requestID)
+		return
+	}
+
+	switch strings.ToLower(fields[0]) {
+	case "add":
+		provider, err := parseProvider(fields[1:], isAdmin(userID))
+		if err != nil {
+			b.sendMessage(chatID, "❌ "+err.Error()+"\n\n"+providerUsage, requestID)
+			return
+		}
+		addLogSecret(provider.APIKey)
+		modifyUser(userID, requestID, func(stored *User) {
+			if stored.Providers == nil {
+				stored.Providers = make(map[string]Provider)
+			}
+			stored.Providers[provider.Name] = provider
+		})
+		logInfo("[%s] User %d registered provider %s at %s", requestID, userID, provider.Name, provider.BaseURL)
+		b.sendMessage(chatID, fmt.Sprintf("Provider %s added (%s, capabilities: %s).\nAdd its models with /addmodel <your_name> %s:<model>.",
+			provider.Name, provider.BaseURL, provider.Capabilities, provider.Name), requestID)
+	case "remove":
+		if len(fields) != 2 {
+			b.sendMessage(chatID, "Usage: /provider remove <name>", requestID)
+			return
+		}
+		name := strings.ToLower(fields[1])
+		if _, exists := user.Providers[name]; !exists {
+			b.sendMessage(chatID, fmt.Sprintf("❌ You have no provider %q.", name), requestID)
+			return
+		}
+		modifyUser(userID, requestID, func(stored *User) { delete(stored.Providers, name) })
+		b.sendMessage(chatID, fmt.Sprintf("Provider %s removed.", name), requestID)
+	default:
+		b.sendMessage(chatID, providerUsage, requestID)
+	}
+}
+
+// Describe the providers available to a user
+func formatProviders(user User) string {
+	providers := userProviders(user)
+	var sb strings.Builder
+	sb.WriteString("Providers:\n")
+	for _, name := range sortedKeys(providers) {
+		provider := providers[name]
+		source := "bot"
+		if name == openRouterProviderName {
+			source = "built-in"
+		} else if _, own := user.Providers[name]; own {
+			source = "yours"
+		}
+		sb.WriteString(fmt.Sprintf("• %s (%s): %s, capabilities: %s\n", name, source, provider.BaseURL, provider.Capabilities))
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	maxConcurrentRequests = 8  // Global cap on messages processed at the same time
+	maxQueuedPerChat      = 10 // Maximum number of pending messages per chat
+	rateLimitPerMinute    = 10 // Sustained AI requests per user per minute
+	rateLimitBurst        = 5  // AI requests a user can send in a quick burst
+)
+
+// chatJob is a single message waiting to be handled
+type chatJob struct {
+	message   *tgbotapi.Message
+	requestID string
+	queuedAt  time.Time
+}
+
+// chatQueue holds the pending messages of one chat. Messages of a chat are
+// handled one at a time so that replies arrive in the order they were asked.
+type chatQueue struct {
+	pending []chatJob
+	running bool
+}
+
+var (
+	chatQueues      = make(map[int64]*chatQueue)
+	chatQueuesMu    sync.Mutex
+	workerSlots     = make(chan struct{}, maxConcurrentRequests)
+	userRateLimiter = newRateLimiter(rateLimitPerMinute, rateLimitBurst)
+)
+
+// Add a message to its chat queue. Returns the number of messages ahead of it
+// (0 means it is handled right away) and false if the queue is full.
+func (b *Bot) enqueueMessage(message *tgbotapi.Message, requestID string) (int, bool) {
+	chatID := message.Chat.ID
+
+	chatQueuesMu.Lock()
+	defer chatQueuesMu.Unlock()
+
+	queue, exists := chatQueues[chatID]
+	if !exists {
+		queue = &chatQueue{}
+		chatQueues[chatID] = queue
+	}
+
+	if len(queue.pending) >= maxQueuedPerChat {
+		return 0, false
+	}
+
+	position := len(queue.pending)
+	if queue.running {
+		position++
+	}
+	queue.pending = append(queue.pending, chatJob{message: message, requestID: requestID, queuedAt: time.Now()})
+
+	if !queue.running {
+		queue.running = true
+		go b.runChatQueue(chatID, queue)
+	}
+
+	return position, true
+}
+
+// Process the messages of a chat in order until its queue is empty
+func (b *Bot) runChatQueue(chatID int64, queue *chatQueue) {
+	for {
+		chatQueuesMu.Lock()
+		if len(queue.pending) == 0 {
+			queue.running = false
+			delete(chatQueues, chatID)
+			chatQueuesMu.Unlock()
+			return
+		}
+		job := queue.pending[0]
+		queue.pending = queue.pending[1:]
+		chatQueuesMu.Unlock()
+
+		// Wait for a free slot so that the total number of concurrent requests stays bounded
+		workerSlots <- struct{}{}
+		b.processMessage(job)
+		<-workerSlots
+	}
+}
+
+// Handle a single message with the handler timeout
+func (b *Bot) processMessage(job chatJob) {
+	message, requestID := job.message, job.requestID
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+
+	// The update span starts when the message was queued, so that the time
+	// spent waiting behind other messages of the chat shows in the trace
+	ctx, span := tracer.Start(ctx, "telegram.update", trace.WithTimestamp(job.queuedAt),
+		trace.WithAttributes(attribute.String("request_id", requestID)))
+	defer span.End()
+	_, wait := tracer.Start(ctx, "queue.wait", trace.WithTimestamp(job.queuedAt))
+	wait.End()
+
+	// Create a done channel to signal completion
+	done := make(chan struct{})
+
+	go func() {
+		b.handleMessageWithContext(ctx, message, requestID)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		logInfo("[%s] Message handling completed normally", requestID)
+	case <-ctx.Done():
+		logError("[%s] Message handling timed out after %v", requestID, b.timeout)
+		b.sendMessage(message.Chat.ID, "Sorry, the operation timed out. Please try again.", requestID)
+		// Keep the worker slot and the chat until the handler has seen the
+		// cancellation, so that the next message of the chat does not run
+		// alongside it
+		<-done
+		logInfo("[%s] Timed out message handling finished", requestID)
+	}
+}
+
+// Drop all pending messages of a chat. Returns the number of dropped messages.
+func clearChatQueue(chatID int64) int {
+	chatQueuesMu.Lock()
+	defer chatQueuesMu.Unlock()
+
+	queue, exists := chatQueues[chatID]
+	if !exists {
+		return 0
+	}
+	dropped := len(queue.pending)
+	queue.pending = nil
+	return dropped
+}
+
+// Count the messages waiting in all chat queues
+func queuedMessages() int {
+	chatQueuesMu.Lock()
+	defer chatQueuesMu.Unlock()
+
+	count := 0
+	for _, queue := range chatQueues {
+		count += len(queue.pending)
+	}
+	return count
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	rasterFontSize = 18 // Font size of rendered images, in points at 72 DPI
+	rasterPadding  = 10 // Padding around text, in pixels
+
+	maxRasterTableRows    = 500        // Most rows of a table rendered as an image
+	maxRasterTableColumns = 30         // Most columns of a table rendered as an image
+	maxRasterPixels       = 10_000_000 // Largest table image, about 40 MB in memory
+)
+
+// errTableTooLarge is returned for tables over the limits of table images
+var errTableTooLarge = errors.New("table is too large to render as an image")
+
+var (
+	rasterFontsOnce   sync.Once
+	rasterRegularFont *opentype.Font
+	rasterBoldFont    *opentype.Font
+	rasterFontsErr    error
+
+	rasterBackground = color.White
+	rasterText       = color.Black
+	rasterGrid       = color.Gray{Y: 0xc0}
+	rasterHeader     = color.Gray{Y: 0xee}
+)
+
+// Create the regular and bold Go Mono faces used for rendered images. The
+// parsed fonts are shared, but a face caches glyphs and is not safe for
+// concurrent use, so each image gets its own faces.
+func rasterFaces() (font.Face, font.Face, error) {
+	rasterFontsOnce.Do(func() {
+		if rasterRegularFont, rasterFontsErr = opentype.Parse(gomono.TTF); rasterFontsErr != nil {
+			return
+		}
+		rasterBoldFont, rasterFontsErr = opentype.Parse(gomonobold.TTF)
+	})
+	if rasterFontsErr != nil {
+		return nil, nil, rasterFontsErr
+	}
+
+	options := &opentype.FaceOptions{Size: rasterFontSize, DPI: 72, Hinting: font.HintingFull}
+	regular, err := opentype.NewFace(rasterRegularFont, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	bold, err := opentype.NewFace(rasterBoldFont, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return regular, bold, nil
+}
+
+// Render a table as a PNG image with a grid and a shaded header row. Tables
+// over the size limits are refused with errTableTooLarge.
+func renderTablePNG(header []string, rows [][]string, aligns []string) ([]byte, error) {
+	if len(rows)+1 > maxRasterTableRows || len(header) > maxRasterTableColumns {
+		return nil, fmt.Errorf("%w: %d rows and %d columns", errTableTooLarge, len(rows)+1, len(header))
+	}
+	regular, bold, err := rasterFaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load fonts: %v", err)
+	}
+
+	allRows := append([][]string{header}, rows...)
+	columns := len(header)
+
+	// Measure columns
+	widths := make([]int, columns)
+	for _, row := range allRows {
+		for col := 0; col < columns && col < len(row); col++ {
+			if w := font.MeasureString(bold, row[col]).Ceil(); w > widths[col] {
+				widths[col] = w
+			}
+		}
+	}
+
+	metrics := regular.Metrics()
+	lineHeight := (metrics.Ascent + metrics.Descent).Ceil()
+	rowHeight := lineHeight + 2*rasterPadding
+
+	width := 1
+	for _, w := range widths {
+		width += w + 2*rasterPadding + 1
+	}
+	height := len(allRows)*(rowHeight+1) + 1
+	if width*height > maxRasterPixels {
+		return nil, fmt.Errorf("%w: %dx%d pixels", errTableTooLarge, width, height)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(rasterBackground), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, width, rowHeight+1), image.NewUniform(rasterHeader), image.Point{}, draw.Src)
+
+	// Grid lines
+	y := 0
+	for range len(allRows) + 1 {
+		draw.Draw(img, image.Rect(0, y, width, y+1), image.NewUniform(rasterGrid), image.Point{}, draw.Src)
+		y += rowHeight + 1
+	}
+	x := 0
+	for col := 0; col <= columns; col++ {
+		draw.Draw(img, image.Rect(x, 0, x+1, height), image.NewUniform(rasterGrid), image.Point{}, draw.Src)
+		if col < columns {
+			x += widths[col] + 2*rasterPadding + 1
+		}
+	}
+
+	// Cell text
+	for rowIndex, row := range allRows {
+		face := regular
+		if rowIndex == 0 {
+			face = bold
+		}
+		baseline := rowIndex*(rowHeight+1) + 1 + rasterPadding + metrics.Ascent.Ceil()
+		cellX := 1
+		for col := 0; col < columns; col++ {
+			cell := ""
+			if col < len(row) {
+				cell = row[col]
+			}
+			textX := cellX + rasterPadding
+			textWidth := font.MeasureString(face, cell).Ceil()
+			switch alignmentOf(aligns, col) {
+			case "right":
+				textX += widths[col] - textWidth
+			case "center":
+				textX += (widths[col] - textWidth) / 2
+			}
+			drawRasterText(img, face, cell, textX, baseline)
+			cellX += widths[col] + 2*rasterPadding + 1
+		}
+	}
+
+	return encodePNG(img)
+}
+
+// Draw a line of text with its baseline at (x, y)
+func drawRasterText(img draw.Image, face font.Face, text string, x int, y int) {
+	drawer := &font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(rasterText),
+		Face: face,
+		Dot:  fixed.P(x, y),
+	}
+	drawer.DrawString(text)
+}
+
+// Encode an image as PNG
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Check whether Telegram accepts an image of this size as a photo
+// (width + height at most 10000, aspect ratio at most 20)
+func fitsTelegramPhoto(width int, height int) bool {
+	if width+height > 10000 {
+		return false
+	}
+	return width <= 20*height && height <= 20*width
+}
+
+// Get the alignment of a column, defaulting to left
+func alignmentOf(aligns []string, col int) string {
+	if col < len(aligns) {
+		return aligns[col]
+	}
+	return "left"
+}
+
+const (
+	mathFontSize    = 28  // Font size of formula images
+	mathScriptScale = 0.7 // Size of scripts and root indices relative to their base
+	mathMinFontSize = 11  // Smallest font size used in nested scripts
+)
+
+// mathBox is a laid out part of a formula. Boxes are positioned by their
+// baseline, like text.
+type mathBox struct {
+	width   int
+	ascent  int // height above the baseline
+	descent int // depth below the baseline
+	draw    func(img *image.RGBA, x int, baseline int)
+}
+
+// mathLayouter lays out parsed LaTeX with Go Regular at several sizes
+type mathLayouter struct {
+	font  *opentype.Font
+	faces map[int]font.Face
+	err   error
+}
+
+// Render a LaTeX math expression as a PNG image
+func renderMathPNG(tex string) ([]byte, error) {
+	parsed, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load fonts: %v", err)
+	}
+	l := &mathLayouter{font: parsed, faces: make(map[int]font.Face)}
+	box := l.layoutLines(parseTeX(tex), mathFontSize)
+	if l.err != nil {
+		return nil, fmt.Errorf("failed to load fonts: %v", l.err)
+	}
+
+	// Very flat formulas are padded so Telegram accepts them as photos
+	width := box.width + 2*rasterPadding
+	height := box.ascent + box.descent + 2*rasterPadding
+	height = max(height, width/15)
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(rasterBackground), image.Point{}, draw.Src)
+	top := (height - box.ascent - box.descent) / 2
+	box.draw(img, rasterPadding, top+box.ascent)
+	return encodePNG(img)
+}
+
+// Get the face for a font size
+func (l *mathLayouter) face(size int) font.Face {
+	if face, ok := l.faces[size]; ok {
+		return face
+	}
+	face, err := opentype.NewFace(l.font, &opentype.FaceOptions{Size: float64(size), DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		l.err = err
+		face, _, _ = rasterFaces()
+	}
+	l.faces[size] = face
+	return face
+}
+
+// Lay out a formula, stacking the lines of multi-line display math
+func (l *mathLayouter) layoutLines(root *mathNode, size int) mathBox {
+	var lines []mathBox
+	var line []*mathNode
+	for _, child := range root.children {
+		if child.kind == mathNewline {
+			lines = append(lines, l.layout(&mathNode{kind: mathGroup, children: line}, size))
+			line = nil
+			continue
+		}
+		line = append(line, child)
+	}
+	lines = append(lines, l.layout(&mathNode{kind: mathGroup, children: line}, size))
+	if len(lines) == 1 {
+		return lines[0]
+	}
+
+	gap := size / 3
+	box := mathBox{ascent: lines[0].ascent}
+	height := -gap
+	for _, line := range lines {
+		box.width = max(box.width, line.width)
+		height += line.ascent + line.descent + gap
+	}
+	box.descent = height - box.ascent
+	box.draw = func(img *image.RGBA, x int, baseline int) {
+		top := baseline - box.ascent
+		for _, line := range lines {
+			line.draw(img, x+(box.width-line.width)/2, top+line.ascent)
+			top += line.ascent + line.descent + gap
+		}
+	}
+	return box
+}
+
+// Lay out a node at a font size
+func (l *mathLayouter) layout(node *mathNode, size int) mathBox {
+	switch node.kind {
+	case mathText:
+		return l.textBox(node.text, size)
+	case mathGroup:
+		var boxes []mathBox
+		for _, child := range node.children {
+			if child.kind != mathSpace {
+				boxes = append(boxes, l.layout(child, size))
+			}
+		}
+		return l.row(boxes, size)
+	case mathScripts:
+		return l.scripts(node, size)
+	case mathFrac:
+		return l.fraction(node, size)
+	case mathSqrt:
+		return l.root(node, size)
+	case mathAccent:
+		return l.accent(node, size)
+	}
+	return mathBox{draw: func(*image.RGBA, int, int) {}}
+}
+
+func (l *mathLayouter) scriptSize(size int) int {
+	return max(int(float64(size)*mathScriptScale), mathMinFontSize)
+}
+
+// Lay out text. Even empty text has the font's height, so scripts of an
+// empty base are positioned like those of a letter.
+func (l *mathLayouter) textBox(text string, size int) mathBox {
+	face := l.face(size)
+	metrics := face.Metrics()
+	return mathBox{
+		width:   font.MeasureString(face, text).Ceil(),
+		ascent:  metrics.Ascent.Ceil(),
+		descent: metrics.Descent.Ceil(),
+		draw: func(img *image.RGBA, x int, baseline int) {
+			drawRasterText(img, face, text, x, baseline)
+		},
+	}
+}
+
+// Lay out boxes side by side on a common baseline
+func (l *mathLayouter) row(boxes []mathBox, size int) mathBox {
+	if len(boxes) == 0 {
+		return l.textBox("", size)
+	}
+	var box mathBox
+	for _, b := range boxes {
+		box.width += b.width
+		box.ascent = max(box.ascent, b.ascent)
+		box.descent = max(box.descent, b.descent)
+	}
+	box.draw = func(img *image.RGBA, x int, baseline int) {
+		for _, b := range boxes {
+			b.draw(img, x, baseline)
+			x += b.width
+		}
+	}
+	return box
+}
+
+// Lay out a base with a raised superscript and a lowered subscript
+func (l *mathLayouter) scripts(node *mathNode, size int) mathBox {
+	base := l.layout(node.base, size)
+	plain := l.textBox("", size)
+	box := mathBox{width: base.width, ascent: base.ascent, descent: base.descent}
+
+	var sup, sub mathBox
+	supShift := size*2/5 + max(0, base.ascent-plain.ascent)
+	subShift := size/4 + max(0, base.descent-plain.descent)
+	scriptWidth := 0
+	if node.sup != nil {
+		sup = l.layout(node.sup, l.scriptSize(size))
+		box.ascent = max(box.ascent, supShift+sup.ascent)
+		scriptWidth = sup.width
+	}
+	if node.sub != nil {
+		sub = l.layout(node.sub, l.scriptSize(size))
+		box.descent = max(box.descent, subShift+sub.descent)
+		scriptWidth = max(scriptWidth, sub.width)
+	}
+	box.width += scriptWidth + 1
+	if isBigOperator(node.base) {
+		box.width += size / 5
+	}
+
+	box.draw = func(img *image.RGBA, x int, baseline int) {
+		base.draw(img, x, baseline)
+		if node.sup != nil {
+			sup.draw(img, x+base.width+1, baseline-supShift)
+		}
+		if node.sub != nil {
+			sub.draw(img, x+base.width+1, baseline+subShift)
+		}
+	}
+	return box
+}
+
+// Lay out a fraction with the bar on the math axis
+func (l *mathLayouter) fraction(node *mathNode, size int) mathBox {
+	partSize := max(size*17/20, mathMinFontSize)
+	num := l.layout(node.base, partSize)
+	den := l.layout(node.sub, partSize)
+
+	axis := size / 4
+	thickness := max(1, size/16)
+	gap := max(2, size/10)
+	padding := max(2, size/6)
+
+	box := mathBox{width: max(num.width, den.width) + 2*padding}
+	box.ascent = axis + gap + num.descent + num.ascent
+	box.descent = thickness + gap + den.ascent + den.descent - axis
+
+	box.draw = func(img *image.RGBA, x int, baseline int) {
+		barTop := baseline - axis
+		num.draw(img, x+(box.width-num.width)/2, barTop-gap-num.descent)
+		fillRasterRect(img, x+padding/2, barTop, x+box.width-padding/2, barTop+thickness)
+		den.draw(img, x+(box.width-den.width)/2, barTop+thickness+gap+den.ascent)
+	}
+	return box
+}
+
+// Lay out a root with a radical sign and an optional index
+func (l *mathLayouter) root(node *mathNode, size int) mathBox {
+	body := l.layout(node.base, size)
+	thickness := max(1, size/16)
+	gap := max(2, size/10)
+	radicalWidth := size / 2
+
+	var index mathBox
+	indexWidth := 0
+	if node.sup != nil {
+		index = l.layout(node.sup, l.scriptSize(l.scriptSize(size)))
+		indexWidth = max(0, index.width-radicalWidth/3)
+	}
+
+	box := mathBox{
+		width:   indexWidth + radicalWidth + body.width + size/10,
+		ascent:  body.ascent + gap + thickness,
+		descent: body.descent + thickness,
+	}
+	indexBaseline := body.ascent / 3
+	if node.sup != nil {
+		box.ascent = max(box.ascent, indexBaseline+index.ascent+2)
+	}
+
+	box.draw = func(img *image.RGBA, x int, baseline int) {
+		left := x + indexWidth
+		top := baseline - body.ascent - gap - thickness
+		middle := baseline - body.ascent/3
+		bottom := baseline + body.descent
+		drawRasterLine(img, left, middle, left+radicalWidth/4, middle-thickness, thickness)
+		drawRasterLine(img, left+radicalWidth/4, middle-thickness, left+radicalWidth/2, bottom, thickness+1)
+		drawRasterLine(img, left+radicalWidth/2, bottom, left+radicalWidth, top, thickness)
+		fillRasterRect(img, left+radicalWidth, top, left+radicalWidth+body.width+size/10, top+thickness)
+		body.draw(img, left+radicalWidth, baseline)
+		if node.sup != nil {
+			index.draw(img, x, baseline-indexBaseline-2)
+		}
+	}
+	return box
+}
+
+// Spacing forms of combining accents, drawn above their base
+var mathAccentGlyphs = map[string]string{
+	"̂": "^", "̃": "~", "̇": "˙", "̈": "¨", "⃗": "→",
+}
+
+// Lay out a node with an accent or an overline above it
+func (l *mathLayouter) accent(node *mathNode, size int) mathBox {
+	body := l.layout(node.base, size)
+	box := mathBox{width: body.width, ascent: body.ascent, descent: body.descent}
+
+	glyph, isGlyph := mathAccentGlyphs[node.text]
+	if !isGlyph {
+		// Bars and overlines are drawn as lines
+		thickness := max(1, size/16)
+		box.ascent += thickness + 1
+		box.draw = func(img *image.RGBA, x int, baseline int) {
+			top := baseline - box.ascent
+			fillRasterRect(img, x+1, top, x+body.width-1, top+thickness)
+			body.draw(img, x, baseline)
+		}
+		return box
+	}
+
+	mark := l.textBox(glyph, l.scriptSize(size))
+	box.width = max(box.width, mark.width)
+	box.ascent = body.ascent + mark.ascent/3
+	box.draw = func(img *image.RGBA, x int, baseline int) {
+		body.draw(img, x+(box.width-body.width)/2, baseline)
+		mark.draw(img, x+(box.width-mark.width)/2, baseline-body.ascent+mark.ascent*2/3)
+	}
+	return box
+}
+
+// Fill a rectangle with the text color
+func fillRasterRect(img *image.RGBA, x0 int, y0 int, x1 int, y1 int) {
+	draw.Draw(img, image.Rect(x0, y0, x1, y1), image.NewUniform(rasterText), image.Point{}, draw.Src)
+}
+
+// Draw a straight line of the given thickness with the text color
+func drawRasterLine(img *image.RGBA, x0 int, y0 int, x1 int, y1 int, thickness int) {
+	steps := max(abs(x1-x0), abs(y1-y0), 1)
+	for i := 0; i <= steps; i++ {
+		x := x0 + (x1-x0)*i/steps
+		y := y0 + (y1-y0)*i/steps
+		fillRasterRect(img, x, y, x+thickness, y+thickness)
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestRenderTablePNG(t *testing.T) {
+	data, err := renderTablePNG([]string{"Name", "Qty"}, [][]string{{"apple", "3"}, {"kiwi", "12"}}, []string{"left", "right"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("the image is not a valid PNG: %v", err)
+	}
+	if bounds := img.Bounds(); bounds.Dx() < bounds.Dy() || !fitsTelegramPhoto(bounds.Dx(), bounds.Dy()) {
+		t.Errorf("got a %dx%d image, want a small landscape photo", bounds.Dx(), bounds.Dy())
+	}
+}
+
+func TestRenderTablePNGLimits(t *testing.T) {
+	manyRows := make([][]string, maxRasterTableRows)
+	for i := range manyRows {
+		manyRows[i] = []string{"row"}
+	}
+	manyColumns := make([]string, maxRasterTableColumns+1)
+	for i := range manyColumns {
+		manyColumns[i] = "col"
+	}
+
+	tests := []struct {
+		name   string
+		header []string
+		rows   [][]string
+	}{
+		{"too many rows", []string{"h"}, manyRows},
+		{"too many columns", manyColumns, nil},
+		{"too many pixels", []string{"h"}, [][]string{{strings.Repeat("x", 20000)}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := renderTablePNG(test.header, test.rows, nil); !errors.Is(err, errTableTooLarge) {
+				t.Errorf("got error %v, want errTableTooLarge", err)
+			}
+			file, err := tableAttachment(test.header, test.rows, nil, TableOutputImage, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if file.name != "table-1.csv" || file.image {
+				t.Errorf("got attachment %s, want the CSV fallback", file.name)
+			}
+		})
+	}
+}
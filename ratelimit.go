@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket tracks the available request tokens for a single user
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// rateLimiter implements a per-key token bucket rate limit
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[int64]*tokenBucket
+	rate      float64   // tokens added per second
+	burst     float64   // maximum number of tokens in a bucket
+	lastSweep time.Time // last time idle buckets were dropped
+}
+
+// Create a rate limiter allowing perMinute requests per minute with the given burst size
+func newRateLimiter(perMinute int, burst int) *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[int64]*tokenBucket),
+		rate:    float64(perMinute) / 60.0,
+		burst:   float64(burst),
+	}
+}
+
+// Take a token for the key. If no token is available, returns false and
+// the time until the next token becomes available.
+func (rl *rateLimiter) allow(key int64) (bool, time.Duration) {
+	return rl.allowN(key, 1)
+}
+
+// Take n tokens for the key, all or none. If fewer are available, returns
+// false and the time until there are enough.
+func (rl *rateLimiter) allowN(key int64, n int) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.evictIdleLocked(now)
+	bucket, exists := rl.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: rl.burst, lastSeen: now}
+		rl.buckets[key] = bucket
+	}
+
+	// Refill tokens for the time elapsed since the last request
+	elapsed := now.Sub(bucket.lastSeen).Seconds()
+	bucket.tokens = math.Min(rl.burst, bucket.tokens+elapsed*rl.rate)
+	bucket.lastSeen = now
+
+	if bucket.tokens >= float64(n) {
+		bucket.tokens -= float64(n)
+		return true, 0
+	}
+
+	wait := time.Duration((float64(n) - bucket.tokens) / rl.rate * float64(time.Second))
+	return false, wait
+}
+
+// Drop the buckets that have been idle long enough to refill completely,
+// since they are the same as the full bucket a new key gets. Runs at most
+// once per refill period. The caller must hold rl.mu.
+func (rl *rateLimiter) evictIdleLocked(now time.Time) {
+	refill := time.Duration(rl.burst / rl.rate * float64(time.Second))
+	if now.Sub(rl.lastSweep) < refill {
+		return
+	}
+	rl.lastSweep = now
+	for key, bucket := range rl.buckets {
+		if now.Sub(bucket.lastSeen) >= refill {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// Take the rate limit tokens of n requests to the AI by a user. Every
+// message or command that queries the models goes through here. If the user
+// is sending requests too fast, tells them how long to wait and returns false.
+func (b *Bot) takeRequestTokens(chatID int64, userID int64, n int, requestID string) bool {
+	allowed, wait := userRateLimiter.allowN(userID, n)
+	if !allowed {
+		logInfo("[%s] Rate limit exceeded for user %d (%d requests)", requestID, userID, n)
+		b.sendMessage(chatID, fmt.Sprintf("⏳ You are sending messages too fast. Please wait %d seconds and try again.",
+			int(wait.Seconds())+1), requestID)
+	}
+	return allowed
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Longest reasoning text shown above an answer; longer reasoning keeps its end
+const maxReasoningDisplayChars = 3000
+
+// ReasoningSettings are the user's preferences for reasoning models
+type ReasoningSettings struct {
+	Effort    string `json:"effort,omitempty"`     // low, medium or high
+	MaxTokens int    `json:"max_tokens,omitempty"` // reasoning token budget, used instead of effort
+	Hide      bool   `json:"hide,omitempty"`       // don't show the reasoning in answers
+}
+
+// ReasoningConfig is the reasoning parameter of an OpenRouter request
+type ReasoningConfig struct {
+	Effort    string `json:"effort,omitempty"`
+	MaxTokens int    `json:"max_tokens,omitempty"`
+	Exclude   bool   `json:"exclude,omitempty"` // reason, but don't return the reasoning text
+}
+
+const reasoningUsage = `Usage:
+/reasoning - Show reasoning settings
+/reasoning low|medium|high - Set reasoning effort
+/reasoning tokens <n> - Set a reasoning token budget
+/reasoning default - Use the model's default reasoning
+/reasoning hide|show - Hide or show the thinking above answers`
+
+// Build the reasoning parameter for a request, or nil to use model defaults
+func reasoningConfig(settings ReasoningSettings) *ReasoningConfig {
+	if settings.Effort == "" && settings.MaxTokens == 0 && !settings.Hide {
+		return nil
+	}
+	return &ReasoningConfig{
+		Effort:    settings.Effort,
+		MaxTokens: settings.MaxTokens,
+		Exclude:   settings.Hide,
+	}
+}
+
+// Describe the reasoning settings
+func (s ReasoningSettings) format() string {
+	var level string
+	switch {
+	case s.MaxTokens > 0:
+		level = fmt.Sprintf("budget of %d tokens", s.MaxTokens)
+	case s.Effort != "":
+		level = s.Effort + " effort"
+	default:
+		level = "model default"
+	}
+	display := "shown"
+	if s.Hide {
+		display = "hidden"
+	}
+	return fmt.Sprintf("Reasoning: %s\nThinking output: %s", level, display)
+}
+
+// Render model reasoning as a collapsed Telegram blockquote
+func formatReasoningTokens(reasoning string, reasoningTokens int) []htmlToken {
+	reasoning = strings.TrimSpace(reasoning)
+	if reasoning == "" {
+		return nil
+	}
+	if runes := []rune(reasoning); len(runes) > maxReasoningDisplayChars {
+		reasoning = "…" + string(runes[len(runes)-maxReasoningDisplayChars:])
+	}
+
+	header := "Thinking"
+	if reasoningTokens > 0 {
+		header = fmt.Sprintf("Thinking (%d tokens)", reasoningTokens)
+	}
+	return []htmlToken{
+		{kind: tokenOpen, tag: "blockquote", attrs: " expandable"},
+		{kind: tokenText, text: "💭 "},
+		{kind: tokenOpen, tag: "b"},
+		{kind: tokenText, text: header},
+		{kind: tokenClose, tag: "b"},
+		{kind: tokenText, text: "\n" + reasoning},
+		{kind: tokenClose, tag: "blockquote"},
+		{kind: tokenBreak, text: "\n"},
+	}
+}
+
+// Handle the /reasoning command
+func (b *Bot) handleReasoningCommand(chatID int64, userID int64, user User, args string, requestID string) {
+	fields := strings.Fields(strings.ToLower(args))
+	if len(fields) == 0 {
+		b.sendMessage(chatID, user.Reasoning.format()+"\n\n"+reasoningUsage, requestID)
+		return
+	}
+
+	switch fields[0] {
+	case "low", "medium", "high":
+		user.Reasoning.Effort = fields[0]
+		user.Reasoning.MaxTokens = 0
+	case "tokens":
+		if len(fields) < 2 {
+			b.sendMessage(chatID, reasoningUsage, requestID)
+			return
+		}
+		budget, err := strconv.Atoi(fields[1])
+		if err != nil || budget < 1 {
+			b.sendMessage(chatID, "The reasoning token budget must be a positive integer.", requestID)
+			return
+		}
+		user.Reasoning.MaxTokens = budget
+		user.Reasoning.Effort = ""
+	case "default":
+		user.Reasoning.Effort = ""
+		user.Reasoning.MaxTokens = 0
+	case "hide":
+		user.Reasoning.Hide = true
+	case "show":
+		user.Reasoning.Hide = false
+	default:
+		b.sendMessage(chatID, reasoningUsage, requestID)
+		return
+	}
+
+	modifyUser(userID, requestID, func(stored *User) { stored.Reasoning = user.Reasoning })
+	b.sendMessage(chatID, "Reasoning settings updated.\n\n"+user.Reasoning.format(), requestID)
+}
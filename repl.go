@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	replPrompt         = "you> "
+	replContinuePrompt = "...> "
+	replRedrawWidth    = 80 // Widest printed line a message may have to be redrawn in place
+)
+
+// ANSI escape sequences
+const (
+	ansiReset     = "\x1b[0m"
+	ansiBold      = "\x1b[1m"
+	ansiDim       = "\x1b[2m"
+	ansiItalic    = "\x1b[3m"
+	ansiUnderline = "\x1b[4m"
+	ansiReverse   = "\x1b[7m"
+	ansiStrike    = "\x1b[9m"
+	ansiCyan      = "\x1b[36m"
+	ansiBlue      = "\x1b[34m"
+	ansiClearDown = "\x1b[J"
+)
+
+// ANSI styles of the Telegram HTML tags
+var ansiTagStyles = map[string]string{
+	"b": ansiBold, "strong": ansiBold,
+	"i": ansiItalic, "em": ansiItalic,
+	"u": ansiUnderline, "ins": ansiUnderline,
+	"s": ansiStrike, "strike": ansiStrike, "del": ansiStrike,
+	"code": ansiCyan, "pre": ansiCyan,
+	"a":          ansiBlue + ansiUnderline,
+	"blockquote": ansiDim,
+	"tg-spoiler": ansiReverse,
+}
+
+var telegramTagRegex = regexp.MustCompile(`<(/?)([a-z-]+)([^>]*)>`)
+var htmlHrefRegex = regexp.MustCompile(`href="([^"]*)"`)
+
+// Convert Telegram HTML to text for a terminal, styled with ANSI escape
+// sequences when color is true. Links are followed by their URL and quotes
+// are marked with a bar.
+func htmlToANSI(text string, color bool) string {
+	var sb strings.Builder
+	var styles []string // tags open at the current position
+	var links []string  // URLs of the open links
+	quoteDepth := 0
+
+	// Write the current style: a reset followed by the styles of all open tags
+	restyle := func() {
+		if !color {
+			return
+		}
+		sb.WriteString(ansiReset)
+		for _, tag := range styles {
+			sb.WriteString(ansiTagStyles[tag])
+		}
+	}
+	writeText := func(segment string) {
+		segment = html.UnescapeString(segment)
+		if quoteDepth > 0 {
+			segment = strings.ReplaceAll(segment, "\n", "\n"+strings.Repeat("│ ", quoteDepth))
+		}
+		sb.WriteString(segment)
+	}
+
+	last := 0
+	for _, match := range telegramTagRegex.FindAllStringSubmatchIndex(text, -1) {
+		writeText(text[last:match[0]])
+		last = match[1]
+		closing := text[match[2]:match[3]] == "/"
+		tag := text[match[4]:match[5]]
+		attrs := text[match[6]:match[7]]
+
+		if !closing {
+			switch tag {
+			case "a":
+				url := ""
+				if href := htmlHrefRegex.FindStringSubmatch(attrs); href != nil {
+					url = html.UnescapeString(href[1])
+				}
+				links = append(links, url)
+			case "blockquote":
+				quoteDepth++
+				if sb.Len() > 0 && !strings.HasSuffix(sb.String(), "\n") {
+					sb.WriteString("\n")
+				}
+				sb.WriteString(strings.Repeat("│ ", quoteDepth))
+			}
+			styles = append(styles, tag)
+			restyle()
+			continue
+		}
+
+		for i := len(styles) - 1; i >= 0; i-- {
+			if styles[i] == tag {
+				styles = append(styles[:i], styles[i+1:]...)
+				break
+			}
+		}
+		restyle()
+		switch tag {
+		case "a":
+			if len(links) > 0 {
+				url := links[len(links)-1]
+				links = links[:len(links)-1]
+				if url != "" {
+					sb.WriteString(styleText(" ("+url+")", ansiDim, color))
+					restyle()
+				}
+			}
+		case "blockquote":
+			quoteDepth = max(quoteDepth-1, 0)
+		}
+	}
+	writeText(text[last:])
+	if color {
+		sb.WriteString(ansiReset)
+	}
+	return sb.String()
+}
+
+// Wrap text in an ANSI style when color is true
+func styleText(text string, style string, color bool) string {
+	if !color {
+		return text
+	}
+	return style + text + ansiReset
+}
+
+// terminalChat is a Telegram chat shown in a terminal. It implements
+// TelegramSender: messages are printed, files are saved to a directory and
+// edits and deletions of the last message are redrawn in place.
+type terminalChat struct {
+	mu            sync.Mutex
+	out           io.Writer
+	color         bool   // style with ANSI escapes and redraw edited messages
+	fileDir       string // directory for the files the bot sends
+	nextMessageID int
+	lastID        int // last printed message, which can be redrawn in place
+	lastLines     int // number of lines of the last printed message, 0 if it cannot be redrawn
+}
+
+// Create a terminal chat printing to out
+func newTerminalChat(out io.Writer, color bool) *terminalChat {
+	return &terminalChat{
+		out:           out,
+		color:         color,
+		fileDir:       filepath.Join(os.TempDir(), "tgbot-repl-files"),
+		nextMessageID: 1,
+	}
+}
+
+// Check whether a file is a terminal that understands ANSI escapes
+func isTerminal(file *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Send prints a message or saves a file
+func (t *terminalChat) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch config := c.(type) {
+	case tgbotapi.MessageConfig:
+		id := t.print(t.render(config.Text, config.ParseMode))
+		return tgbotapi.Message{MessageID: id, Chat: &tgbotapi.Chat{ID: config.ChatID}, Text: config.Text}, nil
+	case tgbotapi.EditMessageTextConfig:
+		text := t.render(config.Text, config.ParseMode)
+		if config.MessageID == t.lastID && t.lastLines > 0 {
+			t.erase()
+			t.printAs(config.MessageID, text)
+		} else {
+			t.print(styleText("(edited) ", ansiDim, t.color) + text)
+		}
+		return tgbotapi.Message{MessageID: config.MessageID, Chat: &tgbotapi.Chat{ID: config.ChatID}, Text: config.Text}, nil
+	case tgbotapi.DocumentConfig:
+		return t.saveFile(config.ChatID, config.File, config.Caption, config.ParseMode)
+	case tgbotapi.PhotoConfig:
+		return t.saveFile(config.ChatID, config.File, config.Caption, config.ParseMode)
+	}
+	return tgbotapi.Message{}, fmt.Errorf("%T is not supported in the terminal", c)
+}
+
+// Request handles requests that do not send a message. Deleting the last
+// message erases it; other requests, such as chat actions, do nothing.
+func (t *terminalChat) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if config, ok := c.(tgbotapi.DeleteMessageConfig); ok && config.MessageID == t.lastID && t.lastLines > 0 {
+		t.erase()
+	}
+	return &tgbotapi.APIResponse{Ok: true, Result: []byte("true")}, nil
+}
+
+// GetFileDirectURL fails, since files cannot be sent from the terminal
+func (t *terminalChat) GetFileDirectURL(fileID string) (string, error) {
+	return "", fmt.Errorf("files are not supported in the terminal")
+}
+
+// GetMe returns a bot account standing for the terminal chat
+func (t *terminalChat) GetMe() (tgbotapi.User, error) {
+	return tgbotapi.User{IsBot: true, FirstName: "Terminal", UserName: "terminal"}, nil
+}
+
+// Render a message for the terminal
+func (t *terminalChat) render(text string, parseMode string) string {
+	if parseMode == tgbotapi.ModeHTML {
+		return htmlToANSI(text, t.color)
+	}
+	return text
+}
+
+// Print a new message and return its ID
+func (t *terminalChat) print(text string) int {
+	id := t.nextMessageID
+	t.nextMessageID++
+	t.printAs(id, text)
+	return id
+}
+
+// Print a message, remembering whether it can be redrawn
+func (t *terminalChat) printAs(id int, text string) {
+	text = strings.TrimRight(text, "\n")
+	fmt.Fprintf(t.out, "%s %s\n\n", styleText("bot>", ansiBold+ansiCyan, t.color), text)
+
+	t.lastID, t.lastLines = id, 0
+	if !t.color {
+		return
+	}
+	lines := strings.Split(text, "\n")
+	for _, line := range lines {
+		if utf8.RuneCountInString(line) > replRedrawWidth {
+			return
+		}
+	}
+	t.lastLines = len(lines) + 1 // and the blank line
+}
+
+// Erase the last printed message
+func (t *terminalChat) erase() {
+	fmt.Fprintf(t.out, "\x1b[%dA\r%s", t.lastLines, ansiClearDown)
+	t.lastID, t.lastLines = 0, 0
+}
+
+// Save a file sent by the bot and print where it is
+func (t *terminalChat) saveFile(chatID int64, file tgbotapi.RequestFileData, caption string, parseMode string) (tgbotapi.Message, error) {
+	name, data := "file", []byte(nil)
+	if file != nil && file.NeedsUpload() {
+		uploadName, reader, err := file.UploadData()
+		if err != nil {
+			return tgbotapi.Message{}, err
+		}
+		if data, err = io.ReadAll(reader); err != nil {
+			return tgbotapi.Message{}, err
+		}
+		name = uploadName
+	}
+	if err := os.MkdirAll(t.fileDir, 0755); err != nil {
+		return tgbotapi.Message{}, err
+	}
+	path := filepath.Join(t.fileDir, filepath.Base(name))
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return tgbotapi.Message{}, err
+	}
+
+	text := fmt.Sprintf("📎 %s (%d bytes) saved to %s", name, len(data), path)
+	if caption != "" {
+		text += "\n" + t.render(caption, parseMode)
+	}
+	id := t.print(text)
+	return tgbotapi.Message{MessageID: id, Chat: &tgbotapi.Chat{ID: chatID}}, nil
+}
+
+// Build an incoming message typed in the terminal. Text starting with / is
+// marked as a command, as Telegram does.
+func replMessage(userID int64, messageID int, text string) *tgbotapi.Message {
+	message := &tgbotapi.Message{
+		MessageID: messageID,
+		From:      &tgbotapi.User{ID: userID, FirstName: "REPL"},
+		Chat:      &tgbotapi.Chat{ID: userID, Type: "private"},
+		Text:      text,
+	}
+	if strings.HasPrefix(text, "/") {
+		length := len(text)
+		if i := strings.IndexAny(text, " \n"); i >= 0 {
+			length = i
+		}
+		message.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: length}}
+	}
+	return message
+}
+
+// Read messages from the terminal. Lines ending with \ continue on the next
+// line. The channel is closed at the end of the input.
+func readREPLMessages(in io.Reader, out io.Writer) <-chan string {
+	messages := make(chan string)
+	go func() {
+		defer close(messages)
+		scanner := bufio.NewScanner(in)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		var lines []string
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasSuffix(line, `\`) {
+				lines = append(lines, strings.TrimSuffix(line, `\`))
+				fmt.Fprint(out, replContinuePrompt)
+				continue
+			}
+			messages <- strings.Join(append(lines, line), "\n")
+			lines = nil
+		}
+	}()
+	return messages
+}
+
+// Chat with the bot in the terminal as the given user, with the same command
+// handling and model pipeline as in Telegram. Ctrl+C stops the answer being
+// generated, or quits when there is none; Ctrl+D quits.
+func runREPL(userID int64, llm LLMClient) {
+	color := isTerminal(os.Stdout)
+	chat := newTerminalChat(os.Stdout, color)
+	b := newBot(tracingTelegram{chat}, llm)
+
+	// The terminal user does not need the password
+	configMu.Lock()
+	config.AuthorizedIDs[userID] = true
+	configMu.Unlock()
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	fmt.Printf("Chatting as user %d. Type /help for the commands, Ctrl+C to stop an answer, Ctrl+D to quit.\n\n", userID)
+	messages := readREPLMessages(os.Stdin, os.Stdout)
+	for messageID := 1; ; messageID++ {
+		fmt.Print(styleText(replPrompt, ansiBold, color))
+		var text string
+		select {
+		case line, ok := <-messages:
+			if !ok {
+				fmt.Println()
+				return
+			}
+			text = line
+		case <-interrupts:
+			fmt.Println()
+			return
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		requestID := uuid.New().String()
+		ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			b.handleMessageWithContext(ctx, replMessage(userID, messageID, text), requestID)
+		}()
+		for waiting := true; waiting; {
+			select {
+			case <-done:
+				waiting = false
+			case <-interrupts:
+				stopActiveRequest(userID, requestID)
+			}
+		}
+		cancel()
+	}
+}
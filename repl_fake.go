@@ -0,0 +1,14 @@
+//go:build fakeapi
+
+package main
+
+import "tgbot/fake"
+
+// Builds with the fakeapi tag can answer from a local fake OpenRouter, so
+// that the fake package stays out of the production binary
+func init() {
+	startFakeAPI = func() (string, func()) {
+		api := fake.NewOpenRouter()
+		return api.BaseURL(), api.Close
+	}
+}
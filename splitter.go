@@ -0,0 +1,198 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Maximum visible length of a message part in UTF-16 code units. Telegram
+// allows 4096 after entity parsing; the rest is kept for the part header.
+const maxPartSize = 4000
+
+// tokenSplitter splits a rendered token stream into Telegram-sized messages.
+// Tags still open at a split are closed at the end of the part and reopened
+// at the start of the next one.
+type tokenSplitter struct {
+	limit   int
+	parts   [][]htmlToken
+	current []htmlToken
+	length  int         // visible length of the current part
+	stack   []htmlToken // tags open at the end of the current part
+
+	breakIndex  int         // position in current right after the last block break, or -1
+	breakStack  []htmlToken // tags open at breakIndex
+	breakLength int         // visible length of the current part up to breakIndex
+}
+
+// Split tokens into parts whose visible text is at most limit UTF-16 code units
+func splitHTMLTokens(tokens []htmlToken, limit int) [][]htmlToken {
+	s := &tokenSplitter{limit: limit, breakIndex: -1}
+	for _, token := range tokens {
+		s.add(token)
+	}
+	s.flush()
+	return s.parts
+}
+
+func (s *tokenSplitter) add(token htmlToken) {
+	switch token.kind {
+	case tokenOpen:
+		s.current = append(s.current, token)
+		s.stack = append(s.stack, token)
+	case tokenClose:
+		s.current = append(s.current, token)
+		for i := len(s.stack) - 1; i >= 0; i-- {
+			if s.stack[i].tag == token.tag {
+				s.stack = append(s.stack[:i], s.stack[i+1:]...)
+				break
+			}
+		}
+	case tokenBreak:
+		size := utf16Length(token.text)
+		if s.length+size > s.limit {
+			// The break is the natural end of this part
+			s.flush()
+			return
+		}
+		s.current = append(s.current, token)
+		s.length += size
+		s.breakIndex = len(s.current)
+		s.breakStack = append([]htmlToken(nil), s.stack...)
+		s.breakLength = s.length
+	case tokenText:
+		s.addText(token.text)
+	}
+}
+
+func (s *tokenSplitter) addText(text string) {
+	for text != "" {
+		size := utf16Length(text)
+		if s.length+size <= s.limit {
+			s.current = append(s.current, htmlToken{kind: tokenText, text: text})
+			s.length += size
+			return
+		}
+
+		// Prefer to end the part at the last block boundary, unless that leaves it almost empty
+		if s.breakIndex > 0 && s.breakLength >= s.limit/4 {
+			s.splitAtBreak()
+			continue
+		}
+
+		// Start a new part rather than leave a small fragment at the end of this one
+		free := s.limit - s.length
+		if free < s.limit/4 && s.hasText() {
+			s.flush()
+			continue
+		}
+
+		cut := findTextCut(text, free)
+		s.current = append(s.current, htmlToken{kind: tokenText, text: text[:cut]})
+		s.length += utf16Length(text[:cut])
+		s.flush()
+		text = text[cut:]
+	}
+}
+
+// End the current part at the last block break and carry the rest over
+func (s *tokenSplitter) splitAtBreak() {
+	carried := append([]htmlToken(nil), s.current[s.breakIndex:]...)
+	s.current = s.current[:s.breakIndex]
+	s.stack = s.breakStack
+	s.flush()
+	for _, token := range carried {
+		s.add(token)
+	}
+}
+
+// Check whether the current part contains any visible text
+func (s *tokenSplitter) hasText() bool {
+	for _, token := range s.current {
+		if token.kind == tokenText && strings.TrimSpace(token.text) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Close the current part and start a new one with the open tags reopened
+func (s *tokenSplitter) flush() {
+	if s.hasText() {
+		part := trimTrailingBreaks(s.current)
+
+		// Tags opened right at the end have no content yet; they only start in the next part
+		open := len(s.stack)
+		for open > 0 && len(part) > 0 && part[len(part)-1].kind == tokenOpen {
+			part = part[:len(part)-1]
+			open--
+		}
+		for i := open - 1; i >= 0; i-- {
+			part = append(part, htmlToken{kind: tokenClose, tag: s.stack[i].tag})
+		}
+		s.parts = append(s.parts, part)
+	}
+
+	s.current = append([]htmlToken(nil), s.stack...)
+	s.length = 0
+	s.breakIndex = -1
+	s.breakStack = nil
+	s.breakLength = 0
+}
+
+// Remove block breaks at the end of a part
+func trimTrailingBreaks(tokens []htmlToken) []htmlToken {
+	for len(tokens) > 0 && tokens[len(tokens)-1].kind == tokenBreak {
+		tokens = tokens[:len(tokens)-1]
+	}
+	return tokens
+}
+
+// Find the byte index where text should be cut so that the head fits in
+// maxUnits UTF-16 code units. Never cuts inside a rune and prefers line,
+// sentence and word boundaries in the second half of the head.
+func findTextCut(text string, maxUnits int) int {
+	units := 0
+	fit := 0
+	for i, r := range text {
+		units += utf16RuneLength(r)
+		if units > maxUnits {
+			break
+		}
+		// An invalid byte decodes as RuneError but is only one byte wide
+		_, size := utf8.DecodeRuneInString(text[i:])
+		fit = i + size
+	}
+	if fit == 0 {
+		// Not even one rune fits; cut after the first one to make progress
+		_, size := utf8.DecodeRuneInString(text)
+		return size
+	}
+	if fit == len(text) {
+		return fit
+	}
+
+	head := text[:fit]
+	for _, separator := range []string{"\n\n", "\n", ". ", "! ", "? ", " "} {
+		if i := strings.LastIndex(head, separator); i > len(head)/2 {
+			return i + len(separator)
+		}
+	}
+	return fit
+}
+
+// Get the length of text in UTF-16 code units, as Telegram counts it
+func utf16Length(text string) int {
+	length := 0
+	for _, r := range text {
+		length += utf16RuneLength(r)
+	}
+	return length
+}
+
+func utf16RuneLength(r rune) int {
+	if n := utf16.RuneLen(r); n > 0 {
+		return n
+	}
+	return 1
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitHTMLTokensSurrogatePairAtLimit(t *testing.T) {
+	const limit = 4096
+	// The emoji takes two UTF-16 code units, the 4096th and 4097th
+	text := strings.Repeat("a", limit-1) + "😀" + strings.Repeat("b", 10)
+
+	parts := splitHTMLTokens([]htmlToken{{kind: tokenText, text: text}}, limit)
+	if len(parts) != 2 {
+		t.Fatalf("got %d parts, want 2", len(parts))
+	}
+	var joined strings.Builder
+	for i, part := range parts {
+		html := serializeHTMLTokens(part)
+		if !utf8.ValidString(html) {
+			t.Errorf("part %d is not valid UTF-8", i+1)
+		}
+		if length := utf16Length(html); length > limit {
+			t.Errorf("part %d is %d UTF-16 code units, more than %d", i+1, length, limit)
+		}
+		joined.WriteString(html)
+	}
+	if got := serializeHTMLTokens(parts[1]); !strings.HasPrefix(got, "😀") {
+		t.Errorf("second part starts with %q, want the emoji", got[:8])
+	}
+	if joined.String() != text {
+		t.Error("parts do not add up to the original text")
+	}
+}
+
+func TestSplitHTMLTokensReopensCodeBlock(t *testing.T) {
+	var code strings.Builder
+	for i := 0; i < 150; i++ {
+		code.WriteString(fmt.Sprintf("print(\"line %d of a long program\")\n", i))
+	}
+	tokens, _ := renderMarkdown("```python\n"+code.String()+"```", renderOptions{})
+
+	parts := splitHTMLTokens(tokens, maxPartSize)
+	if len(parts) != 2 {
+		t.Fatalf("got %d parts, want 2", len(parts))
+	}
+	var lines []string
+	for i, part := range parts {
+		html := serializeHTMLTokens(part)
+		if !strings.HasPrefix(html, `<pre><code class="language-python">`) {
+			t.Errorf("part %d does not reopen the code block: %q", i+1, html[:40])
+		}
+		if !strings.HasSuffix(html, "</code></pre>") {
+			t.Errorf("part %d does not close the code block: %q", i+1, html[len(html)-40:])
+		}
+		visible := 0
+		for _, token := range part {
+			if token.kind == tokenText || token.kind == tokenBreak {
+				visible += utf16Length(token.text)
+			}
+		}
+		if visible > maxPartSize {
+			t.Errorf("part %d has %d UTF-16 code units of text, more than %d", i+1, visible, maxPartSize)
+		}
+		body := strings.TrimSuffix(strings.TrimPrefix(html, `<pre><code class="language-python">`), "</code></pre>")
+		lines = append(lines, strings.Split(strings.Trim(body, "\n"), "\n")...)
+	}
+	if len(lines) != 150 {
+		t.Errorf("got %d code lines across the parts, want 150", len(lines))
+	}
+}
+
+func TestSplitHTMLTokensInvalidUTF8(t *testing.T) {
+	const limit = 100
+	// Stray bytes decode as RuneError, which is three bytes when encoded
+	text := strings.Repeat("a\xff", limit)
+
+	parts := splitHTMLTokens([]htmlToken{{kind: tokenText, text: text}}, limit)
+	var joined strings.Builder
+	for i, part := range parts {
+		html := serializeHTMLTokens(part)
+		if length := utf16Length(html); length > limit {
+			t.Errorf("part %d is %d UTF-16 code units, more than %d", i+1, length, limit)
+		}
+		joined.WriteString(html)
+	}
+	if joined.String() != text {
+		t.Error("parts do not add up to the original text")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Delay between a change and the write of its data file, so that the changes
+// made in the meantime are written together
+const saveDelay = 2 * time.Second
+
+// delayedSave writes a data file once per saveDelay at most, after the first
+// change since the last write
+type delayedSave struct {
+	write func()
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+var (
+	delayedSaves   []*delayedSave // Saves flushed on shutdown
+	delayedSavesMu sync.Mutex
+)
+
+// Create a delayed save running write, flushed by flushSaves
+func newDelayedSave(write func()) *delayedSave {
+	save := &delayedSave{write: write}
+	delayedSavesMu.Lock()
+	delayedSaves = append(delayedSaves, save)
+	delayedSavesMu.Unlock()
+	return save
+}
+
+// Write the file after saveDelay, unless a write is already scheduled
+func (s *delayedSave) schedule() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer == nil {
+		s.timer = time.AfterFunc(saveDelay, s.run)
+	}
+}
+
+func (s *delayedSave) run() {
+	s.mu.Lock()
+	s.timer = nil
+	s.mu.Unlock()
+	s.write()
+}
+
+// Write the file now if a write is scheduled
+func (s *delayedSave) flush() {
+	s.mu.Lock()
+	pending := s.timer != nil && s.timer.Stop()
+	s.timer = nil
+	s.mu.Unlock()
+	if pending {
+		s.write()
+	}
+}
+
+// Write all scheduled saves, before exiting
+func flushSaves() {
+	delayedSavesMu.Lock()
+	saves := append([]*delayedSave(nil), delayedSaves...)
+	delayedSavesMu.Unlock()
+	for _, save := range saves {
+		save.flush()
+	}
+}
+
+// Write a file through a temporary file renamed into place, so that a crash
+// during the write leaves the previous version intact
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	file, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tempName := file.Name()
+	defer os.Remove(tempName) // No-op once renamed
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tempName, perm); err != nil {
+		return err
+	}
+	return os.Rename(tempName, name)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultThreadName   = "main"
+	maxThreadNameLength = 32
+	titleTimeout        = 30 * time.Second
+	maxTitleLength      = 60
+)
+
+const threadUsage = `Usage:
+/thread - List your threads
+/thread new <name> - Start a new thread and switch to it
+/thread switch <name> - Switch to another thread
+/thread rename [<name>] <new_name> - Rename a thread (the current one by default)
+/thread delete <name> - Delete a thread and its history
+/thread system <prompt> - Set the system prompt of the current thread (off to clear)
+
+Each thread has its own history, model and system prompt. /setmodel changes the model of the current thread.`
+
+// Handle the /thread command
+func (b *Bot) handleThreadCommand(chatID int64, userID int64, user User, args string, requestID string) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 || fields[0] == "list" {
+		b.sendMessage(chatID, formatThreadList(userID)+"\n\n"+threadUsage, requestID)
+		return
+	}
+
+	action := strings.ToLower(fields[0])
+	names := fields[1:]
+	switch action {
+	case "new":
+		if len(names) != 1 {
+			b.sendMessage(chatID, "Usage: /thread new <name>", requestID)
+			return
+		}
+		if err := createThread(userID, names[0], user.CurrentModel, requestID); err != nil {
+			b.sendMessage(chatID, "❌ "+err.Error(), requestID)
+			return
+		}
+		b.sendMessage(chatID, fmt.Sprintf("Started thread %q and switched to it.", names[0]), requestID)
+	case "switch":
+		if len(names) != 1 {
+			b.sendMessage(chatID, "Usage: /thread switch <name>", requestID)
+			return
+		}
+		conversation, err := switchThread(userID, names[0], requestID)
+		if err != nil {
+			b.sendMessage(chatID, "❌ "+err.Error(), requestID)
+			return
+		}
+		reply := fmt.Sprintf("Switched to thread %q (%d messages).", conversation.Name, len(conversation.Messages))
+		user = useThreadModel(userID, user, conversation, requestID)
+		if user.CurrentModel != "" {
+			reply += fmt.Sprintf("\nModel: %s (%s)", user.CurrentModel, user.Models[user.CurrentModel])
+		}
+		b.sendMessage(chatID, reply, requestID)
+	case "rename":
+		oldName, newName := "", ""
+		switch len(names) {
+		case 1:
+			newName = names[0]
+		case 2:
+			oldName, newName = names[0], names[1]
+		default:
+			b.sendMessage(chatID, "Usage: /thread rename [<name>] <new_name>", requestID)
+			return
+		}
+		oldName, err := renameThread(userID, oldName, newName, requestID)
+		if err != nil {
+			b.sendMessage(chatID, "❌ "+err.Error(), requestID)
+			return
+		}
+		b.sendMessage(chatID, fmt.Sprintf("Thread %q renamed to %q.", oldName, newName), requestID)
+	case "delete":
+		if len(names) != 1 {
+			b.sendMessage(chatID, "Usage: /thread delete <name>", requestID)
+			return
+		}
+		if err := deleteThread(userID, names[0], requestID); err != nil {
+			b.sendMessage(chatID, "❌ "+err.Error(), requestID)
+			return
+		}
+		conversation := getConversation(userID)
+		useThreadModel(userID, user, conversation, requestID)
+		b.sendMessage(chatID, fmt.Sprintf("Thread %q deleted. Current thread: %q.", names[0], conversation.Name), requestID)
+	case "system":
+		prompt := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(args), fields[0]))
+		if prompt == "" {
+			conversation := getConversation(userID)
+			if conversation.SystemPrompt == "" {
+				b.sendMessage(chatID, "The current thread has no system prompt. Usage: /thread system <prompt>", requestID)
+			} else {
+				b.sendMessage(chatID, "System prompt of the current thread:\n\n"+conversation.SystemPrompt, requestID)
+			}
+			return
+		}
+		if prompt == "off" {
+			prompt = ""
+		}
+		setThreadSystemPrompt(userID, prompt, requestID)
+		if prompt == "" {
+			b.sendMessage(chatID, "System prompt cleared.", requestID)
+		} else {
+			b.sendMessage(chatID, "System prompt set for the current thread.", requestID)
+		}
+	default:
+		b.sendMessage(chatID, threadUsage, requestID)
+	}
+}
+
+// Check that a thread name is usable
+func validateThreadName(name string) error {
+	if utf8.RuneCountInString(name) > maxThreadNameLength {
+		return fmt.Errorf("thread names can be at most %d characters long", maxThreadNameLength)
+	}
+	return nil
+}
+
+// Create a thread that uses the given model and make it current
+func createThread(userID int64, name string, model string, requestID string) error {
+	if err := validateThreadName(name); err != nil {
+		return err
+	}
+
+	conversationsMu.Lock()
+	threads := userThreadsLocked(userID)
+	if _, exists := threads.Threads[name]; exists {
+		conversationsMu.Unlock()
+		return fmt.Errorf("thread %q already exists", name)
+	}
+	threads.Threads[name] = &Conversation{Name: name, Model: model, StartedAt: time.Now()}
+	threads.Current = name
+	conversationsMu.Unlock()
+
+	saveConversations()
+	logInfo("[%s] User %d created thread %q", requestID, userID, name)
+	return nil
+}
+
+// Make a thread current and return a copy of it
+func switchThread(userID int64, name string, requestID string) (Conversation, error) {
+	conversationsMu.Lock()
+	threads := userThreadsLocked(userID)
+	conversation, exists := threads.Threads[name]
+	if !exists {
+		conversationsMu.Unlock()
+		return Conversation{}, fmt.Errorf("thread %q not found. Use /thread to list your threads", name)
+	}
+	threads.Current = name
+	copied := conversation.copy()
+	conversationsMu.Unlock()
+
+	saveConversations()
+	logInfo("[%s] User %d switched to thread %q", requestID, userID, name)
+	return copied, nil
+}
+
+// Rename a thread, the current one if oldName is empty. Returns the old name.
+func renameThread(userID int64, oldName string, newName string, requestID string) (string, error) {
+	if err := validateThreadName(newName); err != nil {
+		return "", err
+	}
+
+	conversationsMu.Lock()
+	threads := userThreadsLocked(userID)
+	if oldName == "" {
+		oldName = threads.Current
+	}
+	conversation, exists := threads.Threads[oldName]
+	if !exists {
+		conversationsMu.Unlock()
+		return "", fmt.Errorf("thread %q not found", oldName)
+	}
+	if _, taken := threads.Threads[newName]; taken {
+		conversationsMu.Unlock()
+		return "", fmt.Errorf("thread %q already exists", newName)
+	}
+	delete(threads.Threads, oldName)
+	conversation.Name = newName
+	threads.Threads[newName] = conversation
+	if threads.Current == oldName {
+		threads.Current = newName
+	}
+	conversationsMu.Unlock()
+
+	saveConversations()
+	logInfo("[%s] User %d renamed thread %q to %q", requestID, userID, oldName, newName)
+	return oldName, nil
+}
+
+// Delete a thread. If it was the current thread, another one (or a new
+// default thread) becomes current.
+func deleteThread(userID int64, name string, requestID string) error {
+	conversationsMu.Lock()
+	threads := userThreadsLocked(userID)
+	if _, exists := threads.Threads[name]; !exists {
+		conversationsMu.Unlock()
+		return fmt.Errorf("thread %q not found", name)
+	}
+	delete(threads.Threads, name)
+	userThreadsLocked(userID)
+	conversationsMu.Unlock()
+
+	saveConversations()
+	logInfo("[%s] User %d deleted thread %q", requestID, userID, name)
+	return nil
+}
+
+// Make the model of a thread the user's current model, if the user still has it
+func useThreadModel(userID int64, user User, conversation Conversation, requestID string) User {
+	if _, exists := user.Models[conversation.Model]; exists && conversation.Model != user.CurrentModel {
+		user.CurrentModel = conversation.Model
+		modifyUser(userID, requestID, func(stored *User) { stored.CurrentModel = conversation.Model })
+	}
+	return user
+}
+
+// Set the system prompt of the user's current thread
+func setThreadSystemPrompt(userID int64, prompt string, requestID string) {
+	conversationsMu.Lock()
+	threads := userThreadsLocked(userID)
+	name := threads.Current
+	threads.Threads[name].SystemPrompt = prompt
+	conversationsMu.Unlock()
+
+	saveConversations()
+	logDebug("[%s] Set system prompt of thread %q of user %d (%d chars)", requestID, name, userID, len(prompt))
+}
+
+// Set the model of the user's current thread
+func setThreadModel(userID int64, model string, requestID string) {
+	conversationsMu.Lock()
+	threads := userThreadsLocked(userID)
+	name := threads.Current
+	threads.Threads[name].Model = model
+	conversationsMu.Unlock()
+
+	saveConversations()
+	logDebug("[%s] Set model of thread %q of user %d to %s", requestID, name, userID, model)
+}
+
+// Set the title of a thread if it has none yet
+func setThreadTitle(userID int64, name string, title string, requestID string) {
+	conversationsMu.Lock()
+	conversation := userThreadsLocked(userID).Threads[name]
+	if conversation == nil || conversation.Title != "" {
+		conversationsMu.Unlock()
+		return
+	}
+	conversation.Title = title
+	conversationsMu.Unlock()
+
+	saveConversations()
+	logDebug("[%s] Titled thread %q of user %d: %s", requestID, name, userID, logContent(title))
+}
+
+// Get the thread names of a user in alphabetical order. The caller must hold conversationsMu.
+func sortedThreadNames(threads *UserThreads) []string {
+	names := make([]string, 0, len(threads.Threads))
+	for name := range threads.Threads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Describe the user's threads
+func formatThreadList(userID int64) string {
+	conversationsMu.Lock()
+	defer conversationsMu.Unlock()
+
+	threads := userThreadsLocked(userID)
+	var sb strings.Builder
+	sb.WriteString("Your threads:\n")
+	for _, name := range sortedThreadNames(threads) {
+		conversation := threads.Threads[name]
+		marker := "•"
+		if name == threads.Current {
+			marker = "▶"
+		}
+		sb.WriteString(fmt.Sprintf("%s %s", marker, name))
+		if conversation.Title != "" {
+			sb.WriteString(" - " + conversation.Title)
+		}
+		sb.WriteString(fmt.Sprintf(" (%d messages", len(conversation.Messages)))
+		if conversation.Model != "" {
+			sb.WriteString(", " + conversation.Model)
+		}
+		sb.WriteString(")\n")
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+// Generate a title for a thread from its first exchange with a cheap model
+func (b *Bot) generateThreadTitle(user User, userID int64, thread string, query string, answer string, requestID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), titleTimeout)
+	defer cancel()
+
+	messages := []Message{
+		{Role: "system", Content: "Write a short title (at most 6 words) for a conversation that starts with the exchange below. Reply with the title only, without quotes or punctuation at the end."},
+		{Role: "user", Content: fmt.Sprintf("User: %s\n\nAssistant: %s", truncateRunes(query, 1000), truncateRunes(answer, 1000))},
+	}
+	completion, err := b.queryUtilityModel(ctx, user, utilityModelID(user), messages, requestID)
+	if err != nil {
+		logError("[%s] Failed to generate a title for thread %q: %v", requestID, thread, err)
+		return
+	}
+	recordUsage(userID, completion, requestID)
+
+	title := strings.Trim(strings.TrimSpace(strings.SplitN(completion.Content, "\n", 2)[0]), `"'.`)
+	if title == "" {
+		return
+	}
+	setThreadTitle(userID, thread, truncateRunes(title, maxTitleLength), requestID)
+}
+
+// Shorten text to at most n runes, marking the cut with an ellipsis
+func truncateRunes(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n-1]) + "…"
+}
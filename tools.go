@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	maxToolSteps       = 5    // Most rounds of tool calls before the model must answer
+	maxToolResultRunes = 8000 // Longest tool result passed back to the model
+)
+
+const toolsUsage = `Usage:
+/tools - List the tools and whether they are enabled
+/tools on|off - Let the model call tools while answering
+/tools enable <tool> - Enable a tool
+/tools disable <tool> - Disable a tool`
+
+// Tool is a function the model can call while answering
+type Tool interface {
+	Name() string
+	Description() string
+	// JSON schema of the arguments object
+	Parameters() json.RawMessage
+	// Run the tool with the arguments chosen by the model and return the
+	// result as text for the model
+	Execute(ctx context.Context, arguments json.RawMessage) (string, error)
+}
+
+// ToolDefinition describes a tool to the API
+type ToolDefinition struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		Parameters  json.RawMessage `json:"parameters"`
+	} `json:"function"`
+}
+
+// ToolSettings are the user's tool calling preferences
+type ToolSettings struct {
+	Enabled  bool     `json:"enabled,omitempty"`
+	Disabled []string `json:"disabled,omitempty"` // names of tools the model may not call
+}
+
+// Registered tools, by name
+var toolRegistry = make(map[string]Tool)
+
+// Make a tool available to the models
+func registerTool(tool Tool) {
+	if _, exists := toolRegistry[tool.Name()]; exists {
+		panic("tool registered twice: " + tool.Name())
+	}
+	toolRegistry[tool.Name()] = tool
+}
+
+// Get the definitions of the tools the user lets the model call
+func enabledToolDefinitions(settings ToolSettings) []ToolDefinition {
+	if !settings.Enabled {
+		return nil
+	}
+	var definitions []ToolDefinition
+	for _, name := range sortedKeys(toolRegistry) {
+		if slices.Contains(settings.Disabled, name) {
+			continue
+		}
+		tool := toolRegistry[name]
+		definition := ToolDefinition{Type: "function"}
+		definition.Function.Name = tool.Name()
+		definition.Function.Description = tool.Description()
+		definition.Function.Parameters = tool.Parameters()
+		definitions = append(definitions, definition)
+	}
+	return definitions
+}
+
+// Query the model, running the tools it calls and sending their results back
+// until it answers. After maxToolSteps rounds of tool calls the model has to
+// answer without tools. Without enabled tools this is a plain query.
+func (b *Bot) queryWithTools(ctx context.Context, user User, messages []Message, requestID string) (*Completion, error) {
+	definitions := enabledToolDefinitions(user.Tools)
+	if len(definitions) == 0 || !currentProvider(user).Capabilities.Tools {
+		return b.queryOpenRouterWithContext(ctx, user, messages, requestID)
+	}
+
+	var used []string
+	var usage *Usage
+	var citations []Citation
+	cached := true
+	for step := 0; ; step++ {
+		request := OpenRouterRequest{Messages: messages, Tools: definitions}
+		if step == maxToolSteps {
+			logInfo("[%s] Reached %d rounds of tool calls, asking for an answer", requestID, maxToolSteps)
+			request.ToolChoice = "none"
+		}
+		completion, err := b.queryOpenRouter(ctx, user, request, requestID)
+		if step == 0 && isToolsUnsupportedError(err) {
+			logInfo("[%s] Model does not support tools, asking without them: %v", requestID, err)
+			return b.queryOpenRouterWithContext(ctx, user, messages, requestID)
+		}
+		if completion != nil {
+			usage = addUsage(usage, completion.Usage)
+			cached = cached && completion.Cached
+			citations = mergeCitations(citations, completion.Citations)
+		}
+		if err != nil || len(completion.ToolCalls) == 0 || step == maxToolSteps {
+			if completion != nil {
+				completion.Usage = usage
+				completion.Cached = cached
+				completion.ToolsUsed = used
+				completion.Citations = citations
+				completion.ToolCalls = nil
+			}
+			return completion, err
+		}
+
+		messages = append(messages, Message{Role: "assistant", Content: completion.Content, ToolCalls: completion.ToolCalls})
+		for _, call := range completion.ToolCalls {
+			used = append(used, call.Function.Name)
+			result := executeToolCall(ctx, user.Tools, call, requestID)
+			messages = append(messages, Message{Role: "tool", ToolCallID: call.ID, Content: result})
+		}
+		if ctx.Err() != nil {
+			return &Completion{Usage: usage, ToolsUsed: used}, fmt.Errorf("generation interrupted: %w", context.Cause(ctx))
+		}
+	}
+}
+
+// Run a tool call and get the result for the model. Failures are reported
+// to the model as the result so that it can recover.
+func executeToolCall(ctx context.Context, settings ToolSettings, call ToolCall, requestID string) string {
+	name := call.Function.Name
+	tool, exists := toolRegistry[name]
+	if !exists || slices.Contains(settings.Disabled, name) {
+		logError("[%s] Model called unknown tool %q", requestID, name)
+		return fmt.Sprintf("Error: unknown tool %q", name)
+	}
+
+	arguments := json.RawMessage(call.Function.Arguments)
+	if strings.TrimSpace(call.Function.Arguments) == "" {
+		arguments = json.RawMessage("{}")
+	}
+	logInfo("[%s] Running tool %s with arguments %s", requestID, name, arguments)
+	result, err := tool.Execute(ctx, arguments)
+	if err != nil {
+		logInfo("[%s] Tool %s failed: %v", requestID, name, err)
+		return "Error: " + err.Error()
+	}
+	logDebug("[%s] Tool %s returned %d chars", requestID, name, len(result))
+	return truncateRunes(result, maxToolResultRunes)
+}
+
+// Check whether a request failed because the model cannot call tools
+func isToolsUnsupportedError(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	message := strings.ToLower(apiErr.Message)
+	return strings.Contains(message, "tool use") || strings.Contains(message, "support tools")
+}
+
+// Add the usage of another request to a total
+func addUsage(total *Usage, usage *Usage) *Usage {
+	if usage == nil {
+		return total
+	}
+	if total == nil {
+		copied := *usage
+		return &copied
+	}
+	total.PromptTokens += usage.PromptTokens
+	total.CompletionTokens += usage.CompletionTokens
+	total.TotalTokens += usage.TotalTokens
+	total.Cost += usage.Cost
+	return total
+}
+
+// Describe the tools run for an answer, such as "calculator ×2, get_current_time"
+func formatToolsUsed(used []string) string {
+	counts := make(map[string]int)
+	var names []string
+	for _, name := range used {
+		if counts[name] == 0 {
+			names = append(names, name)
+		}
+		counts[name]++
+	}
+	for i, name := range names {
+		if counts[name] > 1 {
+			names[i] = fmt.Sprintf("%s ×%d", name, counts[name])
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// Handle the /tools command
+func (b *Bot) handleToolsCommand(chatID int64, userID int64, user User, args string, requestID string) {
+	fields := strings.Fields(strings.ToLower(args))
+	if len(fields) == 0 {
+		b.sendMessage(chatID, formatTools(user.Tools)+"\n\n"+toolsUsage, requestID)
+		return
+	}
+
+	switch {
+	case len(fields) == 1 && (fields[0] == "on" || fields[0] == "off"):
+		user.Tools.Enabled = fields[0] == "on"
+		modifyUser(userID, requestID, func(stored *User) { stored.Tools.Enabled = user.Tools.Enabled })
+		if user.Tools.Enabled {
+			b.sendMessage(chatID, "Tools enabled. The model can now call them while answering.", requestID)
+		} else {
+			b.sendMessage(chatID, "Tools disabled.", requestID)
+		}
+	case len(fields) == 2 && (fields[0] == "enable" || fields[0] == "disable"):
+		name := fields[1]
+		if _, exists := toolRegistry[name]; !exists {
+			b.sendMessage(chatID, fmt.Sprintf("❌ Tool %q not found. Use /tools to list the tools.", name), requestID)
+			return
+		}
+		modifyUser(userID, requestID, func(stored *User) {
+			// A new slice, since the list of the old profile may be in use
+			disabled := slices.DeleteFunc(slices.Clone(stored.Tools.Disabled), func(disabled string) bool { return disabled == name })
+			if fields[0] == "disable" {
+				disabled = append(disabled, name)
+			}
+			stored.Tools.Disabled = disabled
+		})
+		b.sendMessage(chatID, fmt.Sprintf("Tool %s %sd.", name, fields[0]), requestID)
+	default:
+		b.sendMessage(chatID, toolsUsage, requestID)
+	}
+}
+
+// Describe the tools and the user's settings
+func formatTools(settings ToolSettings) string {
+	var sb strings.Builder
+	if settings.Enabled {
+		sb.WriteString("Tools are enabled:\n")
+	} else {
+		sb.WriteString("Tools are disabled. Available tools:\n")
+	}
+	for _, name := range sortedKeys(toolRegistry) {
+		marker := "✅"
+		if slices.Contains(settings.Disabled, name) {
+			marker = "🚫"
+		}
+		sb.WriteString(fmt.Sprintf("%s %s - %s\n", marker, name, toolRegistry[name].Description()))
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace exporters, chosen with the OTEL_TRACES_EXPORTER environment variable
+const (
+	TraceExporterNone   = "none" // default: spans are not recorded
+	TraceExporterOTLP   = "otlp" // OTLP over HTTP, configured with the OTEL_EXPORTER_OTLP_* variables
+	TraceExporterStdout = "stdout"
+)
+
+const (
+	serviceName            = "tgbot"
+	tracingShutdownTimeout = 5 * time.Second
+)
+
+// Tracer of the bot's spans. It does nothing until initTracing sets up an exporter.
+var tracer = otel.Tracer(serviceName)
+
+// Spans of the messages being handled, by chat, used as the parents of the
+// Telegram requests since the TelegramSender methods have no context. The
+// queue handles one message of a chat at a time.
+var (
+	chatSpans   = make(map[int64]trace.SpanContext)
+	chatSpansMu sync.Mutex
+)
+
+// Set up the exporter chosen with OTEL_TRACES_EXPORTER. The stdout exporter
+// writes to out, next to the logs. Returns a function flushing the spans
+// that are not exported yet, to call before exiting.
+func initTracing(out io.Writer) func() {
+	var exporter sdktrace.SpanExporter
+	var err error
+	name := strings.ToLower(strings.TrimSpace(os.Getenv("OTEL_TRACES_EXPORTER")))
+	switch name {
+	case "", TraceExporterNone:
+		return func() {}
+	case TraceExporterOTLP:
+		exporter, err = otlptracehttp.New(context.Background())
+	case TraceExporterStdout, "console":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(out))
+	default:
+		logError("Unknown OTEL_TRACES_EXPORTER %q, tracing is disabled", name)
+		return func() {}
+	}
+	if err != nil {
+		logError("Failed to create the %s trace exporter, tracing is disabled: %v", name, err)
+		return func() {}
+	}
+
+	// Attributes of the environment, such as OTEL_SERVICE_NAME, override the defaults
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		logError("Failed to describe the trace resource: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	logInfo("Exporting traces with the %s exporter", name)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			logError("Failed to flush traces: %v", err)
+		}
+	}
+}
+
+// End a span, marking it as failed if err is not nil
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Run a storage operation, such as saving a conversation, in a span
+func traceStorage(ctx context.Context, name string, operation func()) {
+	_, span := tracer.Start(ctx, "storage."+name)
+	defer span.End()
+	operation()
+}
+
+// Make a span the parent of the Telegram requests of a chat. Returns a
+// function to call when the span ends.
+func setChatSpan(chatID int64, span trace.Span) func() {
+	spanContext := span.SpanContext()
+	if !spanContext.IsValid() {
+		return func() {}
+	}
+	chatSpansMu.Lock()
+	chatSpans[chatID] = spanContext
+	chatSpansMu.Unlock()
+
+	return func() {
+		chatSpansMu.Lock()
+		defer chatSpansMu.Unlock()
+		if chatSpans[chatID].Equal(spanContext) {
+			delete(chatSpans, chatID)
+		}
+	}
+}
+
+// Get the context of the span handling a message of a chat
+func chatSpanContext(chatID int64) context.Context {
+	chatSpansMu.Lock()
+	defer chatSpansMu.Unlock()
+	if spanContext, exists := chatSpans[chatID]; exists {
+		return trace.ContextWithSpanContext(context.Background(), spanContext)
+	}
+	return context.Background()
+}
+
+// Get the chat a Telegram request is sent to, 0 if it has none
+func chattableChatID(c tgbotapi.Chattable) int64 {
+	switch config := c.(type) {
+	case tgbotapi.MessageConfig:
+		return config.ChatID
+	case tgbotapi.EditMessageTextConfig:
+		return config.ChatID
+	case tgbotapi.DeleteMessageConfig:
+		return config.ChatID
+	case tgbotapi.ChatActionConfig:
+		return config.ChatID
+	case tgbotapi.DocumentConfig:
+		return config.ChatID
+	case tgbotapi.PhotoConfig:
+		return config.ChatID
+	}
+	return 0
+}
+
+// tracingTelegram records a span for every request of another TelegramSender,
+// so that each send and retry shows up in the trace of its message
+type tracingTelegram struct {
+	TelegramSender
+}
+
+// Start the span of a Telegram request
+func startTelegramSpan(c tgbotapi.Chattable) trace.Span {
+	chatID := chattableChatID(c)
+	_, span := tracer.Start(chatSpanContext(chatID), "telegram."+chattableName(c),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.Int64("chat_id", chatID)))
+	return span
+}
+
+func (t tracingTelegram) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	span := startTelegramSpan(c)
+	message, err := t.TelegramSender.Send(c)
+	endSpan(span, err)
+	return message, err
+}
+
+func (t tracingTelegram) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	span := startTelegramSpan(c)
+	response, err := t.TelegramSender.Request(c)
+	endSpan(span, err)
+	return response, err
+}
+
+// tracingLLMClient records a span for every request of another LLMClient
+type tracingLLMClient struct {
+	LLMClient
+}
+
+func (c tracingLLMClient) Chat(ctx context.Context, provider Provider, request OpenRouterRequest, requestID string) (*Completion, error) {
+	ctx, span := tracer.Start(ctx, "llm.chat", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("request_id", requestID),
+		attribute.String("llm.provider", provider.Name),
+		attribute.String("llm.model", request.Model),
+		attribute.Bool("llm.stream", request.Stream),
+		attribute.Int("llm.messages", len(request.Messages)),
+	))
+	completion, err := c.LLMClient.Chat(ctx, provider, request, requestID)
+	span.SetAttributes(attribute.String("http.status", apiStatus(err)))
+	if completion != nil {
+		span.SetAttributes(attribute.String("llm.response_model", completion.Model), attribute.Int("llm.tool_calls", len(completion.ToolCalls)))
+		if completion.Usage != nil {
+			span.SetAttributes(
+				attribute.Int("llm.prompt_tokens", completion.Usage.PromptTokens),
+				attribute.Int("llm.completion_tokens", completion.Usage.CompletionTokens),
+				attribute.Float64("llm.cost", completion.Usage.Cost),
+			)
+		}
+	}
+	endSpan(span, err)
+	return completion, err
+}
+
+func (c tracingLLMClient) Credits(ctx context.Context, apiToken string, requestID string) (*CreditsResponse, error) {
+	ctx, span := tracer.Start(ctx, "llm.credits", trace.WithSpanKind(trace.SpanKindClient))
+	credits, err := c.LLMClient.Credits(ctx, apiToken, requestID)
+	endSpan(span, err)
+	return credits, err
+}
+
+func (c tracingLLMClient) Models(ctx context.Context, requestID string) (map[string]CatalogModel, error) {
+	ctx, span := tracer.Start(ctx, "llm.models", trace.WithSpanKind(trace.SpanKindClient))
+	models, err := c.LLMClient.Models(ctx, requestID)
+	endSpan(span, err)
+	return models, err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const cacheUsage = `Usage:
+/cache - Show your cache setting
+/cache on - Reuse answers to identical requests made with temperature 0
+/cache force - Reuse answers to identical requests whatever the temperature
+/cache off - Always ask the model
+/cache clear - Remove all cached answers (admins only, the cache is shared)`
+
+// UsageStats counts the requests a user made to the models
+type UsageStats struct {
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+	CacheHits        int     `json:"cache_hits"`
+	CacheSavedCost   float64 `json:"cache_saved_cost"` // cost of the cached answers when they were generated
+}
+
+// Add a completed request to the user's usage stats. Answers from the cache
+// are counted as hits and do not add to the tokens and cost spent.
+func recordUsage(userID int64, completion *Completion, requestID string) {
+	configMu.Lock()
+	user, exists := config.Users[userID]
+	if !exists {
+		configMu.Unlock()
+		return
+	}
+	stats := &user.Usage
+	stats.Requests++
+	switch {
+	case completion.Cached:
+		stats.CacheHits++
+		if completion.Usage != nil {
+			stats.CacheSavedCost += completion.Usage.Cost
+		}
+	case completion.Usage != nil:
+		stats.PromptTokens += completion.Usage.PromptTokens
+		stats.CompletionTokens += completion.Usage.CompletionTokens
+		stats.Cost += completion.Usage.Cost
+	}
+	config.Users[userID] = user
+	addRequestStatsLocked(completion)
+	configMu.Unlock()
+
+	observeUsage(completion)
+	saveConfig()
+	logDebug("[%s] Recorded usage of user %d (cached: %v)", requestID, userID, completion.Cached)
+}
+
+// Handle the /usage command
+func (b *Bot) handleUsageCommand(chatID int64, userID int64, user User, args string, requestID string) {
+	if strings.TrimSpace(strings.ToLower(args)) == "reset" {
+		modifyUser(userID, requestID, func(stored *User) { stored.Usage = UsageStats{} })
+		b.sendMessage(chatID, "Usage stats reset.", requestID)
+		return
+	}
+	b.sendMessage(chatID, formatUsageStats(user.Usage)+"\n\nUse /usage reset to start counting again.", requestID)
+}
+
+// Describe the user's usage stats
+func formatUsageStats(stats UsageStats) string {
+	var sb strings.Builder
+	sb.WriteString("Your usage:\n")
+	sb.WriteString(fmt.Sprintf("• Requests: %d\n", stats.Requests))
+	sb.WriteString(fmt.Sprintf("• Tokens: %d prompt + %d completion\n", stats.PromptTokens, stats.CompletionTokens))
+	sb.WriteString(fmt.Sprintf("• Cost: %s\n", formatCost(stats.Cost)))
+	sb.WriteString(fmt.Sprintf("• Cache hits: %d", stats.CacheHits))
+	if stats.Requests > 0 {
+		sb.WriteString(fmt.Sprintf(" (%d%% of requests)", stats.CacheHits*100/stats.Requests))
+	}
+	if stats.CacheSavedCost > 0 {
+		sb.WriteString(fmt.Sprintf(", saved %s", formatCost(stats.CacheSavedCost)))
+	}
+	return sb.String()
+}
+
+// Handle the /cache command
+func (b *Bot) handleCacheCommand(chatID int64, userID int64, user User, args string, requestID string) {
+	fields := strings.Fields(strings.ToLower(args))
+	if len(fields) == 0 {
+		mode := user.Cache
+		if mode == "" {
+			mode = CacheOff
+		}
+		b.sendMessage(chatID, fmt.Sprintf("Response cache: %s\n\n%s", mode, cacheUsage), requestID)
+		return
+	}
+	if len(fields) != 1 {
+		b.sendMessage(chatID, cacheUsage, requestID)
+		return
+	}
+
+	switch fields[0] {
+	case CacheOn, CacheOff, CacheForce:
+		modifyUser(userID, requestID, func(stored *User) { stored.Cache = fields[0] })
+		switch fields[0] {
+		case CacheOn:
+			b.sendMessage(chatID, "Response cache enabled for requests with temperature 0. Set it with /params temperature 0.", requestID)
+		case CacheForce:
+			b.sendMessage(chatID, "Response cache enabled for all requests. Identical requests get the same answer until it expires.", requestID)
+		default:
+			b.sendMessage(chatID, "Response cache disabled.", requestID)
+		}
+	case "clear":
+		if !isAdmin(userID) {
+			logInfo("[%s] User %d is not allowed to clear the cache", requestID, userID)
+			b.sendMessage(chatID, "❌ Only admins can clear the cache, which is shared by all users.", requestID)
+			return
+		}
+		count := responseCache.Clear()
+		logInfo("[%s] User %d cleared %d cached answers", requestID, userID, count)
+		b.sendMessage(chatID, fmt.Sprintf("Removed %d cached answers.", count), requestID)
+	default:
+		b.sendMessage(chatID, cacheUsage, requestID)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const webSearchResults = 5 // Search results given to the model by the web plugin
+
+const webUsage = `Usage:
+/web <question> - Answer one question with web search results
+/web on|off - Search the web for every message
+
+Answers based on web search list their sources below the text.`
+
+// Plugin enables an OpenRouter plugin for a request
+type Plugin struct {
+	ID         string `json:"id"`
+	MaxResults int    `json:"max_results,omitempty"`
+}
+
+// Annotation is extra information attached to an answer, such as the web
+// page a statement was taken from
+type Annotation struct {
+	Type        string `json:"type"`
+	URLCitation *struct {
+		URL   string `json:"url"`
+		Title string `json:"title"`
+	} `json:"url_citation,omitempty"`
+}
+
+// Citation is a web page an answer is based on
+type Citation struct {
+	URL   string
+	Title string
+}
+
+// Get the plugins to enable for the user's requests
+func requestPlugins(user User) []Plugin {
+	if !user.Web {
+		return nil
+	}
+	return []Plugin{{ID: "web", MaxResults: webSearchResults}}
+}
+
+// Add the URL citations among annotations to the citations of an answer
+func appendCitations(citations []Citation, annotations []Annotation) []Citation {
+	var cited []Citation
+	for _, annotation := range annotations {
+		if annotation.Type == "url_citation" && annotation.URLCitation != nil && annotation.URLCitation.URL != "" {
+			cited = append(cited, Citation{URL: annotation.URLCitation.URL, Title: strings.TrimSpace(annotation.URLCitation.Title)})
+		}
+	}
+	return mergeCitations(citations, cited)
+}
+
+// Add citations to a list, skipping pages that are already cited
+func mergeCitations(citations []Citation, more []Citation) []Citation {
+	for _, citation := range more {
+		if !slices.ContainsFunc(citations, func(c Citation) bool { return c.URL == citation.URL }) {
+			citations = append(citations, citation)
+		}
+	}
+	return citations
+}
+
+// Escape text for use as the label of a Markdown link. Brackets become
+// character references, since \[ and \] delimit math.
+func escapeMarkdownLinkText(text string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `[`, `&#91;`, `]`, `&#93;`, `&`, `&amp;`, `*`, `\*`, `_`, `\_`, "`", "\\`", `$`, `\$`)
+	return replacer.Replace(text)
+}
+
+// Format the sources of an answer as a numbered list of Markdown links
+func formatCitations(citations []Citation) string {
+	var sb strings.Builder
+	sb.WriteString("🔎 **Sources:**\n")
+	for i, citation := range citations {
+		title := citation.Title
+		if title == "" {
+			title = citation.URL
+		}
+		sb.WriteString(fmt.Sprintf("%d. [%s](<%s>)\n", i+1, escapeMarkdownLinkText(truncateRunes(title, 100)), citation.URL))
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+// Handle the /web command
+func (b *Bot) handleWebCommand(ctx context.Context, chatID int64, userID int64, user User, args string, requestID string) {
+	question := strings.TrimSpace(args)
+	switch strings.ToLower(question) {
+	case "":
+		status := "off"
+		if user.Web {
+			status = "on for every message"
+		}
+		b.sendMessage(chatID, fmt.Sprintf("Web search: %s\n\n%s", status, webUsage), requestID)
+	case "on", "off":
+		user.Web = strings.ToLower(question) == "on"
+		modifyUser(userID, requestID, func(stored *User) { stored.Web = user.Web })
+		if user.Web {
+			b.sendMessage(chatID, "Web search enabled. Every answer will use web search results and list its sources.", requestID)
+		} else {
+			b.sendMessage(chatID, "Web search disabled. Use /web <question> to search for a single question.", requestID)
+		}
+	default:
+		user.Web = true
+		b.answerQuery(ctx, chatID, userID, user, question, requestID)
+	}
+}